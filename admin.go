@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Roles stored in User.Role; an empty role is a regular user
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Audit actions of administrators
+const (
+	LogAdminDisableUser   = "admin_disable_user"
+	LogAdminEnableUser    = "admin_enable_user"
+	LogAdminDeleteUser    = "admin_delete_user"
+	LogAdminResetPassword = "admin_reset_password"
+	LogAdminSetRole       = "admin_set_role"
+	LogAdminDeleteWebhook = "admin_delete_webhook"
+	LogAdminDeleteBot     = "admin_delete_bot"
+)
+
+// AdminUser is a row of the admin user list
+type AdminUser struct {
+	Username    string    `json:"username"`
+	Role        string    `json:"role"`
+	IsBot       bool      `json:"is_bot,omitempty"`
+	BotOwner    string    `json:"bot_owner,omitempty"`
+	Disabled    bool      `json:"disabled"`
+	Suspended   time.Time `json:"suspended_until,omitempty"`
+	Locked      time.Time `json:"locked_until,omitempty"` // после неудачных попыток входа
+	TwoFactor   bool      `json:"two_factor"`
+	IsOnline    bool      `json:"is_online"`
+	LastSeen    time.Time `json:"last_seen"`
+	Messages    int       `json:"messages"`
+	StorageUsed int64     `json:"storage_used"`
+}
+
+// GroupInfo describes a group conversation for admins
+type GroupInfo struct {
+	GroupKey      string    `json:"group_key"`
+	Users         []string  `json:"users"`
+	Messages      int       `json:"messages"`
+	LastMessageAt time.Time `json:"last_message_at"`
+	StorageUsed   int64     `json:"storage_used"`
+}
+
+// InstanceStats is the overview on the admin console
+type InstanceStats struct {
+	Users           int   `json:"users"`
+	Bots            int   `json:"bots"`
+	DisabledUsers   int   `json:"disabled_users"`
+	OnlineUsers     int   `json:"online_users"`
+	Messages        int   `json:"messages"`
+	MessagesToday   int   `json:"messages_today"`
+	Groups          int   `json:"groups"`
+	Attachments     int   `json:"attachments"`
+	AttachmentBytes int64 `json:"attachment_bytes"`
+	PendingUploads  int   `json:"pending_uploads"`
+	Quarantined     int   `json:"quarantined"`
+	OpenReports     int   `json:"open_reports"`
+	Webhooks        int   `json:"webhooks"`
+	AuditEntries    int   `json:"audit_entries"`
+}
+
+var ErrUserNotFound = errors.New("user not found")
+
+// isAdmin reports whether the user has the admin role. Users listed in
+// config.Admins are admins regardless of their role, so the first admin
+// can be appointed without an existing one.
+func isAdmin(username string) bool {
+	if containsUser(config.Admins, username) {
+		return true
+	}
+	user := findUser(username)
+	return user != nil && user.Role == RoleAdmin && !user.Disabled && !user.isSuspended()
+}
+
+// updateUser applies fn to the stored user
+func updateUser(username string, fn func(*User)) error {
+	users := loadUsers()
+	for i := range users {
+		if users[i].Username == username {
+			fn(&users[i])
+			return saveUsers(users)
+		}
+	}
+	return ErrUserNotFound
+}
+
+// listUsers returns the users whose name contains query
+func listUsers(query string) []AdminUser {
+	query = strings.ToLower(strings.TrimSpace(query))
+	counts := make(map[string]int)
+	for _, msg := range loadMessages() {
+		counts[msg.FromUser]++
+	}
+
+	result := []AdminUser{}
+	for _, u := range loadUsers() {
+		if u.Deleted || (query != "" && !strings.Contains(strings.ToLower(u.Username), query)) {
+			continue
+		}
+		role := u.Role
+		if role == "" {
+			role = RoleUser
+		}
+		if containsUser(config.Admins, u.Username) {
+			role = RoleAdmin
+		}
+		var suspended time.Time
+		if u.isSuspended() {
+			suspended = u.SuspendedUntil
+		}
+		var locked time.Time
+		if u.isLocked() {
+			locked = u.LockedUntil
+		}
+		result = append(result, AdminUser{
+			Username:    u.Username,
+			Role:        role,
+			IsBot:       u.IsBot,
+			BotOwner:    u.BotOwner,
+			Disabled:    u.Disabled,
+			Suspended:   suspended,
+			Locked:      locked,
+			TwoFactor:   u.TOTPEnabled,
+			IsOnline:    u.IsOnline,
+			LastSeen:    u.LastSeen,
+			Messages:    counts[u.Username],
+			StorageUsed: userStorageUsage(u.Username).Used,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Username < result[j].Username })
+	return result
+}
+
+// setUserDisabled blocks or unblocks logging in; a blocked user is
+// signed out everywhere right away
+func setUserDisabled(username string, disabled bool) error {
+	if err := updateUser(username, func(u *User) {
+		u.Disabled = disabled
+		if disabled {
+			u.IsOnline = false
+		}
+	}); err != nil {
+		return err
+	}
+	if disabled {
+		return revokeUserSessions(username)
+	}
+	return nil
+}
+
+func setUserRole(username, role string) error {
+	if role != RoleUser && role != RoleAdmin {
+		return errors.New("unknown role")
+	}
+	return updateUser(username, func(u *User) {
+		u.Role = role
+	})
+}
+
+// resetUserPassword replaces the password with a random temporary one,
+// which the admin passes on to the user
+func resetUserPassword(username string) (string, error) {
+	user := findUser(username)
+	if user == nil || user.IsBot || user.Deleted {
+		return "", ErrUserNotFound
+	}
+	password, err := randomToken(8)
+	if err != nil {
+		return "", err
+	}
+	return password, setPassword(username, password)
+}
+
+// deleteUserAccount removes the account together with its bots, staged
+// attachments and unfinished uploads. Sent messages stay in the
+// conversations of the other participants. The user record is kept as a
+// placeholder (see markDeleted), so nobody can register the name and take
+// over the conversations, groups and files stored under it.
+func deleteUserAccount(username string) error {
+	user := findUser(username)
+	if user == nil || user.Deleted {
+		return ErrUserNotFound
+	}
+	if user.IsBot {
+		return deleteBot(user.BotOwner, username)
+	}
+
+	for _, bot := range loadBots() {
+		if bot.Owner == username {
+			if err := deleteBot(username, bot.Username); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := updateUser(username, markDeleted); err != nil {
+		return err
+	}
+	revokeUserSessions(username)
+	dropPasswordResets(username)
+
+	var staged []Attachment
+	for _, s := range loadStagedAttachments() {
+		if s.Owner == username {
+			staged = append(staged, s.Attachment)
+		}
+	}
+	if len(staged) > 0 && unstageAttachments(staged) == nil {
+		discardAttachments(staged)
+	}
+	for _, u := range loadUploads() {
+		if u.Owner == username {
+			removeUpload(u.ID)
+		}
+	}
+	return nil
+}
+
+// markDeleted turns a user record into the placeholder of a deleted
+// account: only the ID and the name are kept, and it cannot log in
+func markDeleted(u *User) {
+	*u = User{
+		ID:                u.ID,
+		Username:          u.Username,
+		IsBot:             u.IsBot,
+		BotOwner:          u.BotOwner,
+		Disabled:          true,
+		Deleted:           true,
+		LastSeen:          u.LastSeen,
+		PasswordChangedAt: time.Now(),
+	}
+}
+
+// disconnectUser closes all of the user's WebSockets
+func disconnectUser(username string) {
+	clientsMutex.RLock()
+	conn, ok := clients[username]
+	clientsMutex.RUnlock()
+	if ok {
+		conn.Close()
+	}
+	closeConns(func(ws wsSession) bool { return ws.username == username })
+}
+
+// listGroups returns all group conversations, most recently active first
+func listGroups() []GroupInfo {
+	byKey := make(map[string]*GroupInfo)
+	for _, msg := range loadMessages() {
+		if !msg.IsGroup {
+			continue
+		}
+		key := groupKey(msg.GroupUsers)
+		g, ok := byKey[key]
+		if !ok {
+			g = &GroupInfo{GroupKey: key, Users: msg.GroupUsers}
+			byKey[key] = g
+		}
+		g.Messages++
+		g.StorageUsed += attachmentsSize(msg.Attachments)
+		if msg.CreatedAt.After(g.LastMessageAt) {
+			g.LastMessageAt = msg.CreatedAt
+		}
+	}
+
+	groups := make([]GroupInfo, 0, len(byKey))
+	for _, g := range byKey {
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].LastMessageAt.After(groups[j].LastMessageAt) })
+	return groups
+}
+
+func instanceStats() InstanceStats {
+	var stats InstanceStats
+	for _, u := range loadUsers() {
+		if u.Deleted {
+			continue
+		}
+		if u.IsBot {
+			stats.Bots++
+			continue
+		}
+		stats.Users++
+		if u.Disabled {
+			stats.DisabledUsers++
+		}
+		if u.IsOnline {
+			stats.OnlineUsers++
+		}
+	}
+
+	today := time.Now().Truncate(24 * time.Hour)
+	groups := make(map[string]bool)
+	for _, msg := range loadMessages() {
+		stats.Messages++
+		if !msg.CreatedAt.Before(today) {
+			stats.MessagesToday++
+		}
+		if msg.IsGroup {
+			groups[groupKey(msg.GroupUsers)] = true
+		}
+		stats.Attachments += len(msg.Attachments)
+		stats.AttachmentBytes += attachmentsSize(msg.Attachments)
+	}
+	stats.Groups = len(groups)
+
+	uploadsMutex.Lock()
+	stats.PendingUploads = len(loadUploads())
+	uploadsMutex.Unlock()
+	quarantineMutex.Lock()
+	stats.Quarantined = len(loadQuarantine())
+	quarantineMutex.Unlock()
+	stats.Webhooks = len(loadIncomingWebhooks())
+	reportsMutex.Lock()
+	for _, rep := range loadReports() {
+		if rep.Status == ReportOpen {
+			stats.OpenReports++
+		}
+	}
+	reportsMutex.Unlock()
+
+	logMutex.RLock()
+	stats.AuditEntries = len(messageLogs)
+	logMutex.RUnlock()
+	return stats
+}
+
+// logAdminAction writes an admin action on target to the audit log
+func logAdminAction(r *http.Request, admin, action, target, before, after string) {
+	recordMessageLog(MessageLog{
+		Action: action,
+		UserID: admin,
+		Target: target,
+		Before: before,
+		After:  after,
+		IP:     clientIP(r),
+	})
+}
+
+// accountGuard ends the sessions of disabled, suspended and deleted
+// accounts, revoked sessions and sessions started before the last
+// password change
+func accountGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "session-name")
+		username, ok := session.Values["username"].(string)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authTime, _ := session.Values["auth_time"].(int64)
+		token, _ := session.Values["sid"].(string)
+		user := findUser(username)
+		if user != nil && !user.Disabled && !user.isSuspended() && sessionValid(user, authTime) {
+			// Сессия без записи на сервере отозвана или создана до их появления
+			if s := touchSession(r, token); s != nil && s.Username == username {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		delete(session.Values, "username")
+		delete(session.Values, "sid")
+		delete(session.Values, "auth_time")
+		session.Save(r, w)
+		switch {
+		case r.URL.Path == "/login" || r.URL.Path == "/login/unlock" || r.URL.Path == "/register" ||
+			strings.HasPrefix(r.URL.Path, "/password/") || strings.HasPrefix(r.URL.Path, "/static/"):
+			// Куки в этом запросе ещё старые: сессию дальше не читаем
+			r.Header.Del("Cookie")
+			next.ServeHTTP(w, r)
+		case r.Method == "GET" && !strings.HasPrefix(r.URL.Path, "/api/"):
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		default:
+			reason := "account disabled"
+			if user != nil && !user.Disabled && !user.isSuspended() {
+				reason = "session expired"
+			}
+			http.Error(w, reason, http.StatusUnauthorized)
+		}
+	})
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Attachment is the metadata of an uploaded file; the content itself
+// lives in the blob store under BlobKey
+type Attachment struct {
+	ID          string    `json:"id"`
+	BlobKey     string    `json:"blob_key"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+	ScanStatus  string    `json:"scan_status,omitempty"`
+	Caption     string    `json:"caption,omitempty"`
+
+	// Заполняются для изображений после загрузки (см. thumbnails.go)
+	Width      int         `json:"width,omitempty"`
+	Height     int         `json:"height,omitempty"`
+	BlurHash   string      `json:"blurhash,omitempty"`
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+}
+
+// blobKeys lists the blobs of the file and its thumbnails
+func (a *Attachment) blobKeys() []string {
+	keys := []string{a.BlobKey}
+	for _, t := range a.Thumbnails {
+		keys = append(keys, t.BlobKey)
+	}
+	return keys
+}
+
+// storeAttachment checks the file type, streams r into the blob store,
+// scans it and returns the attachment metadata. The attachment must not
+// be published if an error is returned.
+func storeAttachment(ctx context.Context, uploader, fileName string, r io.Reader) (*Attachment, error) {
+	contentType, content, err := inspectUpload(fileName, r)
+	if err != nil {
+		return nil, err
+	}
+	att, err := putAttachment(ctx, fileName, contentType, content)
+	if err != nil {
+		return nil, err
+	}
+	if err := scanAttachment(ctx, uploader, att); err != nil {
+		if !errors.Is(err, ErrFileRejected) {
+			releaseBlob(att.BlobKey)
+		}
+		return nil, err
+	}
+	return att, nil
+}
+
+func putAttachment(ctx context.Context, fileName, contentType string, r io.Reader) (*Attachment, error) {
+	info, err := putBlob(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Attachment{
+		ID:          id,
+		BlobKey:     info.Key,
+		FileName:    filepath.Base(fileName),
+		ContentType: contentType,
+		Size:        info.Size,
+		CreatedAt:   time.Now(),
+	}, nil
+}
+
+// A blob that was just stored may belong to an upload whose message is
+// not saved or staged yet, and identical uploads share one blob. Such
+// blobs are leased: releaseBlob keeps them and tries again once the lease
+// has run out, by which time the upload is saved, staged or gone.
+const blobLeaseTime = time.Hour
+
+var (
+	blobLeases      = make(map[string]time.Time)
+	blobReleases    = make(map[string]bool) // отложенные освобождения арендованных блобов
+	blobLeasesMutex sync.Mutex
+)
+
+// putBlob stores r in the blob store and leases the blob
+func putBlob(ctx context.Context, r io.Reader) (BlobInfo, error) {
+	info, err := blobStore.Put(ctx, r)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	blobLeasesMutex.Lock()
+	defer blobLeasesMutex.Unlock()
+	// Между Put и арендой releaseBlob мог удалить такой же блоб
+	if _, err := blobStore.Stat(ctx, info.Key); err != nil {
+		return BlobInfo{}, fmt.Errorf("blob %s was removed during the upload, try again", info.Key)
+	}
+	blobLeases[info.Key] = time.Now()
+	return info, nil
+}
+
+// releaseBlob deletes the blob once no stored message or staged upload
+// references it and it is not leased. Blobs are shared between identical
+// uploads, so it must be called after the referencing message has been
+// removed.
+func releaseBlob(key string) {
+	blobLeasesMutex.Lock()
+	defer blobLeasesMutex.Unlock()
+
+	if leased, ok := blobLeases[key]; ok && time.Since(leased) < blobLeaseTime {
+		blobReleases[key] = true
+		return
+	}
+	delete(blobLeases, key)
+	delete(blobReleases, key)
+
+	if isQuarantined(key) {
+		return
+	}
+	for _, msg := range loadMessages() {
+		for _, att := range msg.Attachments {
+			for _, k := range att.blobKeys() {
+				if k == key {
+					return
+				}
+			}
+		}
+	}
+	for _, staged := range loadStagedAttachments() {
+		if staged.Attachment.BlobKey == key {
+			return
+		}
+	}
+	if err := blobStore.Delete(context.Background(), key); err != nil {
+		log.Printf("Failed to delete blob %s: %v", key, err)
+	}
+}
+
+// expireBlobLeases drops leases that have run out and retries the
+// releases that were put off because of them
+func expireBlobLeases() {
+	blobLeasesMutex.Lock()
+	var due []string
+	for key, leased := range blobLeases {
+		if time.Since(leased) >= blobLeaseTime {
+			delete(blobLeases, key)
+			if blobReleases[key] {
+				due = append(due, key)
+			}
+		}
+	}
+	blobLeasesMutex.Unlock()
+
+	for _, key := range due {
+		releaseBlob(key)
+	}
+}
+
+// migrateAttachments moves base64 FileData left in messages.json by older
+// versions into the blob store and converts single attachments into
+// the Attachments list
+func migrateAttachments() error {
+	messages := loadMessages()
+	migrated := 0
+	for i := range messages {
+		msg := &messages[i]
+		if msg.Attachment != nil {
+			msg.Attachments = append([]Attachment{*msg.Attachment}, msg.Attachments...)
+			msg.Attachment = nil
+			migrated++
+		}
+		if msg.FileData == "" {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(msg.FileData)
+		if err != nil {
+			log.Printf("Message %d: invalid file data, skipped: %v", msg.ID, err)
+			continue
+		}
+		// Старые файлы переносятся как есть, их тип определяется по содержимому
+		contentType := sniffContentType(data)
+		if !inlineSafeTypes[contentType] {
+			contentType = "application/octet-stream"
+		}
+		att, err := putAttachment(context.Background(), msg.FileName, contentType, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		att.CreatedAt = msg.CreatedAt
+		msg.Attachments = append(msg.Attachments, *att)
+		msg.FileData = ""
+		migrated++
+	}
+	if migrated == 0 {
+		return nil
+	}
+	log.Printf("Migrated attachments of %d messages", migrated)
+	return saveMessages(messages)
+}
+
+// isParticipant reports whether username takes part in the message's conversation
+func isParticipant(msg Message, username string) bool {
+	if msg.IsGroup {
+		return containsUser(msg.GroupUsers, username)
+	}
+	return msg.FromUser == username || msg.ToUser == username
+}
+
+// findAttachment returns the attachment with the given ID and its message
+func findAttachment(id string) (*Attachment, *Message) {
+	for _, msg := range loadMessages() {
+		for i := range msg.Attachments {
+			if msg.Attachments[i].ID == id {
+				return &msg.Attachments[i], &msg
+			}
+		}
+	}
+	return nil, nil
+}
+
+// attachmentDisposition shows only types that are safe to render from
+// our origin inline and offers everything else as a download
+func attachmentDisposition(att *Attachment, forceDownload bool) string {
+	disposition := "attachment"
+	if !forceDownload && inlineSafeTypes[att.ContentType] {
+		disposition = "inline"
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": att.FileName})
+}
+
+const maxAttachmentsPerMessage = 10
+
+var ErrTooManyAttachments = fmt.Errorf("too many attachments (max %d)", maxAttachmentsPerMessage)
+
+// AttachmentRef points to a staged attachment when a message is sent
+// through the JSON API or the WebSocket
+type AttachmentRef struct {
+	ID      string `json:"id"`
+	Caption string `json:"caption,omitempty"`
+}
+
+// StagedAttachment is an uploaded file that is not part of a message yet
+type StagedAttachment struct {
+	Attachment Attachment `json:"attachment"`
+	Owner      string     `json:"owner"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	// Sending is set while a message with the file is being sent, so a
+	// parallel send cannot take the same file
+	Sending bool `json:"sending,omitempty"`
+}
+
+var (
+	stagedAttachmentsFile = "data/staged_attachments.json"
+	stagedMutex           sync.Mutex
+)
+
+func loadStagedAttachments() []StagedAttachment {
+	data, err := os.ReadFile(stagedAttachmentsFile)
+	if err != nil {
+		return []StagedAttachment{}
+	}
+
+	var staged []StagedAttachment
+	json.Unmarshal(data, &staged)
+	return staged
+}
+
+func saveStagedAttachments(staged []StagedAttachment) error {
+	data, err := json.MarshalIndent(staged, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(stagedAttachmentsFile, data, 0644)
+}
+
+// storeAttachments stores several uploaded files for one message. Either
+// all of them are stored or, on the first failure, none. Their space stays
+// reserved in the quota until the caller calls release, after the message
+// is saved or the files are staged or discarded.
+func storeAttachments(ctx context.Context, uploader string, target Message, files []*multipart.FileHeader, captions []string) ([]Attachment, func(), error) {
+	if len(files) > maxAttachmentsPerMessage {
+		return nil, nil, ErrTooManyAttachments
+	}
+	var total int64
+	for _, fh := range files {
+		if err := validateMediaFile(fh.Filename, fh.Size); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", fh.Filename, err)
+		}
+		total += fh.Size
+	}
+	release, err := reserveQuota(uploader, target, total)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	atts := make([]Attachment, 0, len(files))
+	for i, fh := range files {
+		att, err := storeFileHeader(ctx, uploader, fh)
+		if err != nil {
+			discardAttachments(atts)
+			release()
+			return nil, nil, fmt.Errorf("%s: %w", fh.Filename, err)
+		}
+		if i < len(captions) {
+			att.Caption = strings.TrimSpace(captions[i])
+		}
+		atts = append(atts, *att)
+	}
+	return atts, release, nil
+}
+
+func storeFileHeader(ctx context.Context, uploader string, fh *multipart.FileHeader) (*Attachment, error) {
+	file, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return storeAttachment(ctx, uploader, fh.Filename, file)
+}
+
+// discardAttachments removes blobs of attachments that were never published
+func discardAttachments(atts []Attachment) {
+	for _, att := range atts {
+		releaseBlob(att.BlobKey)
+	}
+}
+
+// stageAttachments keeps uploaded files until the owner sends them
+func stageAttachments(owner string, atts []Attachment) error {
+	stagedMutex.Lock()
+	defer stagedMutex.Unlock()
+
+	staged := loadStagedAttachments()
+	for _, att := range atts {
+		staged = append(staged, StagedAttachment{
+			Attachment: att,
+			Owner:      owner,
+			ExpiresAt:  time.Now().Add(uploadExpiry()),
+		})
+	}
+	return saveStagedAttachments(staged)
+}
+
+// claimStagedAttachments returns the owner's staged attachments in the
+// order of refs, with their captions, and marks them as being sent in the
+// same step. The caller either unstages them or gives them back with
+// unclaimStagedAttachments. Files stay staged meanwhile, so they are
+// still counted and their blobs kept.
+func claimStagedAttachments(owner string, refs []AttachmentRef) ([]Attachment, error) {
+	if len(refs) > maxAttachmentsPerMessage {
+		return nil, ErrTooManyAttachments
+	}
+	stagedMutex.Lock()
+	defer stagedMutex.Unlock()
+
+	all := loadStagedAttachments()
+	staged := make(map[string]int)
+	for i, s := range all {
+		// Файл, который уже отправляется, считается занятым
+		if s.Owner == owner && !s.Sending {
+			staged[s.Attachment.ID] = i
+		}
+	}
+	atts := make([]Attachment, 0, len(refs))
+	used := make(map[string]bool)
+	for _, ref := range refs {
+		i, ok := staged[ref.ID]
+		if !ok || used[ref.ID] {
+			return nil, fmt.Errorf("attachment %s not found", ref.ID)
+		}
+		used[ref.ID] = true
+		att := all[i].Attachment
+		att.Caption = strings.TrimSpace(ref.Caption)
+		atts = append(atts, att)
+	}
+	for _, i := range staged {
+		if used[all[i].Attachment.ID] {
+			all[i].Sending = true
+		}
+	}
+	if err := saveStagedAttachments(all); err != nil {
+		return nil, err
+	}
+	return atts, nil
+}
+
+// unclaimStagedAttachments makes attachments whose message was not sent
+// available again
+func unclaimStagedAttachments(atts []Attachment) error {
+	stagedMutex.Lock()
+	defer stagedMutex.Unlock()
+
+	claimed := make(map[string]bool)
+	for _, att := range atts {
+		claimed[att.ID] = true
+	}
+	staged := loadStagedAttachments()
+	for i := range staged {
+		if claimed[staged[i].Attachment.ID] {
+			staged[i].Sending = false
+		}
+	}
+	return saveStagedAttachments(staged)
+}
+
+func unstageAttachments(atts []Attachment) error {
+	stagedMutex.Lock()
+	defer stagedMutex.Unlock()
+
+	sent := make(map[string]bool)
+	for _, att := range atts {
+		sent[att.ID] = true
+	}
+	staged := loadStagedAttachments()
+	kept := staged[:0]
+	for _, s := range staged {
+		if !sent[s.Attachment.ID] {
+			kept = append(kept, s)
+		}
+	}
+	return saveStagedAttachments(kept)
+}
+
+// expireStagedAttachments removes staged files that were never sent
+func expireStagedAttachments() {
+	stagedMutex.Lock()
+	now := time.Now()
+	staged := loadStagedAttachments()
+	kept := staged[:0]
+	var expired []Attachment
+	for _, s := range staged {
+		// Файл, который сейчас отправляется, не трогаем; зависшая
+		// отправка освобождает его позже
+		if s.Sending && now.Before(s.ExpiresAt.Add(blobLeaseTime)) {
+			kept = append(kept, s)
+			continue
+		}
+		if now.After(s.ExpiresAt) {
+			expired = append(expired, s.Attachment)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	if len(expired) > 0 {
+		saveStagedAttachments(kept)
+	}
+	stagedMutex.Unlock()
+
+	discardAttachments(expired)
+}
+
+// sendMessageWithAttachments creates a message with atts in the target
+// conversation and delivers it live. On error nothing is published and
+// the caller decides what happens to the attachments.
+func sendMessageWithAttachments(from string, target Message, content string, atts []Attachment) (Message, error) {
+	msg := Message{
+		FromUser:   from,
+		ToUser:     target.ToUser,
+		Content:    content,
+		CreatedAt:  time.Now(),
+		IsGroup:    target.IsGroup,
+		GroupUsers: target.GroupUsers,
+		ReplyTo:    target.ReplyTo,
+		ClientIP:   target.ClientIP,
+	}
+	if msg.IsGroup {
+		msg.ToUser = "group"
+	}
+	setAttachments(&msg, atts)
+	if err := appendMessage(&msg); err != nil {
+		return Message{}, err
+	}
+
+	deliverMessage(msg)
+	return msg, nil
+}
+
+// sendStagedMessage sends a message with previously staged attachments.
+// Staged files already count against the sender's quota; a group has to
+// have room for them as well.
+func sendStagedMessage(from string, target Message, content string, refs []AttachmentRef) (Message, error) {
+	atts, err := claimStagedAttachments(from, refs)
+	if err != nil {
+		return Message{}, err
+	}
+	msg, err := sendClaimedAttachments(from, target, content, atts)
+	if err != nil {
+		if err := unclaimStagedAttachments(atts); err != nil {
+			log.Printf("Failed to unclaim staged attachments: %v", err)
+		}
+		return Message{}, err
+	}
+	if err := unstageAttachments(atts); err != nil {
+		log.Printf("Failed to unstage attachments of message %d: %v", msg.ID, err)
+	}
+	return msg, nil
+}
+
+// sendClaimedAttachments sends claimed staged files after reserving room
+// for them in the group's quota
+func sendClaimedAttachments(from string, target Message, content string, atts []Attachment) (Message, error) {
+	if target.IsGroup && len(atts) > 0 {
+		release, err := reserveGroupQuota(target.GroupUsers, attachmentsSize(atts))
+		if err != nil {
+			return Message{}, err
+		}
+		defer release()
+	}
+	return sendMessageWithAttachments(from, target, content, atts)
+}
+
+// setAttachments fills the attachment fields of msg; HasFile and FileName
+// are kept for older clients
+func setAttachments(msg *Message, atts []Attachment) {
+	msg.Attachments = atts
+	msg.HasFile = len(atts) > 0
+	msg.FileName = ""
+	if len(atts) > 0 {
+		msg.FileName = atts[0].FileName
+	}
+}
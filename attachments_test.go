@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTempBlobStore points the blob store and the files releaseBlob reads
+// at a temporary directory
+func useTempBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalBlobStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldStore, oldMessages, oldStaged, oldQuarantine := blobStore, messagesFile, stagedAttachmentsFile, quarantineFile
+	blobStore = store
+	messagesFile = filepath.Join(dir, "messages.json")
+	stagedAttachmentsFile = filepath.Join(dir, "staged_attachments.json")
+	quarantineFile = filepath.Join(dir, "quarantine.json")
+	t.Cleanup(func() {
+		blobStore, messagesFile, stagedAttachmentsFile, quarantineFile = oldStore, oldMessages, oldStaged, oldQuarantine
+		blobLeasesMutex.Lock()
+		blobLeases = make(map[string]time.Time)
+		blobReleases = make(map[string]bool)
+		blobLeasesMutex.Unlock()
+	})
+}
+
+func TestReleaseBlobKeepsLeasedBlob(t *testing.T) {
+	useTempBlobStore(t)
+	ctx := context.Background()
+
+	// Два пользователя загрузили одинаковый файл; отправка одного не удалась
+	first, err := putAttachment(ctx, "a.txt", "text/plain", bytes.NewReader([]byte("same bytes")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := putAttachment(ctx, "b.txt", "text/plain", bytes.NewReader([]byte("same bytes")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.BlobKey != second.BlobKey {
+		t.Fatalf("identical uploads got different blobs")
+	}
+
+	discardAttachments([]Attachment{*second})
+	if _, err := blobStore.Stat(ctx, first.BlobKey); err != nil {
+		t.Fatalf("blob of the unsaved upload was deleted: %v", err)
+	}
+
+	// Первое сообщение сохранено, аренда истекла: блоб остаётся
+	if err := saveMessages([]Message{{ID: 1, Attachments: []Attachment{*first}}}); err != nil {
+		t.Fatal(err)
+	}
+	blobLeasesMutex.Lock()
+	blobLeases[first.BlobKey] = time.Now().Add(-blobLeaseTime)
+	blobLeasesMutex.Unlock()
+	expireBlobLeases()
+	if _, err := blobStore.Stat(ctx, first.BlobKey); err != nil {
+		t.Fatalf("blob of a saved message was deleted: %v", err)
+	}
+}
+
+func TestExpireBlobLeasesReleasesUnusedBlob(t *testing.T) {
+	useTempBlobStore(t)
+	ctx := context.Background()
+
+	att, err := putAttachment(ctx, "a.txt", "text/plain", bytes.NewReader([]byte("orphan")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	discardAttachments([]Attachment{*att})
+	if _, err := blobStore.Stat(ctx, att.BlobKey); err != nil {
+		t.Fatalf("leased blob deleted early: %v", err)
+	}
+
+	blobLeasesMutex.Lock()
+	blobLeases[att.BlobKey] = time.Now().Add(-blobLeaseTime)
+	blobLeasesMutex.Unlock()
+	expireBlobLeases()
+	if _, err := blobStore.Stat(ctx, att.BlobKey); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("unused blob kept after the lease ran out: %v", err)
+	}
+}
+
+func TestUpdateAttachmentKeepsConcurrentMessages(t *testing.T) {
+	useTempBlobStore(t)
+	att := Attachment{ID: "img"}
+	if err := saveMessages([]Message{{ID: 1, Attachments: []Attachment{att}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Фоновый обработчик миниатюр обновляет вложение, пока сохраняются новые сообщения
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			updateMessages(func(messages []Message) ([]Message, error) {
+				return append(messages, Message{ID: nextMessageID(messages)}), nil
+			})
+		}()
+		go func(i int) {
+			defer wg.Done()
+			if err := updateAttachment("img", func(a *Attachment) { a.Width = i }); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(loadMessages()); n != 21 {
+		t.Fatalf("%d messages after concurrent updates, want 21", n)
+	}
+}
+
+// expireAllBlobLeases ends every lease as if blobLeaseTime had passed
+func expireAllBlobLeases() {
+	blobLeasesMutex.Lock()
+	for key := range blobLeases {
+		blobLeases[key] = time.Now().Add(-blobLeaseTime)
+	}
+	blobLeasesMutex.Unlock()
+	expireBlobLeases()
+}
+
+func TestGeneratePreviewsReleasesReplacedThumbnails(t *testing.T) {
+	useTempBlobStore(t)
+	oldSizes := config.Thumbnails.Sizes
+	config.Thumbnails.Sizes = map[string]int{"small": 40}
+	t.Cleanup(func() { config.Thumbnails.Sizes = oldSizes })
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 100, 80))); err != nil {
+		t.Fatal(err)
+	}
+	att, err := putAttachment(ctx, "a.png", "image/png", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Миниатюра от прерванной задачи, размеры ещё не записаны
+	old, err := putBlob(ctx, bytes.NewReader([]byte("stale thumbnail")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	att.Thumbnails = []Thumbnail{{Size: "small", BlobKey: old.Key}}
+	if err := saveMessages([]Message{{ID: 1, Attachments: []Attachment{*att}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generatePreviews(att.ID); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := findAttachment(att.ID)
+	if stored.Width != 100 || len(stored.Thumbnails) != 1 || stored.Thumbnails[0].BlobKey == old.Key {
+		t.Fatalf("attachment after previews = %+v", stored)
+	}
+	// Повторная задача ничего не создаёт
+	if err := generatePreviews(att.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	expireAllBlobLeases()
+	if _, err := blobStore.Stat(ctx, old.Key); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("replaced thumbnail kept: %v", err)
+	}
+	if _, err := blobStore.Stat(ctx, stored.Thumbnails[0].BlobKey); err != nil {
+		t.Fatalf("new thumbnail deleted: %v", err)
+	}
+}
+
+func TestGeneratePreviewsReleasesThumbnailsOfRemovedMessage(t *testing.T) {
+	useTempBlobStore(t)
+	oldSizes := config.Thumbnails.Sizes
+	config.Thumbnails.Sizes = map[string]int{"small": 40}
+	t.Cleanup(func() { config.Thumbnails.Sizes = oldSizes })
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 100, 80))); err != nil {
+		t.Fatal(err)
+	}
+	att, err := putAttachment(ctx, "a.png", "image/png", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveMessages([]Message{{ID: 1, Attachments: []Attachment{*att}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Сообщение удаляется, пока создаются миниатюры: запись превью не удаётся
+	var thumbKey string
+	oldStore := blobStore
+	blobStore = removingStore{BlobStore: oldStore, onPut: func(key string) {
+		thumbKey = key
+		saveMessages([]Message{})
+	}}
+	err = generatePreviews(att.ID)
+	blobStore = oldStore
+	if err == nil {
+		t.Fatal("previews of a removed message were recorded")
+	}
+
+	expireAllBlobLeases()
+	if _, err := blobStore.Stat(ctx, thumbKey); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("thumbnail of a removed message kept: %v", err)
+	}
+}
+
+// removingStore calls onPut after every stored blob
+type removingStore struct {
+	BlobStore
+	onPut func(key string)
+}
+
+func (s removingStore) Put(ctx context.Context, r io.Reader) (BlobInfo, error) {
+	info, err := s.BlobStore.Put(ctx, r)
+	if err == nil {
+		s.onPut(info.Key)
+	}
+	return info, err
+}
+
+func TestSendStagedMessageTakesFileOnce(t *testing.T) {
+	useTempBlobStore(t)
+	useTempMessageLog(t)
+	oldUsers := usersFile
+	usersFile = filepath.Join(t.TempDir(), "users.json")
+	t.Cleanup(func() { usersFile = oldUsers })
+	for _, u := range []string{"alice", "bob"} {
+		if err := createUser(u, "secret123"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	att, err := putAttachment(context.Background(), "a.txt", "text/plain", bytes.NewReader([]byte("staged")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stageAttachments("alice", []Attachment{*att}); err != nil {
+		t.Fatal(err)
+	}
+	refs := []AttachmentRef{{ID: att.ID}}
+
+	// Неудачная отправка возвращает файл в черновики
+	if _, err := sendStagedMessage("alice", Message{ToUser: "nobody"}, "lost", refs); err == nil {
+		t.Fatal("send to a missing user succeeded")
+	}
+
+	// Две одновременные отправки одного файла: проходит только одна.
+	// Медленный хук держит первую отправку, пока идёт вторая
+	messageHooks.Register(MessageHook{Name: "slow", Phase: PhasePreValidate, Fn: func(ctx context.Context, msg *Message) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}})
+	t.Cleanup(func() { messageHooks.Unregister("slow") })
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = sendStagedMessage("alice", Message{ToUser: "bob"}, "file", refs)
+		}(i)
+	}
+	wg.Wait()
+
+	if (errs[0] == nil) == (errs[1] == nil) {
+		t.Fatalf("send results = %v, want exactly one success", errs)
+	}
+	if n := len(loadMessages()); n != 1 {
+		t.Fatalf("%d messages carry the staged file, want 1", n)
+	}
+	if staged := loadStagedAttachments(); len(staged) != 0 {
+		t.Fatalf("file still staged after the send: %+v", staged)
+	}
+}
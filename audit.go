@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// MessageLog is one entry of the audit trail. Entries are appended to
+// data/message_logs.jsonl and chained: Hash covers the entry together with
+// the hash of the previous one, so editing or removing a line breaks the chain.
+type MessageLog struct {
+	Seq          int       `json:"seq"`
+	MessageID    int       `json:"message_id,omitempty"`
+	Action       string    `json:"action"`  // create, edit, delete, react, read, members
+	UserID       string    `json:"user_id"` // кто выполнил действие
+	Target       string    `json:"target"`  // получатель или group:<groupKey>
+	Participants []string  `json:"participants,omitempty"`
+	Before       string    `json:"before,omitempty"`
+	After        string    `json:"after,omitempty"`
+	IP           string    `json:"ip,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+	Details      string    `json:"details,omitempty"`
+	PrevHash     string    `json:"prev_hash"`
+	Hash         string    `json:"hash"`
+}
+
+// Audit actions
+const (
+	LogCreate  = "create"
+	LogEdit    = "edit"
+	LogDelete  = "delete"
+	LogReact   = "react"
+	LogRead    = "read"
+	LogMembers = "members"
+)
+
+var messageLogsFile = "data/message_logs.jsonl"
+
+// computeHash hashes the entry without its own Hash field
+func (l MessageLog) computeHash() string {
+	l.Hash = ""
+	data, _ := json.Marshal(l)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadMessageLogs reads the audit trail into memory and verifies the chain.
+// A broken chain is reported but the entries are kept for investigation.
+func loadMessageLogs() error {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	f, err := os.Open(messageLogsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var logs []MessageLog
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry MessageLog
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("Message log: unreadable entry after seq %d: %v", len(logs), err)
+			continue
+		}
+		logs = append(logs, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if seq := verifyMessageLogs(logs); seq != 0 {
+		log.Printf("Message log chain is broken at entry %d, the log may have been tampered with", seq)
+	}
+	messageLogs = logs
+	return nil
+}
+
+// verifyMessageLogs returns the seq of the first entry that does not match
+// its hash or the previous entry, or 0 if the chain is intact
+func verifyMessageLogs(logs []MessageLog) int {
+	prev := ""
+	for _, entry := range logs {
+		if entry.PrevHash != prev || entry.computeHash() != entry.Hash {
+			return entry.Seq
+		}
+		prev = entry.Hash
+	}
+	return 0
+}
+
+// recordMessageLog chains and appends an entry to the audit trail
+func recordMessageLog(entry MessageLog) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	entry.Seq = len(messageLogs) + 1
+	entry.Timestamp = time.Now()
+	if len(messageLogs) > 0 {
+		entry.PrevHash = messageLogs[len(messageLogs)-1].Hash
+	}
+	entry.Hash = entry.computeHash()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Message log: %v", err)
+		return
+	}
+	f, err := os.OpenFile(messageLogsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Message log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("Message log: %v", err)
+		return
+	}
+	messageLogs = append(messageLogs, entry)
+}
+
+// logMessageAction records an action on msg by actor
+func logMessageAction(action string, msg Message, actor, ip, before, after string) {
+	recordMessageLog(MessageLog{
+		MessageID:    msg.ID,
+		Action:       action,
+		UserID:       actor,
+		Target:       logTarget(msg),
+		Participants: messageParticipants(msg),
+		Before:       before,
+		After:        after,
+		IP:           ip,
+	})
+}
+
+func logTarget(msg Message) string {
+	if msg.IsGroup {
+		return "group:" + groupKey(msg.GroupUsers)
+	}
+	return msg.ToUser
+}
+
+func messageParticipants(msg Message) []string {
+	if msg.IsGroup {
+		return append([]string(nil), msg.GroupUsers...)
+	}
+	return []string{msg.FromUser, msg.ToUser}
+}
+
+// canViewMessageLog reports whether a regular user may see the entry:
+// only entries of their own conversations (admins see everything)
+func canViewMessageLog(entry MessageLog, username string) bool {
+	return entry.UserID == username || containsUser(entry.Participants, username)
+}
+
+// clientIP returns the address the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore keeps attachment contents addressed by their SHA-256
+type BlobStore interface {
+	// Put stores the content of r and returns its key (hex SHA-256).
+	// Storing the same content twice keeps a single copy.
+	Put(ctx context.Context, r io.Reader) (BlobInfo, error)
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, BlobInfo, error)
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var (
+	ErrBlobNotFound = errors.New("blob not found")
+	blobKeyPattern  = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// StorageConfig selects and configures the blob store
+type StorageConfig struct {
+	Backend  string   `json:"backend"` // local или s3
+	LocalDir string   `json:"local_dir"`
+	S3       S3Config `json:"s3"`
+}
+
+type S3Config struct {
+	Endpoint  string `json:"endpoint"` // например https://s3.amazonaws.com или http://localhost:9000
+	Bucket    string `json:"bucket"`
+	Region    string `json:"region"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Prefix    string `json:"prefix"`
+}
+
+// NewBlobStore creates the blob store selected in the config
+func NewBlobStore(cfg StorageConfig) (BlobStore, error) {
+	switch cfg.Backend {
+	case "", "local":
+		return NewLocalBlobStore(cfg.LocalDir)
+	case "s3":
+		return NewS3BlobStore(cfg.S3)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+}
+
+// spoolBlob copies r into a temporary file while hashing it
+func spoolBlob(dir string, r io.Reader) (*os.File, string, int64, error) {
+	tmp, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		return nil, "", 0, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, "", 0, err
+	}
+	return tmp, hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// LocalBlobStore keeps blobs on disk as <dir>/<ab>/<sha256>
+type LocalBlobStore struct {
+	dir string
+}
+
+// NewLocalBlobStore creates a filesystem blob store rooted at dir
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if dir == "" {
+		dir = "data/blobs"
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0755); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return "", ErrBlobNotFound
+	}
+	return filepath.Join(s.dir, key[:2], key), nil
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, r io.Reader) (BlobInfo, error) {
+	tmp, key, size, err := spoolBlob(filepath.Join(s.dir, "tmp"), r)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Close(); err != nil {
+		return BlobInfo{}, err
+	}
+
+	dst, _ := s.path(key)
+	if info, err := os.Stat(dst); err == nil {
+		// Такой файл уже есть: храним одну копию
+		return BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return BlobInfo{}, err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: size, ModTime: time.Now()}, nil
+}
+
+func (s *LocalBlobStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, BlobInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, BlobInfo{}, err
+	}
+	return f, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalBlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// S3BlobStore keeps blobs in an S3-compatible bucket (AWS, MinIO, ...),
+// signing requests with AWS Signature Version 4 and path-style URLs
+type S3BlobStore struct {
+	cfg    S3Config
+	client *http.Client
+	tmpDir string
+}
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// NewS3BlobStore creates an S3 blob store
+func NewS3BlobStore(cfg S3Config) (*S3BlobStore, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 storage needs endpoint and bucket")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	return &S3BlobStore{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 5 * time.Minute},
+		tmpDir: os.TempDir(),
+	}, nil
+}
+
+func (s *S3BlobStore) objectPath(key string) string {
+	return "/" + s.cfg.Bucket + "/" + strings.Trim(s.cfg.Prefix+"/"+key[:2]+"/"+key, "/")
+}
+
+// do sends a signed request for the object
+func (s *S3BlobStore) do(ctx context.Context, method, key string, body io.Reader, size int64, payloadHash string, headers map[string]string) (*http.Response, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return nil, ErrBlobNotFound
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, s.cfg.Endpoint+s.objectPath(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to req
+func (s *S3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Range") != "" {
+		signedHeaders = []string{"host", "range", "x-amz-content-sha256", "x-amz-date"}
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		value := req.Header.Get(h)
+		if h == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, s.cfg.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, r io.Reader) (BlobInfo, error) {
+	tmp, key, size, err := spoolBlob(s.tmpDir, r)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if info, err := s.Stat(ctx, key); err == nil {
+		return info, nil
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return BlobInfo{}, err
+	}
+	// Ключ и есть SHA-256 содержимого, поэтому payload подписывается целиком
+	resp, err := s.do(ctx, "PUT", key, tmp, size, key, map[string]string{
+		"Content-Type": "application/octet-stream",
+	})
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return BlobInfo{}, fmt.Errorf("s3 put failed: %s %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return BlobInfo{Key: key, Size: size, ModTime: time.Now()}, nil
+}
+
+func (s *S3BlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	resp, err := s.do(ctx, "HEAD", key, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return BlobInfo{}, ErrBlobNotFound
+	default:
+		return BlobInfo{}, fmt.Errorf("s3 head failed: %s", resp.Status)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return BlobInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3BlobStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, BlobInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	return &s3ObjectReader{ctx: ctx, store: s, key: key, size: info.Size}, info, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, "DELETE", key, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("s3 delete failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// s3ObjectReader reads an object lazily with ranged GETs, so seeking
+// (e.g. for HTTP Range requests) does not download the whole object
+type s3ObjectReader struct {
+	ctx    context.Context
+	store  *S3BlobStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		resp, err := r.store.do(r.ctx, "GET", r.key, nil, 0, emptyPayloadHash, map[string]string{
+			"Range": "bytes=" + strconv.FormatInt(r.offset, 10) + "-",
+		})
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return 0, fmt.Errorf("s3 get failed: %s", resp.Status)
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	var next int64
+	switch whence {
+	case io.SeekStart:
+		next = offset
+	case io.SeekCurrent:
+		next = r.offset + offset
+	case io.SeekEnd:
+		next = r.size + offset
+	}
+	if next < 0 {
+		return 0, errors.New("negative position")
+	}
+	if next != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = next
+	return next, nil
+}
+
+func (r *s3ObjectReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal S3 stand-in: it checks the SigV4 signature of every
+// request on its own and keeps objects in memory
+type fakeS3 struct {
+	t         *testing.T
+	accessKey string
+	secretKey string
+	region    string
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	requests []string // "METHOD path"
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		t:         t,
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		region:    "eu-central-1",
+		objects:   make(map[string][]byte),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	f.mu.Unlock()
+
+	if err := f.verify(r, body); err != nil {
+		f.t.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[r.URL.Path]
+	switch r.Method {
+	case "PUT":
+		f.objects[r.URL.Path] = body
+	case "HEAD", "GET":
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)-start))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start:])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case "DELETE":
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verify recomputes the AWS Signature Version 4 of the request
+func (f *fakeS3) verify(r *http.Request, body []byte) error {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return fmt.Errorf("unexpected Authorization %q", auth)
+	}
+	fields := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) != len("20060102T150405Z") {
+		return fmt.Errorf("bad X-Amz-Date %q", amzDate)
+	}
+	scope := amzDate[:8] + "/" + f.region + "/s3/aws4_request"
+	if fields["Credential"] != f.accessKey+"/"+scope {
+		return fmt.Errorf("credential %q, want %q", fields["Credential"], f.accessKey+"/"+scope)
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	sum := sha256.Sum256(body)
+	if payloadHash != hex.EncodeToString(sum[:]) {
+		return fmt.Errorf("payload hash %q does not match the body", payloadHash)
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signed) {
+		return fmt.Errorf("signed headers %v are not sorted", signed)
+	}
+	var headers strings.Builder
+	for _, h := range signed {
+		value := r.Header.Get(h)
+		if h == "host" {
+			value = r.Host
+		}
+		headers.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+	if r.Header.Get("Range") != "" && !strings.Contains(fields["SignedHeaders"], "range") {
+		return errors.New("Range header is not signed")
+	}
+
+	canonical := strings.Join([]string{
+		r.Method, r.URL.EscapedPath(), r.URL.RawQuery,
+		headers.String(), fields["SignedHeaders"], payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + f.secretKey)
+	for _, part := range []string{amzDate[:8], f.region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if want := hex.EncodeToString(key); fields["Signature"] != want {
+		return fmt.Errorf("signature %q, want %q", fields["Signature"], want)
+	}
+	return nil
+}
+
+func (f *fakeS3) store(t *testing.T, endpoint string) BlobStore {
+	store, err := NewBlobStore(StorageConfig{
+		Backend: "s3",
+		S3: S3Config{
+			Endpoint:  endpoint,
+			Bucket:    "chat",
+			Region:    f.region,
+			AccessKey: f.accessKey,
+			SecretKey: f.secretKey,
+			Prefix:    "blobs",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestS3BlobStorePutOpenDelete(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	store := fake.store(t, srv.URL)
+	ctx := context.Background()
+
+	content := []byte("hello, blob store")
+	sum := sha256.Sum256(content)
+	wantKey := hex.EncodeToString(sum[:])
+
+	info, err := store.Put(ctx, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if info.Key != wantKey || info.Size != int64(len(content)) {
+		t.Fatalf("Put = %+v, want key %s size %d", info, wantKey, len(content))
+	}
+	path := "/chat/blobs/" + wantKey[:2] + "/" + wantKey
+	if got := fake.objects[path]; !bytes.Equal(got, content) {
+		t.Fatalf("object at %s = %q", path, got)
+	}
+
+	// Повторная загрузка того же содержимого не отправляет его ещё раз
+	before := len(fake.requests)
+	if _, err := store.Put(ctx, bytes.NewReader(content)); err != nil {
+		t.Fatalf("second Put: %v", err)
+	}
+	for _, req := range fake.requests[before:] {
+		if strings.HasPrefix(req, "PUT ") {
+			t.Fatalf("identical content uploaded again: %v", fake.requests[before:])
+		}
+	}
+
+	rc, stat, err := store.Open(ctx, wantKey)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if stat.Size != int64(len(content)) {
+		t.Fatalf("Open size = %d", stat.Size)
+	}
+	if _, err := rc.Seek(7, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("ranged read: %v", err)
+	}
+	if string(got) != "blob store" {
+		t.Fatalf("ranged read = %q", got)
+	}
+
+	if err := store.Delete(ctx, wantKey); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Stat(ctx, wantKey); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Stat after Delete = %v, want ErrBlobNotFound", err)
+	}
+}
+
+func TestS3BlobStoreRejectsBadKeys(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	store := fake.store(t, srv.URL)
+
+	if _, _, err := store.Open(context.Background(), "../etc/passwd"); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Open with bad key = %v", err)
+	}
+	if len(fake.requests) != 0 {
+		t.Fatalf("bad key reached the server: %v", fake.requests)
+	}
+}
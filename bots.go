@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BotPermissions limits which conversations a bot can read and post in.
+// Groups are identified by groupKey of their member list.
+type BotPermissions struct {
+	ReadGroups     []string `json:"read_groups"`
+	PostGroups     []string `json:"post_groups"`
+	DirectMessages bool     `json:"direct_messages"`
+}
+
+// Bot is a non-human account driven through the bot API
+type Bot struct {
+	Username    string         `json:"username"`
+	Owner       string         `json:"owner"`
+	TokenHash   string         `json:"token_hash,omitempty"`
+	Permissions BotPermissions `json:"permissions"`
+	RateLimit   int            `json:"rate_limit"` // запросов в минуту
+	CreatedAt   time.Time      `json:"created_at"`
+}
+
+// BotUpdate is a single event in the getUpdates stream
+type BotUpdate struct {
+	UpdateID int      `json:"update_id"`
+	Message  *Message `json:"message,omitempty"`
+}
+
+type botQueue struct {
+	updates []BotUpdate
+	nextID  int
+	wake    chan struct{} // закрывается при поступлении нового события
+}
+
+const (
+	defaultBotRateLimit = 30
+	maxBotQueueSize     = 1000
+	maxBotPollTimeout   = 50 * time.Second
+)
+
+var (
+	botsFile       = "data/bots.json"
+	botsMutex      sync.RWMutex
+	botQueues      = make(map[string]*botQueue)
+	botQueuesMutex sync.Mutex
+	botLimiters    = make(map[string]*RateLimiter)
+	botLimiterMu   sync.Mutex
+)
+
+func loadBots() []Bot {
+	botsMutex.RLock()
+	defer botsMutex.RUnlock()
+
+	data, err := os.ReadFile(botsFile)
+	if err != nil {
+		return []Bot{}
+	}
+
+	var bots []Bot
+	json.Unmarshal(data, &bots)
+	return bots
+}
+
+func saveBots(bots []Bot) error {
+	botsMutex.Lock()
+	defer botsMutex.Unlock()
+
+	data, err := json.MarshalIndent(bots, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(botsFile, data, 0600)
+}
+
+func findBot(username string) *Bot {
+	for _, b := range loadBots() {
+		if b.Username == username {
+			return &b
+		}
+	}
+	return nil
+}
+
+func isBotUser(username string) bool {
+	u := findUser(username)
+	return u != nil && u.IsBot
+}
+
+// createBot registers a bot user owned by owner and returns its API token
+// in the "<username>:<secret>" form
+func createBot(owner, username string, perms BotPermissions, rateLimit int) (string, error) {
+	username = strings.TrimSpace(username)
+	if len(username) < 3 {
+		return "", errors.New("bot username must be at least 3 characters")
+	}
+	if strings.HasPrefix(username, webhookSenderPrefix) {
+		return "", ErrReservedUsername
+	}
+	if findUser(username) != nil {
+		return "", errors.New("user already exists")
+	}
+	if err := validateBotPermissions(owner, perms); err != nil {
+		return "", err
+	}
+	if rateLimit <= 0 {
+		rateLimit = defaultBotRateLimit
+	}
+
+	// Бот не может войти через /login: пароль случайный и нигде не хранится
+	secret, err := randomToken(24)
+	if err != nil {
+		return "", err
+	}
+	unusable, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	users := loadUsers()
+	users = append(users, User{
+		ID:       nextUserID(users),
+		Username: username,
+		Password: string(unusable),
+		IsBot:    true,
+		BotOwner: owner,
+	})
+	if err := saveUsers(users); err != nil {
+		return "", err
+	}
+
+	token := username + ":" + secret
+	bots := loadBots()
+	bots = append(bots, Bot{
+		Username:    username,
+		Owner:       owner,
+		TokenHash:   hashToken(token),
+		Permissions: perms,
+		RateLimit:   rateLimit,
+		CreatedAt:   time.Now(),
+	})
+	return token, saveBots(bots)
+}
+
+// validateBotPermissions makes sure owners only grant access to their own groups
+func validateBotPermissions(owner string, perms BotPermissions) error {
+	ownGroups := make(map[string]bool)
+	for _, g := range getUserGroups(owner) {
+		ownGroups[groupKey(g)] = true
+	}
+	for _, key := range append(append([]string(nil), perms.ReadGroups...), perms.PostGroups...) {
+		if !ownGroups[key] {
+			return errors.New("you can only grant access to groups you are a member of")
+		}
+	}
+	return nil
+}
+
+// updateBot changes permissions and rate limit of an owned bot
+func updateBot(owner, username string, perms BotPermissions, rateLimit int) error {
+	if err := validateBotPermissions(owner, perms); err != nil {
+		return err
+	}
+
+	bots := loadBots()
+	for i := range bots {
+		if bots[i].Username == username && bots[i].Owner == owner {
+			bots[i].Permissions = perms
+			if rateLimit > 0 {
+				bots[i].RateLimit = rateLimit
+			}
+			if err := saveBots(bots); err != nil {
+				return err
+			}
+			botLimiterMu.Lock()
+			delete(botLimiters, username)
+			botLimiterMu.Unlock()
+			return nil
+		}
+	}
+	return errors.New("bot not found")
+}
+
+// rotateBotToken issues a new token, invalidating the old one
+func rotateBotToken(owner, username string) (string, error) {
+	bots := loadBots()
+	for i := range bots {
+		if bots[i].Username == username && bots[i].Owner == owner {
+			secret, err := randomToken(24)
+			if err != nil {
+				return "", err
+			}
+			token := username + ":" + secret
+			bots[i].TokenHash = hashToken(token)
+			return token, saveBots(bots)
+		}
+	}
+	return "", errors.New("bot not found")
+}
+
+// deleteBot removes the bot and its user account
+func deleteBot(owner, username string) error {
+	bots := loadBots()
+	for i := range bots {
+		if bots[i].Username == username && bots[i].Owner == owner {
+			if err := saveBots(append(bots[:i], bots[i+1:]...)); err != nil {
+				return err
+			}
+
+			botQueuesMutex.Lock()
+			delete(botQueues, username)
+			botQueuesMutex.Unlock()
+			return updateUser(username, markDeleted)
+		}
+	}
+	return errors.New("bot not found")
+}
+
+func authenticateBot(token string) (*Bot, error) {
+	username, _, ok := strings.Cut(token, ":")
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	bot := findBot(username)
+	if bot == nil || subtle.ConstantTimeCompare([]byte(bot.TokenHash), []byte(hashToken(token))) != 1 {
+		return nil, errors.New("invalid token")
+	}
+	// Заблокированный владелец не действует и через своих ботов;
+	// после разблокировки боты снова работают
+	if !findUser(bot.Owner).isActive() || !findUser(bot.Username).isActive() {
+		return nil, ErrOwnerInactive
+	}
+	return bot, nil
+}
+
+// allowBotRequest applies the bot's own requests-per-minute limit
+func allowBotRequest(bot *Bot) (bool, time.Duration) {
+	botLimiterMu.Lock()
+	limiter, ok := botLimiters[bot.Username]
+	if !ok {
+		limiter = NewRateLimiter(bot.RateLimit, bot.RateLimit/2+1)
+		botLimiters[bot.Username] = limiter
+	}
+	botLimiterMu.Unlock()
+	return limiter.Allow(bot.Username)
+}
+
+// canRead reports whether the message should be delivered to the bot
+func (b *Bot) canRead(msg Message) bool {
+	if msg.FromUser == b.Username {
+		return false
+	}
+	if msg.IsGroup {
+		return containsUser(b.Permissions.ReadGroups, groupKey(msg.GroupUsers))
+	}
+	return b.Permissions.DirectMessages && msg.ToUser == b.Username
+}
+
+func (b *Bot) canPost(msg Message) bool {
+	if msg.IsGroup {
+		return containsUser(b.Permissions.PostGroups, groupKey(msg.GroupUsers))
+	}
+	return b.Permissions.DirectMessages
+}
+
+// dispatchBotUpdates queues msg for every bot allowed to read it
+func dispatchBotUpdates(msg Message) {
+	for _, b := range loadBots() {
+		if b.canRead(msg) && findUser(b.Owner).isActive() {
+			pushBotUpdate(b.Username, msg)
+		}
+	}
+}
+
+func pushBotUpdate(botName string, msg Message) {
+	botQueuesMutex.Lock()
+	defer botQueuesMutex.Unlock()
+
+	q := getBotQueueLocked(botName)
+	q.nextID++
+	q.updates = append(q.updates, BotUpdate{UpdateID: q.nextID, Message: &msg})
+	if len(q.updates) > maxBotQueueSize {
+		q.updates = q.updates[len(q.updates)-maxBotQueueSize:]
+	}
+
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+func getBotQueueLocked(botName string) *botQueue {
+	q, ok := botQueues[botName]
+	if !ok {
+		q = &botQueue{wake: make(chan struct{})}
+		botQueues[botName] = q
+	}
+	return q
+}
+
+// getBotUpdates implements the long-poll getUpdates model: updates below
+// offset are confirmed and dropped, and if nothing is pending the call
+// waits up to timeout for a new one
+func getBotUpdates(ctx context.Context, botName string, offset int, timeout time.Duration) []BotUpdate {
+	if timeout > maxBotPollTimeout {
+		timeout = maxBotPollTimeout
+	}
+
+	botQueuesMutex.Lock()
+	q := getBotQueueLocked(botName)
+	if offset > 0 {
+		i := 0
+		for i < len(q.updates) && q.updates[i].UpdateID < offset {
+			i++
+		}
+		q.updates = q.updates[i:]
+	}
+	if len(q.updates) > 0 || timeout <= 0 {
+		updates := append([]BotUpdate{}, q.updates...)
+		botQueuesMutex.Unlock()
+		return updates
+	}
+	wake := q.wake
+	botQueuesMutex.Unlock()
+
+	select {
+	case <-wake:
+	case <-time.After(timeout):
+	case <-ctx.Done():
+	}
+
+	botQueuesMutex.Lock()
+	defer botQueuesMutex.Unlock()
+	return append([]BotUpdate{}, getBotQueueLocked(botName).updates...)
+}
+
+// sendBotMessage posts a message on behalf of the bot and delivers it live
+func sendBotMessage(bot *Bot, msg Message) (Message, error) {
+	msg.FromUser = bot.Username
+	msg.CreatedAt = time.Now()
+	if msg.IsGroup {
+		msg.ToUser = "group"
+	}
+	if !bot.canPost(msg) {
+		return Message{}, errors.New("bot is not allowed to post in this conversation")
+	}
+
+	if err := appendMessage(&msg); err != nil {
+		return Message{}, err
+	}
+
+	deliverMessage(msg)
+	return msg, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDisabledOwnerStopsBotsAndWebhooks(t *testing.T) {
+	dir := t.TempDir()
+	oldUsers, oldBots, oldHooks, oldSessions := usersFile, botsFile, webhooksFile, userSessionsFile
+	usersFile = filepath.Join(dir, "users.json")
+	botsFile = filepath.Join(dir, "bots.json")
+	webhooksFile = filepath.Join(dir, "webhooks.json")
+	userSessionsFile = filepath.Join(dir, "sessions.json")
+	t.Cleanup(func() {
+		usersFile, botsFile, webhooksFile, userSessionsFile = oldUsers, oldBots, oldHooks, oldSessions
+	})
+
+	for _, u := range []string{"alice", "bob"} {
+		if err := createUser(u, "secret123"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := createBot("alice", "alicebot", BotPermissions{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook, hookToken, err := createIncomingWebhook("alice", "deploy", "", []string{"alice", "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Заблокированный владелец не пишет через своих ботов и вебхуки
+	if err := setUserDisabled("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateBot(token); err != ErrOwnerInactive {
+		t.Fatalf("bot of a disabled owner = %v, want ErrOwnerInactive", err)
+	}
+	if _, err := authenticateIncomingWebhook(hook.ID, hookToken); err != ErrOwnerInactive {
+		t.Fatalf("webhook of a disabled owner = %v, want ErrOwnerInactive", err)
+	}
+
+	// После разблокировки всё снова работает без новых токенов
+	if err := setUserDisabled("alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateBot(token); err != nil {
+		t.Fatalf("bot after unblocking = %v", err)
+	}
+	if _, err := authenticateIncomingWebhook(hook.ID, hookToken); err != nil {
+		t.Fatalf("webhook after unblocking = %v", err)
+	}
+}
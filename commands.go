@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	ResponseEphemeral = "ephemeral"
+	ResponseInChannel = "in_channel"
+)
+
+// CommandContext describes a slash command invocation
+type CommandContext struct {
+	Command    string   `json:"command"`
+	Text       string   `json:"text"`
+	UserName   string   `json:"user_name"`
+	ToUser     string   `json:"to_user,omitempty"`
+	IsGroup    bool     `json:"is_group"`
+	GroupUsers []string `json:"group_users,omitempty"`
+	Channel    string   `json:"channel"`
+	Timestamp  int64    `json:"timestamp"`
+	ClientIP   string   `json:"-"` // для журнала, внешней команде не передаётся
+}
+
+// CommandResponse is returned by built-in handlers and external endpoints
+type CommandResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+type CommandHandler func(ctx CommandContext) (CommandResponse, error)
+
+// SlashCommand is either a built-in Go handler or an external HTTP endpoint
+type SlashCommand struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Usage       string         `json:"usage,omitempty"`
+	URL         string         `json:"url,omitempty"`
+	Secret      string         `json:"secret,omitempty"` // ключ подписи запросов
+	CreatedBy   string         `json:"created_by,omitempty"`
+	Users       []string       `json:"users,omitempty"` // кому доступна команда: пусто — только автору, "*" — всем
+	CreatedAt   time.Time      `json:"created_at,omitempty"`
+	Handler     CommandHandler `json:"-"`
+}
+
+var (
+	commandsFile     = "data/commands.json"
+	commandsMutex    sync.RWMutex
+	builtinCommands  = make(map[string]SlashCommand)
+	commandPattern   = regexp.MustCompile(`^/([a-z0-9_\-]+)(?:\s+([\s\S]*))?$`)
+	commandNameRegex = regexp.MustCompile(`^[a-z0-9_\-]{2,32}$`)
+
+	errCommandAddress = errors.New("command endpoint address is not allowed")
+)
+
+// commandClient calls external commands. It does not use a proxy, so the
+// address check runs on every connection, redirects included.
+var commandClient = &http.Client{
+	Timeout: 3 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 3 * time.Second,
+			Control: checkCommandAddress,
+		}).DialContext,
+	},
+}
+
+func init() {
+	registerBuiltinCommand(SlashCommand{
+		Name:        "help",
+		Description: "List available commands",
+		Handler:     helpCommand,
+	})
+	registerBuiltinCommand(SlashCommand{
+		Name:        "poll",
+		Description: "Start a poll, vote with reactions",
+		Usage:       `/poll "Question" "Option 1" "Option 2"`,
+		Handler:     pollCommand,
+	})
+	registerBuiltinCommand(SlashCommand{
+		Name:        "remind",
+		Description: "Remind yourself about something later",
+		Usage:       "/remind 10m Call the team",
+		Handler:     remindCommand,
+	})
+}
+
+func registerBuiltinCommand(cmd SlashCommand) {
+	commandsMutex.Lock()
+	defer commandsMutex.Unlock()
+	builtinCommands[cmd.Name] = cmd
+}
+
+func loadExternalCommands() []SlashCommand {
+	commandsMutex.RLock()
+	defer commandsMutex.RUnlock()
+
+	data, err := os.ReadFile(commandsFile)
+	if err != nil {
+		return []SlashCommand{}
+	}
+
+	var commands []SlashCommand
+	json.Unmarshal(data, &commands)
+	return commands
+}
+
+func saveExternalCommands(commands []SlashCommand) error {
+	commandsMutex.Lock()
+	defer commandsMutex.Unlock()
+
+	data, err := json.MarshalIndent(commands, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(commandsFile, data, 0600)
+}
+
+// findCommand looks up a command, built-ins take precedence
+func findCommand(name string) *SlashCommand {
+	commandsMutex.RLock()
+	cmd, ok := builtinCommands[name]
+	commandsMutex.RUnlock()
+	if ok {
+		return &cmd
+	}
+
+	for _, c := range loadExternalCommands() {
+		if c.Name == name {
+			return &c
+		}
+	}
+	return nil
+}
+
+// available reports whether username may run the command. Built-ins are
+// available to everyone; an external command only to the users it lists,
+// so nobody's invocations reach an endpoint they were not given.
+func (c *SlashCommand) available(username string) bool {
+	if c.Handler != nil {
+		return true
+	}
+	return c.CreatedBy == username || containsUser(c.Users, "*") || containsUser(c.Users, username)
+}
+
+// listCommands returns the commands available to username without secrets,
+// sorted by name
+func listCommands(username string) []SlashCommand {
+	var commands []SlashCommand
+	commandsMutex.RLock()
+	for _, c := range builtinCommands {
+		commands = append(commands, c)
+	}
+	commandsMutex.RUnlock()
+
+	for _, c := range loadExternalCommands() {
+		if !c.available(username) {
+			continue
+		}
+		c.Secret = ""
+		commands = append(commands, c)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// registerExternalCommand adds a command served by an external endpoint
+// for the listed users and returns its signing secret
+func registerExternalCommand(creator, name, url, description string, users []string) (string, error) {
+	name = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "/")
+	if !commandNameRegex.MatchString(name) {
+		return "", errors.New("invalid command name")
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return "", errors.New("command URL must be http(s)")
+	}
+	if findCommand(name) != nil {
+		return "", errors.New("command already exists")
+	}
+	for _, u := range users {
+		if u != "*" && findUser(u) == nil {
+			return "", fmt.Errorf("user %s does not exist", u)
+		}
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	commands := loadExternalCommands()
+	commands = append(commands, SlashCommand{
+		Name:        name,
+		Description: description,
+		URL:         url,
+		Secret:      secret,
+		CreatedBy:   creator,
+		Users:       users,
+		CreatedAt:   time.Now(),
+	})
+	return secret, saveExternalCommands(commands)
+}
+
+func deleteExternalCommand(name, username string) error {
+	commands := loadExternalCommands()
+	for i := range commands {
+		if commands[i].Name == name {
+			if commands[i].CreatedBy != username && !isAdmin(username) {
+				return errors.New("can only delete your own commands")
+			}
+			return saveExternalCommands(append(commands[:i], commands[i+1:]...))
+		}
+	}
+	return errors.New("command not found")
+}
+
+// parseSlashCommand splits "/name args" into a command available to from
+// and its arguments. Any other text is sent as usual.
+func parseSlashCommand(from, content string) (*SlashCommand, string) {
+	m := commandPattern.FindStringSubmatch(strings.TrimSpace(content))
+	if m == nil {
+		return nil, ""
+	}
+	cmd := findCommand(m[1])
+	if cmd == nil || !cmd.available(from) {
+		return nil, ""
+	}
+	return cmd, strings.TrimSpace(m[2])
+}
+
+// runSlashCommand executes content if it is a slash command. target carries
+// the conversation (ToUser or GroupUsers) the command was typed in.
+// It returns false when content should be sent as a normal message.
+func runSlashCommand(from string, target Message, content string) (bool, error) {
+	cmd, args := parseSlashCommand(from, content)
+	if cmd == nil {
+		return false, nil
+	}
+	// Команда получает участников и контекст беседы, поэтому сначала те же
+	// проверки участия и приватности, что и для обычного сообщения
+	if err := validateMessage(Message{FromUser: from, ToUser: target.ToUser, IsGroup: target.IsGroup, GroupUsers: target.GroupUsers, Content: content}); err != nil {
+		return true, err
+	}
+
+	ctx := CommandContext{
+		Command:    "/" + cmd.Name,
+		Text:       args,
+		UserName:   from,
+		ToUser:     target.ToUser,
+		IsGroup:    target.IsGroup,
+		GroupUsers: target.GroupUsers,
+		Channel:    conversationKey(Message{FromUser: from, ToUser: target.ToUser, IsGroup: target.IsGroup, GroupUsers: target.GroupUsers}, from),
+		Timestamp:  time.Now().Unix(),
+		ClientIP:   target.ClientIP,
+	}
+
+	var resp CommandResponse
+	var err error
+	if cmd.Handler != nil {
+		resp, err = cmd.Handler(ctx)
+	} else {
+		resp, err = callExternalCommand(cmd, ctx)
+	}
+	if err != nil {
+		resp = CommandResponse{
+			ResponseType: ResponseEphemeral,
+			Text:         fmt.Sprintf("%s failed: %v", ctx.Command, err),
+		}
+	}
+
+	return true, deliverCommandResponse(ctx, resp)
+}
+
+// callExternalCommand POSTs the invocation to the command URL, signed as
+// X-Chat-Signature: v0=hex(HMAC-SHA256(secret, "v0:" + timestamp + ":" + body))
+func callExternalCommand(cmd *SlashCommand, ctx CommandContext) (CommandResponse, error) {
+	body, err := json.Marshal(ctx)
+	if err != nil {
+		return CommandResponse{}, err
+	}
+	timestamp := strconv.FormatInt(ctx.Timestamp, 10)
+
+	req, err := http.NewRequest("POST", cmd.URL, bytes.NewReader(body))
+	if err != nil {
+		return CommandResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chat-Request-Timestamp", timestamp)
+	req.Header.Set("X-Chat-Signature", signCommandRequest(cmd.Secret, timestamp, body))
+
+	resp, err := commandClient.Do(req)
+	if err != nil {
+		return CommandResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return CommandResponse{}, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+
+	var result CommandResponse
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return CommandResponse{}, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return CommandResponse{ResponseType: ResponseEphemeral}, nil
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		// Обычный текст считаем ephemeral-ответом
+		return CommandResponse{ResponseType: ResponseEphemeral, Text: string(data)}, nil
+	}
+	return result, nil
+}
+
+// checkCommandAddress refuses connections from command calls to loopback,
+// private, link-local and other internal addresses. It runs on the
+// resolved address, so DNS names pointing inside the network are caught too.
+func checkCommandAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() {
+		return errCommandAddress
+	}
+	// 100.64.0.0/10 (CGNAT) не входит в IsPrivate, но тоже внутренняя сеть
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+		return errCommandAddress
+	}
+	return nil
+}
+
+func signCommandRequest(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverCommandResponse posts in_channel responses as a message in the
+// conversation and shows ephemeral ones to the invoking user only
+func deliverCommandResponse(ctx CommandContext, resp CommandResponse) error {
+	if strings.TrimSpace(resp.Text) == "" {
+		return nil
+	}
+
+	if resp.ResponseType == ResponseInChannel {
+		msg := Message{
+			FromUser:   ctx.UserName,
+			ToUser:     ctx.ToUser,
+			Content:    resp.Text,
+			CreatedAt:  time.Now(),
+			IsGroup:    ctx.IsGroup,
+			GroupUsers: ctx.GroupUsers,
+			Command:    ctx.Command,
+			ClientIP:   ctx.ClientIP,
+		}
+		if msg.IsGroup {
+			msg.ToUser = "group"
+		}
+		if err := appendMessage(&msg); err != nil {
+			return err
+		}
+		deliverMessage(msg)
+		if !msg.IsGroup {
+			sendToClient(ctx.UserName, msg)
+		}
+		return nil
+	}
+
+	ephemeral := Message{
+		FromUser:  ctx.Command,
+		ToUser:    ctx.UserName,
+		Content:   processMessageContent(resp.Text),
+		CreatedAt: time.Now(),
+		Command:   ctx.Command,
+		Ephemeral: true,
+	}
+	if !sendToClient(ctx.UserName, ephemeral) {
+		notificationService.Notify(Notification{
+			UserID:  ctx.UserName,
+			Type:    "command",
+			Message: ctx.Command,
+			Preview: notificationPreview(ephemeral.Content),
+		})
+	}
+	return nil
+}
+
+func helpCommand(ctx CommandContext) (CommandResponse, error) {
+	var lines []string
+	for _, c := range listCommands(ctx.UserName) {
+		line := fmt.Sprintf("- `/%s` — %s", c.Name, c.Description)
+		if c.Usage != "" {
+			line += fmt.Sprintf(" (`%s`)", c.Usage)
+		}
+		lines = append(lines, line)
+	}
+	return CommandResponse{ResponseType: ResponseEphemeral, Text: strings.Join(lines, "\n")}, nil
+}
+
+var pollArgPattern = regexp.MustCompile(`"([^"]+)"|(\S+)`)
+var pollEmojis = []string{"1️⃣", "2️⃣", "3️⃣", "4️⃣", "5️⃣", "6️⃣", "7️⃣", "8️⃣", "9️⃣", "🔟"}
+
+func pollCommand(ctx CommandContext) (CommandResponse, error) {
+	var args []string
+	for _, m := range pollArgPattern.FindAllStringSubmatch(ctx.Text, -1) {
+		if m[1] != "" {
+			args = append(args, m[1])
+		} else {
+			args = append(args, m[2])
+		}
+	}
+	if len(args) < 3 {
+		return CommandResponse{}, errors.New(`usage: /poll "Question" "Option 1" "Option 2"`)
+	}
+	if len(args)-1 > len(pollEmojis) {
+		return CommandResponse{}, fmt.Errorf("at most %d options", len(pollEmojis))
+	}
+
+	lines := []string{fmt.Sprintf("📊 **%s**", args[0]), ""}
+	for i, option := range args[1:] {
+		lines = append(lines, fmt.Sprintf("%s %s  ", pollEmojis[i], option))
+	}
+	lines = append(lines, "", "_React with an option to vote_")
+	return CommandResponse{ResponseType: ResponseInChannel, Text: strings.Join(lines, "\n")}, nil
+}
+
+func remindCommand(ctx CommandContext) (CommandResponse, error) {
+	parts := strings.SplitN(ctx.Text, " ", 2)
+	if len(parts) < 2 {
+		return CommandResponse{}, errors.New("usage: /remind 10m Call the team")
+	}
+	delay, err := time.ParseDuration(parts[0])
+	if err != nil || delay <= 0 || delay > 7*24*time.Hour {
+		return CommandResponse{}, errors.New("delay must be a duration like 10m or 2h, up to 7 days")
+	}
+
+	user, text := ctx.UserName, strings.TrimSpace(parts[1])
+	time.AfterFunc(delay, func() {
+		notificationService.AddWithPriority(user, "reminder", "Reminder: "+text, PriorityHigh)
+	})
+	return CommandResponse{
+		ResponseType: ResponseEphemeral,
+		Text:         fmt.Sprintf("OK, I will remind you in %s", delay),
+	}, nil
+}
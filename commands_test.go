@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSlashCommandRequiresGroupMembership(t *testing.T) {
+	useTempBlobStore(t)
+	oldUsers := usersFile
+	usersFile = filepath.Join(t.TempDir(), "users.json")
+	t.Cleanup(func() { usersFile = oldUsers })
+
+	group := []string{"alice", "bob"}
+	if err := saveMessages([]Message{{ID: 1, FromUser: "alice", ToUser: "group", Content: "hi", IsGroup: true, GroupUsers: group}}); err != nil {
+		t.Fatal(err)
+	}
+	var calls []CommandContext
+	registerBuiltinCommand(SlashCommand{Name: "probe", Handler: func(ctx CommandContext) (CommandResponse, error) {
+		calls = append(calls, ctx)
+		return CommandResponse{}, nil
+	}})
+	t.Cleanup(func() {
+		commandsMutex.Lock()
+		delete(builtinCommands, "probe")
+		commandsMutex.Unlock()
+	})
+
+	// Посторонний не запускает команду в чужой группе и не узнаёт её участников
+	target := Message{ToUser: "alice,bob", IsGroup: true, GroupUsers: group}
+	handled, err := runSlashCommand("mallory", target, "/probe")
+	if !handled || err != ErrNotGroupMember {
+		t.Fatalf("command of a non-member = %v, %v; want handled with ErrNotGroupMember", handled, err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("command ran for a non-member")
+	}
+
+	if _, err := runSlashCommand("bob", target, "/probe"); err != nil {
+		t.Fatalf("command of a member = %v", err)
+	}
+	if len(calls) != 1 || calls[0].UserName != "bob" {
+		t.Fatalf("calls = %+v, want one by bob", calls)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// PushConfig holds Web Push (VAPID) settings
+type PushConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Subject    string `json:"subject"` // mailto: или https: контакт для push-сервисов
+	PublicKey  string `json:"public_key,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+	TTL        int    `json:"ttl"` // seconds
+}
+
+// Config represents instance-wide settings loaded from data/config.json
+type Config struct {
+	Push          PushConfig          `json:"push"`
+	Storage       StorageConfig       `json:"storage"`
+	Uploads       UploadsConfig       `json:"uploads"`
+	Files         FilesConfig         `json:"files"`
+	Thumbnails    ThumbnailsConfig    `json:"thumbnails"`
+	Scan          ScanConfig          `json:"scan"`
+	Quotas        QuotaConfig         `json:"quotas"`
+	ContentFilter ContentFilterConfig `json:"content_filter"`
+	RateLimits    RateLimitConfig     `json:"rate_limits"`
+	Login         LoginConfig         `json:"login"`
+	TwoFactor     TwoFactorConfig     `json:"two_factor"`
+	PasswordReset PasswordResetConfig `json:"password_reset"`
+	Sessions      SessionsConfig      `json:"sessions"`
+	Admins        []string            `json:"admins"` // администраторы независимо от роли в профиле
+}
+
+// UploadsConfig holds resumable upload settings
+type UploadsConfig struct {
+	Dir         string `json:"dir"`          // незавершённые загрузки
+	ExpiryHours int    `json:"expiry_hours"` // время жизни загрузки без активности
+}
+
+var configFile = "data/config.json"
+
+func defaultConfig() Config {
+	return Config{
+		Push: PushConfig{
+			Enabled: true,
+			Subject: "mailto:admin@localhost",
+			TTL:     24 * 60 * 60,
+		},
+		Storage: StorageConfig{
+			Backend:  "local",
+			LocalDir: "data/blobs",
+		},
+		Uploads: UploadsConfig{
+			Dir:         "data/uploads",
+			ExpiryHours: 24,
+		},
+		Files: FilesConfig{
+			AllowedExtensions: []string{
+				".jpg", ".jpeg", ".png", ".gif",
+				".mp4", ".webm", ".mov",
+				".pdf", ".doc", ".docx", ".txt",
+			},
+			StripMetadata: true,
+		},
+		Thumbnails: ThumbnailsConfig{
+			Enabled: true,
+			Workers: 2,
+			Sizes:   map[string]int{"small": 160, "medium": 480, "large": 1280},
+		},
+		Scan: ScanConfig{
+			Enabled: false,
+			Clamd:   "tcp:127.0.0.1:3310",
+			Policy:  ScanPolicyFailClosed,
+			Timeout: 60,
+		},
+		Quotas: QuotaConfig{
+			UserBytes:  500 * 1024 * 1024,
+			GroupBytes: 2 * 1024 * 1024 * 1024,
+			MaxFileSize: map[string]int64{
+				"image":    10 * 1024 * 1024,
+				"video":    50 * 1024 * 1024,
+				"document": 20 * 1024 * 1024,
+			},
+		},
+		ContentFilter: ContentFilterConfig{
+			Links: LinkFilterConfig{Action: FilterReject},
+		},
+		RateLimits: defaultRateLimitConfig(),
+		Login:      defaultLoginConfig(),
+		TwoFactor: TwoFactorConfig{
+			Issuer: "Chat",
+		},
+		PasswordReset: PasswordResetConfig{
+			Channel:  ResetChannelAdmin,
+			TokenTTL: 60,
+			SMTP:     SMTPConfig{Port: 587},
+		},
+	}
+}
+
+// loadConfig reads the config file on top of the defaults.
+// A missing file is not an error: the defaults are used as is.
+func loadConfig() Config {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return cfg
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("Invalid config %s: %v, using defaults", configFile, err)
+		return defaultConfig()
+	}
+	return cfg
+}
+
+// saveConfig writes the running config back to the file, so settings
+// changed in the admin console survive a restart
+func saveConfig() error {
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(configFile, data, 0600)
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ContentFilterConfig holds the rules applied to messages, edits and
+// profile fields
+type ContentFilterConfig struct {
+	Enabled bool             `json:"enabled"`
+	Rules   []FilterRule     `json:"rules"`
+	Links   LinkFilterConfig `json:"links"`
+}
+
+// FilterRule is a list of terms and patterns with the action taken on a match
+type FilterRule struct {
+	Name     string   `json:"name"`
+	Words    []string `json:"words,omitempty"`     // "слово" — целое слово, "слово*" — слово с этого начала
+	WordFile string   `json:"word_file,omitempty"` // один термин на строку, # — комментарий
+	Patterns []string `json:"patterns,omitempty"`  // регулярные выражения (RE2)
+	Action   string   `json:"action"`              // reject, mask или flag
+}
+
+// LinkFilterConfig restricts the domains messages may link to
+type LinkFilterConfig struct {
+	Allow  []string `json:"allow,omitempty"` // если задан, разрешены только эти домены
+	Deny   []string `json:"deny,omitempty"`
+	Action string   `json:"action"`
+}
+
+// Content filter actions
+const (
+	FilterReject = "reject"
+	FilterMask   = "mask"
+	FilterFlag   = "flag"
+)
+
+// FilterResult is the outcome of checking a text
+type FilterResult struct {
+	Text     string   // текст после маскирования
+	Rejected string   // правило, отклонившее текст
+	Flagged  []string // правила, отправившие текст на проверку модератору
+}
+
+// ContentFilter is the compiled form of ContentFilterConfig
+type ContentFilter struct {
+	rules []compiledRule
+	links LinkFilterConfig
+}
+
+type compiledRule struct {
+	name     string
+	action   string
+	words    []filterWord
+	patterns []*regexp.Regexp
+}
+
+type filterWord struct {
+	skeleton string // нормализованная форма без повторов букв
+	length   int    // число букв до схлопывания повторов
+	prefix   bool
+}
+
+var contentFilter *ContentFilter
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"']+`)
+
+// lookalikes maps digits, symbols and Cyrillic letters that look like Latin
+// ones to a single form, so words spelled with mixed alphabets ("xyй") or
+// digits ("h3ll0") are caught. Words from the lists are normalized the same way.
+var lookalikes = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b',
+	'@': 'a', '$': 's',
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h',
+	'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x',
+}
+
+// NewContentFilter compiles the rules; it returns nil if the filter is disabled
+func NewContentFilter(cfg ContentFilterConfig) (*ContentFilter, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	f := &ContentFilter{links: cfg.Links}
+	if f.links.Action == "" {
+		f.links.Action = FilterReject
+	}
+	if !validFilterAction(f.links.Action) {
+		return nil, fmt.Errorf("links: unknown action %q", f.links.Action)
+	}
+	for i := range f.links.Allow {
+		f.links.Allow[i] = strings.ToLower(strings.TrimPrefix(f.links.Allow[i], "www."))
+	}
+	for i := range f.links.Deny {
+		f.links.Deny[i] = strings.ToLower(strings.TrimPrefix(f.links.Deny[i], "www."))
+	}
+
+	for _, r := range cfg.Rules {
+		if !validFilterAction(r.Action) {
+			return nil, fmt.Errorf("rule %q: unknown action %q", r.Name, r.Action)
+		}
+		rule := compiledRule{name: r.Name, action: r.Action}
+		words := r.Words
+		if r.WordFile != "" {
+			fileWords, err := readWordFile(r.WordFile)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+			}
+			words = append(append([]string(nil), words...), fileWords...)
+		}
+		for _, w := range words {
+			if word, ok := newFilterWord(w); ok {
+				rule.words = append(rule.words, word)
+			}
+		}
+		for _, p := range r.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+			}
+			rule.patterns = append(rule.patterns, re)
+		}
+		f.rules = append(f.rules, rule)
+	}
+	return f, nil
+}
+
+func validFilterAction(action string) bool {
+	return action == FilterReject || action == FilterMask || action == FilterFlag
+}
+
+func readWordFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return words, scanner.Err()
+}
+
+func newFilterWord(w string) (filterWord, bool) {
+	w = strings.TrimSpace(w)
+	word := filterWord{prefix: strings.HasSuffix(w, "*")}
+	letters := normalizeLetters(strings.TrimSuffix(w, "*"))
+	if len(letters) == 0 {
+		return word, false
+	}
+	word.length = len(letters)
+	word.skeleton = collapseRepeats(letters)
+	return word, true
+}
+
+// normalizeRune returns the canonical form of a letter, or false for
+// characters that are not part of a word (separators like "." or "-")
+func normalizeRune(r rune) (rune, bool) {
+	r = unicode.ToLower(r)
+	if l, ok := lookalikes[r]; ok {
+		return l, true
+	}
+	return r, unicode.IsLetter(r)
+}
+
+func normalizeLetters(s string) []rune {
+	var letters []rune
+	for _, r := range s {
+		if n, ok := normalizeRune(r); ok {
+			letters = append(letters, n)
+		}
+	}
+	return letters
+}
+
+// collapseRepeats turns "fuuuck" into "fuck"
+func collapseRepeats(letters []rune) string {
+	var b strings.Builder
+	for i, r := range letters {
+		if i == 0 || r != letters[i-1] {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Check runs the text through the rules. isHTML means the text is
+// rendered message content: words and patterns are then only matched
+// outside of tags. Checking stops at the first rejecting rule.
+func (f *ContentFilter) Check(text string, isHTML bool) FilterResult {
+	result := FilterResult{Text: text}
+	if f == nil {
+		return result
+	}
+
+	for _, rule := range f.rules {
+		matched := false
+		result.Text = mapTextSegments(result.Text, isHTML, func(s string) string {
+			out, hit := rule.apply(s)
+			matched = matched || hit
+			return out
+		})
+		if matched && result.note(rule.name, rule.action) {
+			return result
+		}
+	}
+
+	for _, link := range linkPattern.FindAllString(result.Text, -1) {
+		if f.linkAllowed(link) {
+			continue
+		}
+		if f.links.Action == FilterMask {
+			result.Text = strings.ReplaceAll(result.Text, link, strings.Repeat("*", utf8.RuneCountInString(link)))
+		}
+		if result.note("links", f.links.Action) {
+			return result
+		}
+	}
+	return result
+}
+
+// note records a matched rule and reports whether the text is rejected
+func (r *FilterResult) note(rule, action string) bool {
+	switch action {
+	case FilterReject:
+		r.Rejected = rule
+		return true
+	case FilterFlag:
+		if !containsUser(r.Flagged, rule) {
+			r.Flagged = append(r.Flagged, rule)
+		}
+	}
+	return false
+}
+
+// apply matches the rule against plain text; the returned text is masked
+// when the rule's action is mask
+func (rule compiledRule) apply(s string) (string, bool) {
+	mask := rule.action == FilterMask
+	matched := false
+
+	if len(rule.words) > 0 {
+		var b strings.Builder
+		rest := s
+		for len(rest) > 0 {
+			// Слова разделяются только пробелами, поэтому "f.u.c.k" — одно слово
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end == 0 {
+				_, size := utf8.DecodeRuneInString(rest)
+				b.WriteString(rest[:size])
+				rest = rest[size:]
+				continue
+			}
+			if end < 0 {
+				end = len(rest)
+			}
+			token := rest[:end]
+			rest = rest[end:]
+			if !rule.matchesWord(token) {
+				b.WriteString(token)
+				continue
+			}
+			matched = true
+			if !mask {
+				b.WriteString(token)
+				continue
+			}
+			for _, r := range token {
+				if _, ok := normalizeRune(r); ok {
+					b.WriteByte('*')
+				} else {
+					b.WriteRune(r)
+				}
+			}
+		}
+		s = b.String()
+	}
+
+	for _, re := range rule.patterns {
+		if !re.MatchString(s) {
+			continue
+		}
+		matched = true
+		if mask {
+			s = re.ReplaceAllStringFunc(s, func(m string) string {
+				return strings.Repeat("*", utf8.RuneCountInString(m))
+			})
+		}
+	}
+	return s, matched
+}
+
+func (rule compiledRule) matchesWord(token string) bool {
+	letters := normalizeLetters(token)
+	if len(letters) == 0 {
+		return false
+	}
+	skeleton := collapseRepeats(letters)
+	for _, w := range rule.words {
+		// Повторы схлопываются, но слово не может быть короче термина:
+		// иначе "as" совпадало бы с "ass"
+		if len(letters) < w.length {
+			continue
+		}
+		if skeleton == w.skeleton || (w.prefix && strings.HasPrefix(skeleton, w.skeleton)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mapTextSegments applies fn to the text outside of HTML tags
+func mapTextSegments(s string, isHTML bool, fn func(string) string) string {
+	if !isHTML {
+		return fn(s)
+	}
+	return mapHTMLText(s, nil, fn)
+}
+
+// mapHTMLText applies fn to the text nodes of sanitized HTML, leaving tags
+// and their attributes alone. Text inside the elements named in skip is
+// not passed to fn either. The sanitizer escapes "<" and ">" in attribute
+// values, so the first ">" always ends a tag.
+func mapHTMLText(s string, skip map[string]bool, fn func(string) string) string {
+	var b strings.Builder
+	depth := 0 // вложенность элементов из skip
+	for len(s) > 0 {
+		if s[0] == '<' {
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				end = len(s) - 1
+			}
+			tag := s[:end+1]
+			if name, closing := htmlTagName(tag); skip[name] {
+				if !closing {
+					depth++
+				} else if depth > 0 {
+					depth--
+				}
+			}
+			b.WriteString(tag)
+			s = s[end+1:]
+			continue
+		}
+		end := strings.IndexByte(s, '<')
+		if end < 0 {
+			end = len(s)
+		}
+		if depth == 0 {
+			b.WriteString(fn(s[:end]))
+		} else {
+			b.WriteString(s[:end])
+		}
+		s = s[end:]
+	}
+	return b.String()
+}
+
+// htmlTagName returns the lower-case element name of a tag like <a href=..>
+// or </a>, and whether it is a closing tag
+func htmlTagName(tag string) (string, bool) {
+	tag = strings.TrimPrefix(tag, "<")
+	closing := strings.HasPrefix(tag, "/")
+	tag = strings.TrimPrefix(tag, "/")
+	end := strings.IndexAny(tag, " \t\n/>")
+	if end < 0 {
+		end = len(tag)
+	}
+	return strings.ToLower(tag[:end]), closing
+}
+
+func (f *ContentFilter) linkAllowed(link string) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if len(f.links.Allow) > 0 && !matchesDomain(host, f.links.Allow) {
+		return false
+	}
+	return !matchesDomain(host, f.links.Deny)
+}
+
+// matchesDomain reports whether host is one of the domains or their subdomain
+func matchesDomain(host string, domains []string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRejection is the error shown to the author of rejected content;
+// the rule is not named so it is harder to work around
+func filterRejection(what string) error {
+	return fmt.Errorf("%s contains blocked content", what)
+}
+
+// startContentFilter compiles the configured rules. The filter is not a
+// message hook: filterMessage is called directly in the send path, so a
+// failing filter rejects the message instead of being skipped.
+func startContentFilter() error {
+	f, err := NewContentFilter(config.ContentFilter)
+	if err != nil {
+		return err
+	}
+	contentFilter = f
+	return nil
+}
+
+// filterMessage checks rendered message content and masks it in place.
+// It returns the rules that flagged the message for the moderation queue;
+// a panic in the filter rejects the message.
+func filterMessage(msg *Message) (flagged []string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Content filter failed: %v", p)
+			flagged, err = nil, RejectMessage("the message could not be checked")
+		}
+	}()
+	result := contentFilter.Check(msg.Content, true)
+	if result.Rejected != "" {
+		return nil, RejectMessage("the message contains blocked content")
+	}
+	msg.Content = result.Text
+	return result.Flagged, nil
+}
+
+// flagMessage files a content filter report about a saved message
+func flagMessage(msg Message, rules []string) {
+	_, err := fileReport(Report{
+		ReportedUser: msg.FromUser,
+		MessageID:    msg.ID,
+		Reason:       "content filter: " + strings.Join(rules, ", "),
+		Snapshot:     &msg,
+		Context:      messageContext(loadMessages(), msg),
+	})
+	if err != nil {
+		log.Printf("Content filter report for message %d failed: %v", msg.ID, err)
+	}
+}
+
+// flagProfile files a content filter report about a profile field
+func flagProfile(username, field, value string, rules []string) {
+	_, err := fileReport(Report{
+		ReportedUser: username,
+		Reason:       fmt.Sprintf("content filter: %s in %s: %q", strings.Join(rules, ", "), field, value),
+	})
+	if err != nil {
+		log.Printf("Content filter report for %s failed: %v", username, err)
+	}
+}
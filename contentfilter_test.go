@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+// useContentFilter installs a filter for the test
+func useContentFilter(t *testing.T, f *ContentFilter) {
+	old := contentFilter
+	contentFilter = f
+	t.Cleanup(func() { contentFilter = old })
+}
+
+func TestContentFilterFailsClosed(t *testing.T) {
+	useTempBlobStore(t)
+	useTempMessageLog(t)
+	oldUsers := usersFile
+	usersFile = filepath.Join(t.TempDir(), "users.json")
+	t.Cleanup(func() { usersFile = oldUsers })
+	for _, u := range []string{"alice", "bob"} {
+		if err := createUser(u, "secret123"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Сломанное правило роняет фильтр: сообщение не должно уйти без проверки
+	useContentFilter(t, &ContentFilter{rules: []compiledRule{
+		{name: "broken", action: FilterReject, patterns: []*regexp.Regexp{nil}},
+	}})
+	msg := Message{FromUser: "alice", ToUser: "bob", Content: "hello"}
+	var rejection *HookRejection
+	if err := appendMessage(&msg); !errors.As(err, &rejection) {
+		t.Fatalf("message with a failing filter = %v, want a rejection", err)
+	}
+	if messages := loadMessages(); len(messages) != 0 {
+		t.Fatalf("saved %d messages despite the failing filter", len(messages))
+	}
+
+	f, err := NewContentFilter(ContentFilterConfig{Enabled: true, Rules: []FilterRule{
+		{Name: "mask", Words: []string{"darn"}, Action: FilterMask},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	useContentFilter(t, f)
+	msg = Message{FromUser: "alice", ToUser: "bob", Content: "darn it"}
+	if err := appendMessage(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadMessages()[0].Content; got != "<p>**** it</p>\n" {
+		t.Fatalf("stored content = %q, want the word masked", got)
+	}
+}
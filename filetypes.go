@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// FilesConfig limits which kinds of files users can upload
+type FilesConfig struct {
+	AllowedExtensions []string `json:"allowed_extensions"`
+	StripMetadata     bool     `json:"strip_metadata"` // удалять EXIF/XMP/текстовые блоки из JPEG и PNG
+}
+
+var (
+	ErrFileTypeNotAllowed = errors.New("unsupported file type")
+	ErrFileTypeMismatch   = errors.New("file content does not match its extension")
+)
+
+// fileTypes maps every extension the server knows how to verify to the
+// MIME types its content may be sniffed as. The first one is served.
+var fileTypes = map[string][]string{
+	".jpg":  {"image/jpeg"},
+	".jpeg": {"image/jpeg"},
+	".png":  {"image/png"},
+	".gif":  {"image/gif"},
+	".webp": {"image/webp"},
+	".mp4":  {"video/mp4"},
+	".webm": {"video/webm"},
+	".mov":  {"video/quicktime", "video/mp4"},
+	".mp3":  {"audio/mpeg"},
+	".pdf":  {"application/pdf"},
+	".doc":  {"application/msword"},
+	".docx": {"application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+	".txt":  {"text/plain"},
+}
+
+// inlineSafeTypes can be rendered by the browser from our origin;
+// everything else is served as a download
+var inlineSafeTypes = map[string]bool{
+	"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true,
+	"video/mp4": true, "video/webm": true, "video/quicktime": true,
+	"audio/mpeg": true,
+}
+
+func isAllowedExtension(ext string) bool {
+	ext = strings.ToLower(ext)
+	if _, known := fileTypes[ext]; !known {
+		return false
+	}
+	for _, allowed := range config.Files.AllowedExtensions {
+		if strings.EqualFold(allowed, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffContentType detects the MIME type from the first bytes of a file
+func sniffContentType(head []byte) string {
+	switch {
+	case len(head) >= 12 && string(head[4:8]) == "ftyp" && string(head[8:12]) == "qt  ":
+		return "video/quicktime"
+	case bytes.HasPrefix(head, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}):
+		// Составной документ OLE (.doc)
+		return "application/msword"
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) &&
+		(bytes.Contains(head, []byte("[Content_Types].xml")) || bytes.Contains(head, []byte("word/"))):
+		return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	}
+	contentType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	return contentType
+}
+
+// detectFileType checks that the file's content matches its allowed
+// extension and returns the MIME type to store and serve it with
+func detectFileType(fileName string, head []byte) (string, error) {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if !isAllowedExtension(ext) {
+		return "", ErrFileTypeNotAllowed
+	}
+
+	detected := sniffContentType(head)
+	for _, t := range fileTypes[ext] {
+		if t == detected {
+			return fileTypes[ext][0], nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s is %s", ErrFileTypeMismatch, ext, detected)
+}
+
+// stripImageMetadata removes EXIF, XMP, comments and text chunks from
+// JPEG and PNG images; other content is returned unchanged
+func stripImageMetadata(contentType string, data []byte) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEGMetadata(data)
+	case "image/png":
+		return stripPNGMetadata(data)
+	}
+	return data, nil
+}
+
+// stripJPEGMetadata drops APP1 (EXIF/XMP), APP13 (IPTC) and COM segments.
+// Orientation stored in EXIF is lost with them.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("invalid JPEG")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, errors.New("invalid JPEG segment")
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			pos++ // байт-заполнитель
+			continue
+		}
+		if marker == 0xD9 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+			out.Write(data[pos : pos+2])
+			pos += 2
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		if marker == 0xDA {
+			// Начало сжатых данных: дальше копируем как есть
+			out.Write(data[pos:])
+			return out.Bytes(), nil
+		}
+		if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	out.Write(data[pos:])
+	return out.Bytes(), nil
+}
+
+// stripPNGMetadata drops tEXt, zTXt, iTXt, eXIf and tIME chunks
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errors.New("invalid PNG")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.WriteString(signature)
+
+	pos := len(signature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if end > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		switch string(data[pos+4 : pos+8]) {
+		case "tEXt", "zTXt", "iTXt", "eXIf", "tIME":
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	return out.Bytes(), nil
+}
+
+// inspectUpload verifies the file type of r and returns its MIME type and
+// a reader with the (possibly cleaned) content
+func inspectUpload(fileName string, r io.Reader) (string, io.Reader, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, err
+	}
+	head = head[:n]
+
+	contentType, err := detectFileType(fileName, head)
+	if err != nil {
+		return "", nil, err
+	}
+	content := io.MultiReader(bytes.NewReader(head), r)
+
+	if config.Files.StripMetadata && (contentType == "image/jpeg" || contentType == "image/png") {
+		// Изображения не больше 10MB, их можно обработать в памяти
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return "", nil, err
+		}
+		if data, err = stripImageMetadata(contentType, data); err != nil {
+			return "", nil, fmt.Errorf("%w: %v", ErrFileTypeMismatch, err)
+		}
+		content = bytes.NewReader(data)
+	}
+	return contentType, content, nil
+}
+
+// isRejectedUpload reports whether err is a rejection of the file itself
+// rather than a storage failure
+func isRejectedUpload(err error) bool {
+	return errors.Is(err, ErrFileTypeNotAllowed) || errors.Is(err, ErrFileTypeMismatch) ||
+		errors.Is(err, ErrFileRejected)
+}
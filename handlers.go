@@ -1,17 +1,22 @@
 package main
 
 import (
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 func handleHome(w http.ResponseWriter, r *http.Request) {
@@ -54,27 +59,281 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		username := strings.TrimSpace(r.FormValue("username"))
 		password := r.FormValue("password")
 
+		// Пока действует задержка или блокировка, пароль не проверяется
+		user := findUser(username)
+		if wait, locked := passwordLoginWait(user, clientIP(r)); wait > 0 {
+			seconds := int(wait.Seconds()) + 1
+			w.Header().Set("Retry-After", fmt.Sprint(seconds))
+			if locked {
+				http.Error(w, fmt.Sprintf("Too many failed login attempts, try again in %d minutes", (seconds+59)/60), http.StatusTooManyRequests)
+			} else {
+				http.Error(w, fmt.Sprintf("Too many failed login attempts, try again in %d seconds", seconds), http.StatusTooManyRequests)
+			}
+			return
+		}
+
 		if !validateUser(username, password) {
+			recordLoginFailure(r, username, user, "invalid password")
 			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 			return
 		}
+		beginLogin(w, r, user)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/login.html"))
+	tmpl.Execute(w, nil)
+}
+
+// beginLogin continues a login once the password is checked: users with
+// 2FA go on to the second step, everyone else is signed in
+func beginLogin(w http.ResponseWriter, r *http.Request, user *User) {
+	if user.isSuspended() {
+		http.Error(w, "Account suspended until "+user.SuspendedUntil.Format("2006-01-02 15:04"), http.StatusForbidden)
+		return
+	}
 
-		updateUserStatus(username, true)
+	if user.TOTPEnabled {
+		// Второй шаг: пароль подтверждён, ждём код из приложения
+		token, err := startPendingLogin(user.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		session, _ := store.Get(r, "session-name")
-		session.Values["username"] = username
+		session.Values["2fa_token"] = token
 		session.Save(r, w)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+	completeLogin(w, r, user.Username)
+}
+
+// handleUnlockLink signs the owner of a locked account in with an unlock
+// link and the password; the link proves more than the password, so the
+// lockout of the account does not apply
+func handleUnlockLink(w http.ResponseWriter, r *http.Request) {
+	// Токен в адресе не должен уйти на другие сайты в Referer
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	token := r.FormValue("token")
+	data := struct {
+		Token    string
+		Username string
+		Valid    bool
+		Error    string
+	}{Token: token}
+	data.Username, data.Valid = findAccountToken(token, TokenUnlock)
+
+	if r.Method == "POST" && data.Valid {
+		user := findUser(data.Username)
+		if wait, _ := lockoutBypassWait(user, clientIP(r)); wait > 0 {
+			seconds := int(wait.Seconds()) + 1
+			w.Header().Set("Retry-After", fmt.Sprint(seconds))
+			http.Error(w, fmt.Sprintf("Too many failed login attempts, try again in %d seconds", seconds), http.StatusTooManyRequests)
+			return
+		}
+		switch {
+		case !validateUser(data.Username, r.FormValue("password")):
+			recordLoginFailure(r, data.Username, user, "invalid password")
+			data.Error = "Invalid password"
+		default:
+			if _, ok := takeAccountToken(token, TokenUnlock); !ok {
+				data.Valid = false
+				break
+			}
+			unlockAccount(data.Username)
+			beginLogin(w, r, user)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/unlock_account.html"))
+	tmpl.Execute(w, data)
+}
 
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+// completeLogin signs the user in once all login steps have passed
+func completeLogin(w http.ResponseWriter, r *http.Request, username string) {
+	token, err := createSession(r, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	recordLoginSuccess(r, username)
+	updateUserStatus(username, true)
+	session, _ := store.Get(r, "session-name")
+	if pending, ok := session.Values["2fa_token"].(string); ok {
+		endPendingLogin(pending)
+		delete(session.Values, "2fa_token")
+	}
+	session.Values["username"] = username
+	session.Values["sid"] = token
+	session.Values["auth_time"] = time.Now().Unix()
+	session.Save(r, w)
 
-	tmpl := template.Must(template.ParseFiles("templates/login.html"))
-	tmpl.Execute(w, nil)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// handleLoginTwoFactor is the second login step for users with 2FA: a TOTP
+// code or a recovery code
+func handleLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	token, _ := session.Values["2fa_token"].(string)
+	pending, ok := findPendingLogin(token)
+	username := pending.username
+	user := findUser(username)
+	if !ok || user == nil || user.Disabled || user.isSuspended() || !sessionValid(user, pending.started.Unix()) {
+		if token != "" {
+			endPendingLogin(token)
+		}
+		delete(session.Values, "2fa_token")
+		session.Save(r, w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var errorText string
+	if r.Method == "POST" {
+		// Пароль уже проверен: с верным кодом блокировка аккаунта не мешает
+		if wait, _ := lockoutBypassWait(user, clientIP(r)); wait > 0 {
+			seconds := int(wait.Seconds()) + 1
+			w.Header().Set("Retry-After", fmt.Sprint(seconds))
+			http.Error(w, fmt.Sprintf("Too many failed login attempts, try again in %d seconds", seconds), http.StatusTooManyRequests)
+			return
+		}
+		if err := checkSecondFactor(username, r.FormValue("code")); err == nil {
+			completeLogin(w, r, username)
+			return
+		}
+		recordLoginFailure(r, username, user, "invalid two-factor code")
+		w.WriteHeader(http.StatusUnauthorized)
+		errorText = "Invalid code"
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/login_2fa.html"))
+	tmpl.Execute(w, struct{ Error string }{errorText})
+}
+
+// handleToken issues a JWT for the /api routes; users with 2FA pass "code"
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	var reqData struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	username := strings.TrimSpace(reqData.Username)
+
+	user := findUser(username)
+	if wait, locked := passwordLoginWait(user, clientIP(r)); wait > 0 {
+		seconds := int(wait.Seconds()) + 1
+		w.Header().Set("Retry-After", fmt.Sprint(seconds))
+		if locked {
+			http.Error(w, fmt.Sprintf("Too many failed login attempts, try again in %d minutes", (seconds+59)/60), http.StatusTooManyRequests)
+		} else {
+			http.Error(w, fmt.Sprintf("Too many failed login attempts, try again in %d seconds", seconds), http.StatusTooManyRequests)
+		}
+		return
+	}
+	if !validateUser(username, reqData.Password) {
+		recordLoginFailure(r, username, user, "invalid password")
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if user.isSuspended() {
+		http.Error(w, "Account suspended until "+user.SuspendedUntil.Format("2006-01-02 15:04"), http.StatusForbidden)
+		return
+	}
+	switch {
+	case user.TOTPEnabled && reqData.Code == "":
+		http.Error(w, "Two-factor code required", http.StatusUnauthorized)
+		return
+	case user.TOTPEnabled:
+		if err := checkSecondFactor(username, reqData.Code); err != nil {
+			recordLoginFailure(r, username, user, "invalid two-factor code")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	case twoFactorRequired() && !user.IsBot:
+		http.Error(w, ErrTwoFactorRequired.Error(), http.StatusForbidden)
+		return
+	}
+
+	expires := time.Now().Add(24 * time.Hour)
+	claims := &Claims{
+		Username: username,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expires.Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordLoginSuccess(r, username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expires_at": expires})
+}
+
+// handleForgotPassword starts a password reset. The answer is the same
+// whether or not the account exists.
+func handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var sent bool
+	if r.Method == "POST" {
+		// В фоне, чтобы время ответа не выдавало существование аккаунта
+		go requestPasswordReset(r.FormValue("username"), clientIP(r))
+		sent = true
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/forgot_password.html"))
+	tmpl.Execute(w, struct {
+		Sent    bool
+		Message string
+	}{sent, resetRequestMessage})
+}
+
+// handleResetPassword sets a new password with the token from a reset link
+func handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	// Токен в адресе не должен уйти на другие сайты в Referer
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	token := r.FormValue("token")
+	data := struct {
+		Token string
+		Valid bool
+		Done  bool
+		Error string
+	}{Token: token}
+	_, data.Valid = findPasswordReset(token)
+
+	if r.Method == "POST" && data.Valid {
+		password := r.FormValue("password")
+		if password != r.FormValue("confirm") {
+			data.Error = "Passwords do not match"
+		} else if err := resetPassword(token, password, clientIP(r)); err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Done = true
+		}
+		if data.Error != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/reset_password.html"))
+	tmpl.Execute(w, data)
 }
 
 func handleLogout(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "session-name")
 	if username, ok := session.Values["username"].(string); ok {
+		token, _ := session.Values["sid"].(string)
+		endSession(username, token)
 		updateUserStatus(username, false)
 	}
 	session.Values = make(map[interface{}]interface{})
@@ -103,10 +362,12 @@ func handleMessages(w http.ResponseWriter, r *http.Request) {
 		Messages    []Message
 		OnlineUsers []string
 		CurrentUser string
+		IsAdmin     bool
 	}{
 		Messages:    userMessages,
-		OnlineUsers: getOnlineUsers(),
+		OnlineUsers: getOnlineUsers(username),
 		CurrentUser: username,
+		IsAdmin:     isAdmin(username),
 	}
 
 	tmpl := template.Must(template.ParseFiles("templates/messages.html"))
@@ -125,47 +386,63 @@ func handleSendMessage(w http.ResponseWriter, r *http.Request) {
 	content := strings.TrimSpace(r.FormValue("content"))
 	isGroup := r.FormValue("is_group") == "true"
 
-	// Process content with Markdown
-	content = processMessageContent(content)
+	// Slash-команды обрабатываются до создания сообщения
+	target := Message{ToUser: to, IsGroup: isGroup, ClientIP: clientIP(r)}
+	if isGroup {
+		target.GroupUsers = strings.Split(to, ",")
+	}
+	if handled, err := runSlashCommand(from, target, content); handled {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/messages", http.StatusSeeOther)
+		return
+	}
+
+	// Вложения: несколько полей attachment и подписи caption в том же порядке
+	var files []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		files = r.MultipartForm.File["attachment"]
+	}
 
 	// Create message based on type
 	var err error
-	if isGroup {
-		groupUsers := strings.Split(to, ",")
-		err = createGroupMessage(from, groupUsers, content)
-	} else {
-		// Check for file attachment
-		file, header, fileErr := r.FormFile("attachment")
-		if fileErr == nil {
-			defer file.Close()
-			// Validate file
-			if err := validateFileUpload(header.Filename, header.Size); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			data, err := io.ReadAll(file)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			fileData := base64.StdEncoding.EncodeToString(data)
-			fileName := header.Filename
-
-			messages := loadMessages()
-			newMessage := Message{
-				ID:        len(messages) + 1,
-				FromUser:  from,
-				ToUser:    to,
-				Content:   content,
-				CreatedAt: time.Now(),
-				HasFile:   true,
-				FileName:  fileName,
-				FileData:  fileData,
-			}
-			err = saveMessages(append(messages, newMessage))
-		} else {
-			err = createMessage(from, to, content)
+	switch {
+	case len(files) > 0:
+		if isGroup && !containsUser(target.GroupUsers, from) {
+			http.Error(w, "you are not a member of this group", http.StatusForbidden)
+			return
+		}
+		atts, release, storeErr := storeAttachments(r.Context(), from, target, files, r.MultipartForm.Value["caption"])
+		if storeErr != nil {
+			http.Error(w, storeErr.Error(), storeErrorStatus(storeErr))
+			return
+		}
+		defer release()
+
+		msg := Message{
+			FromUser:   from,
+			ToUser:     to,
+			Content:    content,
+			CreatedAt:  time.Now(),
+			IsGroup:    isGroup,
+			GroupUsers: target.GroupUsers,
+			ClientIP:   target.ClientIP,
+		}
+		if isGroup {
+			msg.ToUser = "group"
 		}
+		setAttachments(&msg, atts)
+		// Сообщение создаётся со всеми файлами или не создаётся вовсе
+		if err = appendMessage(&msg); err != nil {
+			discardAttachments(atts)
+		}
+	case isGroup:
+		groupUsers := strings.Split(to, ",")
+		err = createGroupMessage(from, groupUsers, content, clientIP(r))
+	default:
+		err = createMessage(from, to, content, clientIP(r))
 	}
 
 	if err != nil {
@@ -173,10 +450,6 @@ func handleSendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Добавляем уведомление получателю
-	notificationService.Add(to, "new_message",
-		fmt.Sprintf("New message from %s", from))
-
 	http.Redirect(w, r, "/messages", http.StatusSeeOther)
 }
 
@@ -197,7 +470,7 @@ func handleEditMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := editMessage(reqData.MessageID, username, reqData.NewContent); err != nil {
+	if err := editMessage(reqData.MessageID, username, reqData.NewContent, clientIP(r)); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -222,19 +495,15 @@ func handleReplyMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Process content with Markdown
-	reqData.Content = processMessageContent(reqData.Content)
-
-	messages := loadMessages()
 	newMessage := Message{
-		ID:        len(messages) + 1,
 		FromUser:  username,
 		ToUser:    reqData.ToUser,
 		Content:   reqData.Content,
 		CreatedAt: time.Now(),
 		ReplyTo:   reqData.ReplyTo,
+		ClientIP:  clientIP(r),
 	}
-	if err := saveMessages(append(messages, newMessage)); err != nil {
+	if err := appendMessage(&newMessage); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -265,7 +534,7 @@ func handleAPI(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(userMessages)
 
 	case "/api/users/online":
-		json.NewEncoder(w).Encode(getOnlineUsers())
+		json.NewEncoder(w).Encode(getOnlineUsers(username))
 
 	case "/api/messages/delete":
 		if r.Method != "POST" {
@@ -281,7 +550,7 @@ func handleAPI(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := deleteMessage(reqData.MessageID, username); err != nil {
+		if err := deleteMessage(reqData.MessageID, username, clientIP(r)); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -301,7 +570,7 @@ func handleAPI(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := markMessageAsRead(reqData.MessageID, username); err != nil {
+		if err := markMessageAsRead(reqData.MessageID, username, clientIP(r)); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -324,12 +593,25 @@ func handleAPI(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 
 	case "/api/history":
+		// История группы: ?group=участник1,участник2,...
+		if group := r.URL.Query().Get("group"); group != "" {
+			members := strings.Split(group, ",")
+			history, err := getGroupHistory(username, members)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			notificationService.MarkConversationRead(username, "group:"+groupKey(members))
+			json.NewEncoder(w).Encode(history)
+			return
+		}
 		withUser := r.URL.Query().Get("with")
 		if withUser == "" {
 			http.Error(w, "User parameter required", http.StatusBadRequest)
 			return
 		}
 		history := getMessageHistory(username, withUser)
+		notificationService.MarkConversationRead(username, "dm:"+withUser)
 		json.NewEncoder(w).Encode(history)
 
 	case "/api/avatar":
@@ -361,7 +643,7 @@ func handleAPI(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := editMessage(reqData.MessageID, username, reqData.NewContent); err != nil {
+		if err := editMessage(reqData.MessageID, username, reqData.NewContent, clientIP(r)); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -383,16 +665,15 @@ func handleAPI(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		messages := loadMessages()
 		newMessage := Message{
-			ID:        len(messages) + 1,
 			FromUser:  username,
 			ToUser:    reqData.ToUser,
 			Content:   reqData.Content,
 			CreatedAt: time.Now(),
 			ReplyTo:   reqData.ReplyTo,
+			ClientIP:  clientIP(r),
 		}
-		if err := saveMessages(append(messages, newMessage)); err != nil {
+		if err := appendMessage(&newMessage); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -423,19 +704,40 @@ func handleAPI(w http.ResponseWriter, r *http.Request) {
 		w.Write(data)
 
 	case "/api/messages/upload":
-		file, header, err := r.FormFile("file")
-		if err != nil {
+		// Файлы пишутся в хранилище потоком, без чтения в память
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxAttachmentsPerMessage)*maxFileSize()+1<<20)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer file.Close()
+		files := r.MultipartForm.File["file"]
+		if len(files) == 0 {
+			http.Error(w, "no files", http.StatusBadRequest)
+			return
+		}
 
-		if err := validateMediaFile(header.Filename, header.Size); err != nil {
+		target := Message{ToUser: strings.TrimSpace(r.FormValue("to")), IsGroup: r.FormValue("is_group") == "true", ClientIP: clientIP(r)}
+		if target.IsGroup {
+			target.GroupUsers = strings.Split(target.ToUser, ",")
+			if !containsUser(target.GroupUsers, username) {
+				http.Error(w, "you are not a member of this group", http.StatusForbidden)
+				return
+			}
+		}
+		atts, release, err := storeAttachments(r.Context(), username, target, files, r.MultipartForm.Value["caption"])
+		if err != nil {
+			http.Error(w, err.Error(), storeErrorStatus(err))
+			return
+		}
+		defer release()
+		msg, err := sendMessageWithAttachments(username, target, r.FormValue("content"), atts)
+		if err != nil {
+			discardAttachments(atts)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		// Продолжаем обработку файла...
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msg)
 	}
 }
 
@@ -456,6 +758,11 @@ func jwtAuthMiddleware(next http.Handler) http.Handler {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
+		// Смена пароля отзывает все выданные до неё токены
+		if user := findUser(claims.Username); user == nil || !sessionValid(user, claims.IssuedAt) {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
 
 		next.ServeHTTP(w, r)
 	})
@@ -470,6 +777,13 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	session, _ := store.Get(r, "session-name")
 	username := session.Values["username"].(string)
+	untrack := trackSessionConn(conn, username, currentSessionID(r))
+	defer untrack()
+
+	if max := config.RateLimits.WebSocket.MaxFrameBytes; config.RateLimits.Enabled && max > 0 {
+		conn.SetReadLimit(max) // слишком большой кадр закрывает соединение
+	}
+	frames := newWSFrameLimiter()
 
 	// Add user to active connections
 	clientsMutex.Lock()
@@ -490,15 +804,67 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	// Read messages from WebSocket
 	for {
-		var msg Message
-		if err := conn.ReadJSON(&msg); err != nil {
+		var frame Message
+		if err := conn.ReadJSON(&frame); err != nil {
 			break
 		}
+		if ok, retryAfter, abusive := frames.allow(); !ok {
+			if abusive {
+				log.Printf("Closing WebSocket of %s: too many frames", username)
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"),
+					time.Now().Add(time.Second))
+				break
+			}
+			conn.WriteJSON(map[string]interface{}{"error": "rate limit exceeded", "retry_after": int(retryAfter.Seconds()) + 1})
+			continue
+		}
+		if ok, retryAfter := allowSend(username); !ok {
+			conn.WriteJSON(map[string]interface{}{"error": "rate limit exceeded", "retry_after": int(retryAfter.Seconds()) + 1})
+			continue
+		}
+		// Из кадра берутся только поля, которые задаёт клиент; служебные
+		// (Webhook, Command, FromBot и другие) выставляет сервер
+		msg := Message{
+			FromUser:    username,
+			ToUser:      frame.ToUser,
+			Content:     frame.Content,
+			CreatedAt:   time.Now(),
+			IsGroup:     frame.IsGroup,
+			GroupUsers:  frame.GroupUsers,
+			ReplyTo:     frame.ReplyTo,
+			Attachments: frame.Attachments,
+			ClientIP:    clientIP(r),
+		}
+
+		if handled, err := runSlashCommand(username, msg, msg.Content); handled {
+			if err != nil {
+				conn.WriteJSON(map[string]string{"error": err.Error()})
+			}
+			continue
+		}
+
+		// Клиент передаёт только ID черновых вложений и подписи;
+		// метаданные файлов берутся на сервере
+		var refs []AttachmentRef
+		for _, att := range msg.Attachments {
+			refs = append(refs, AttachmentRef{ID: att.ID, Caption: att.Caption})
+		}
+		msg.Attachments = nil
+		if len(refs) > 0 {
+			if _, err := sendStagedMessage(username, msg, msg.Content, refs); err != nil {
+				conn.WriteJSON(map[string]string{"error": err.Error()})
+			}
+			continue
+		}
 
-		// Format and broadcast message
-		msg = formatMessage(msg)
 		if msg.IsGroup {
-			broadcastGroupMessage(msg)
+			msg.ToUser = "group"
+			if err := appendMessage(&msg); err != nil {
+				conn.WriteJSON(map[string]string{"error": err.Error()})
+				continue
+			}
+			deliverMessage(msg)
 		} else {
 			messageChan <- msg
 		}
@@ -515,16 +881,16 @@ func handleUserMessages(username string, ch chan Message) {
 		}
 
 		// Add new message
-		messages = append(messages, msg)
-		saveMessages(messages)
+		if err := appendMessage(&msg); err != nil {
+			log.Printf("Failed to save message from %s: %v", username, err)
+			continue
+		}
 
 		// Update cache
-		cacheMessages(username, messages)
+		cacheMessages(username, append(messages, msg))
 
 		// Notify recipient
-		if client, ok := clients[msg.ToUser]; ok {
-			client.WriteJSON(msg)
-		}
+		deliverMessage(msg)
 	}
 }
 
@@ -544,16 +910,39 @@ func handleProfile(w http.ResponseWriter, r *http.Request) {
 	username := session.Values["username"].(string)
 
 	if r.Method == "POST" {
-		var profile UserProfile
-		if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		var reqData struct {
+			UserProfile
+			CurrentPassword string `json:"current_password"`
+			Code            string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		user := findUser(username)
+		if user == nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		// На email приходят ссылки сброса пароля: одного сеанса для его
+		// смены мало, иначе украденный сеанс превращается в захват аккаунта
+		emailChanged := strings.TrimSpace(reqData.Email) != user.Email
+		if emailChanged {
+			if err := confirmIdentity(r, user, reqData.CurrentPassword, reqData.Code); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
 
-		if err := updateProfile(username, profile); err != nil {
+		if err := updateProfile(username, reqData.UserProfile); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		// Ссылки, отправленные на прежний адрес, больше не действуют
+		if emailChanged {
+			dropPasswordResets(username)
+		}
 
 		w.WriteHeader(http.StatusOK)
 		return
@@ -565,8 +954,30 @@ func handleProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	messageCount := 0
+	for _, msg := range loadMessages() {
+		if msg.FromUser == username {
+			messageCount++
+		}
+	}
+	data := struct {
+		UserProfile
+		MessageCount      int
+		Locked            bool
+		Logins            []LoginRecord
+		Sessions          []SessionInfo
+		TwoFactorRequired bool
+	}{
+		UserProfile:       UserProfile{User: *user},
+		MessageCount:      messageCount,
+		Locked:            user.isLocked(),
+		Logins:            loginHistory(username),
+		Sessions:          sessionList(username, currentSessionID(r)),
+		TwoFactorRequired: twoFactorRequired(),
+	}
+
 	tmpl := template.Must(template.ParseFiles("templates/profile.html"))
-	tmpl.Execute(w, user)
+	tmpl.Execute(w, data)
 }
 
 func handleNotifications(w http.ResponseWriter, r *http.Request) {
@@ -614,62 +1025,456 @@ func handleNotifications(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleMessageSearch(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	startDate := r.URL.Query().Get("start")
-	endDate := r.URL.Query().Get("end")
-
-	// Конвертируем даты
-	start, _ := time.Parse("2006-01-02", startDate)
-	end, _ := time.Parse("2006-01-02", endDate)
-
-	session, _ := store.Get(r, "session-name")
-	username := session.Values["username"].(string)
-
-	results := searchMessageHistory(username, query, start, end)
-	json.NewEncoder(w).Encode(results)
+func handlePushKey(w http.ResponseWriter, r *http.Request) {
+	if pushService == nil {
+		http.Error(w, "Push notifications are disabled", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"public_key": pushService.PublicKey()})
 }
 
-func handleMessageStats(w http.ResponseWriter, r *http.Request) {
+func handlePushSubscribe(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "session-name")
-	username := session.Values["username"].(string)
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if pushService == nil {
+		http.Error(w, "Push notifications are disabled", http.StatusNotFound)
+		return
+	}
 
-	stats := struct {
-		TotalMessages int
-		UnreadCount   int
-		GroupCount    int
-	}{
-		TotalMessages: len(loadMessages()),
-		UnreadCount:   getUnreadCount(username),
-		GroupCount:    len(getUserGroups(username)),
+	var sub PushSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	json.NewEncoder(w).Encode(stats)
+	var err error
+	if r.Method == "DELETE" {
+		err = pushService.Unsubscribe(username, sub.Endpoint)
+	} else {
+		sub.Device = r.UserAgent()
+		err = pushService.Subscribe(username, sub)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
-func handleSettings(w http.ResponseWriter, r *http.Request) {
+func handleMentions(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "session-name")
-	username := session.Values["username"].(string)
-
-	if r.Method == "POST" {
-		var settings UserSettings
-		json.NewDecoder(r.Body).Decode(&settings)
-		updateUserSettings(username, settings)
-		w.WriteHeader(http.StatusOK)
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	user := findUser(username)
-	json.NewEncoder(w).Encode(user.Settings)
+	mentions := getMentions(username)
+	if unread := r.URL.Query().Get("unread"); unread == "true" {
+		var filtered []Message
+		for _, msg := range mentions {
+			if !msg.IsRead {
+				filtered = append(filtered, msg)
+			}
+		}
+		mentions = filtered
+	}
+	json.NewEncoder(w).Encode(mentions)
 }
 
-func handleUserStatus(w http.ResponseWriter, r *http.Request) {
+func handleCommands(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "session-name")
-	username := session.Values["username"].(string)
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	status := getUserStatus(username)
-	if status == (UserStatus{}) {
-		status = UserStatus{
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(listCommands(username))
+
+	case "POST":
+		// Внешняя команда заставляет сервер обращаться по чужому адресу
+		if !isAdmin(username) {
+			http.Error(w, "only admins can register commands", http.StatusForbidden)
+			return
+		}
+		var reqData struct {
+			Name        string   `json:"name"`
+			URL         string   `json:"url"`
+			Description string   `json:"description"`
+			Users       []string `json:"users"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		secret, err := registerExternalCommand(username, reqData.Name, reqData.URL, reqData.Description, reqData.Users)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"secret": secret})
+
+	case "DELETE":
+		if err := deleteExternalCommand(r.URL.Query().Get("name"), username); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// botRequest is the owner-facing bot description; groups are member lists
+type botRequest struct {
+	Username       string     `json:"username"`
+	ReadGroups     [][]string `json:"read_groups"`
+	PostGroups     [][]string `json:"post_groups"`
+	DirectMessages bool       `json:"direct_messages"`
+	RateLimit      int        `json:"rate_limit"`
+}
+
+func (req botRequest) permissions() BotPermissions {
+	perms := BotPermissions{DirectMessages: req.DirectMessages}
+	for _, g := range req.ReadGroups {
+		perms.ReadGroups = append(perms.ReadGroups, groupKey(g))
+	}
+	for _, g := range req.PostGroups {
+		perms.PostGroups = append(perms.PostGroups, groupKey(g))
+	}
+	return perms
+}
+
+func handleBots(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		var bots []Bot
+		for _, b := range loadBots() {
+			if b.Owner == username {
+				b.TokenHash = ""
+				bots = append(bots, b)
+			}
+		}
+		json.NewEncoder(w).Encode(bots)
+
+	case "POST", "PUT":
+		var reqData botRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == "PUT" {
+			if err := updateBot(username, reqData.Username, reqData.permissions(), reqData.RateLimit); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		token, err := createBot(username, reqData.Username, reqData.permissions(), reqData.RateLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+
+	case "DELETE":
+		if err := deleteBot(username, r.URL.Query().Get("username")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func handleBotToken(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := rotateBotToken(username, mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+// writeBotResult writes a Telegram-style {"ok": ..., "result": ...} response
+func writeBotResult(w http.ResponseWriter, status int, result interface{}, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	resp := map[string]interface{}{"ok": status == http.StatusOK}
+	if status == http.StatusOK {
+		resp["result"] = result
+	} else {
+		resp["error_code"] = status
+		resp["description"] = description
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleBotAPI serves /bot{token}/{method}: getMe, getUpdates and sendMessage
+func handleBotAPI(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bot, err := authenticateBot(vars["token"])
+	if err == ErrOwnerInactive {
+		writeBotResult(w, http.StatusForbidden, nil, "Forbidden: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeBotResult(w, http.StatusUnauthorized, nil, "Unauthorized")
+		return
+	}
+
+	if allowed, retryAfter := allowBotRequest(bot); !allowed {
+		seconds := int(retryAfter.Seconds()) + 1
+		w.Header().Set("Retry-After", fmt.Sprint(seconds))
+		writeBotResult(w, http.StatusTooManyRequests, nil,
+			fmt.Sprintf("Too Many Requests: retry after %d", seconds))
+		return
+	}
+
+	switch vars["method"] {
+	case "getMe":
+		bot.TokenHash = ""
+		writeBotResult(w, http.StatusOK, bot, "")
+
+	case "getUpdates":
+		var params struct {
+			Offset  int `json:"offset"`
+			Timeout int `json:"timeout"`
+		}
+		if r.Method == "POST" && r.ContentLength != 0 {
+			json.NewDecoder(r.Body).Decode(&params)
+		} else {
+			fmt.Sscan(r.URL.Query().Get("offset"), &params.Offset)
+			fmt.Sscan(r.URL.Query().Get("timeout"), &params.Timeout)
+		}
+		updates := getBotUpdates(r.Context(), bot.Username, params.Offset,
+			time.Duration(params.Timeout)*time.Second)
+		writeBotResult(w, http.StatusOK, updates, "")
+
+	case "sendMessage":
+		var params struct {
+			ToUser     string   `json:"to_user"`
+			GroupUsers []string `json:"group_users"`
+			Text       string   `json:"text"`
+			ReplyTo    int      `json:"reply_to"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			writeBotResult(w, http.StatusBadRequest, nil, err.Error())
+			return
+		}
+
+		msg, err := sendBotMessage(bot, Message{
+			ToUser:     params.ToUser,
+			Content:    params.Text,
+			IsGroup:    len(params.GroupUsers) > 0,
+			GroupUsers: params.GroupUsers,
+			ReplyTo:    params.ReplyTo,
+			ClientIP:   clientIP(r),
+		})
+		if err != nil {
+			writeBotResult(w, http.StatusForbidden, nil, err.Error())
+			return
+		}
+		writeBotResult(w, http.StatusOK, msg, "")
+
+	default:
+		writeBotResult(w, http.StatusNotFound, nil, "Not Found: method not found")
+	}
+}
+
+func handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		// Показываем только вебхуки групп, в которых состоит пользователь
+		var hooks []IncomingWebhook
+		for _, h := range loadIncomingWebhooks() {
+			if containsUser(h.GroupUsers, username) {
+				h.TokenHash = ""
+				hooks = append(hooks, h)
+			}
+		}
+		json.NewEncoder(w).Encode(hooks)
+
+	case "POST":
+		var reqData struct {
+			Name       string   `json:"name"`
+			Channel    string   `json:"channel"`
+			GroupUsers []string `json:"group_users"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Вебхуки публикуют от имени внешних систем, поэтому создают их только администраторы
+		if !isAdmin(username) {
+			http.Error(w, "Only admins can create webhooks", http.StatusForbidden)
+			return
+		}
+
+		hook, token, err := createIncomingWebhook(username, reqData.Name, reqData.Channel, reqData.GroupUsers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":    hook.ID,
+			"name":  hook.Name,
+			"token": token,
+			"url":   fmt.Sprintf("/hooks/%s/%s", hook.ID, token),
+		})
+
+	case "DELETE":
+		hook := findIncomingWebhook(r.URL.Query().Get("id"))
+		if hook == nil || !containsUser(hook.GroupUsers, username) {
+			http.Error(w, "webhook not found", http.StatusNotFound)
+			return
+		}
+		// Участники группы видят вебхук, но удалить его может только автор или администратор
+		if hook.CreatedBy != username && !isAdmin(username) {
+			http.Error(w, "only the creator or an admin can delete this webhook", http.StatusForbidden)
+			return
+		}
+		if err := deleteIncomingWebhook(hook.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// handleIncomingWebhook accepts Slack-compatible payloads, either as a JSON
+// body or as a form-encoded "payload" field
+func handleIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hook, err := authenticateIncomingWebhook(vars["id"], vars["token"])
+	if err == ErrOwnerInactive {
+		http.Error(w, "owner_inactive", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid_token", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "invalid_payload", http.StatusBadRequest)
+		return
+	}
+	if trimmed := strings.TrimSpace(string(body)); !strings.HasPrefix(trimmed, "{") {
+		form, _ := url.ParseQuery(trimmed)
+		body = []byte(form.Get("payload"))
+	}
+
+	var payload SlackPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid_payload", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := postIncomingWebhook(hook, payload, clientIP(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func handleMessageSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	startDate := r.URL.Query().Get("start")
+	endDate := r.URL.Query().Get("end")
+
+	// Конвертируем даты
+	start, _ := time.Parse("2006-01-02", startDate)
+	end, _ := time.Parse("2006-01-02", endDate)
+
+	session, _ := store.Get(r, "session-name")
+	username := session.Values["username"].(string)
+
+	results := searchMessageHistory(username, query, start, end)
+	json.NewEncoder(w).Encode(results)
+}
+
+func handleMessageStats(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username := session.Values["username"].(string)
+
+	stats := struct {
+		TotalMessages int
+		UnreadCount   int
+		GroupCount    int
+	}{
+		TotalMessages: len(loadMessages()),
+		UnreadCount:   getUnreadCount(username),
+		GroupCount:    len(getUserGroups(username)),
+	}
+
+	json.NewEncoder(w).Encode(stats)
+}
+
+func handleSettings(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username := session.Values["username"].(string)
+
+	if r.Method == "POST" {
+		var settings UserSettings
+		json.NewDecoder(r.Body).Decode(&settings)
+		updateUserSettings(username, settings)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	user := findUser(username)
+	json.NewEncoder(w).Encode(user.Settings)
+}
+
+// handleUserStatus returns the caller's status, or with ?user= the
+// presence of another user as far as their privacy settings allow
+func handleUserStatus(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username := session.Values["username"].(string)
+
+	if other := r.URL.Query().Get("user"); other != "" && other != username {
+		user := findUser(other)
+		if user == nil {
+			http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(visibleStatus(username, user))
+		return
+	}
+
+	status := getUserStatus(username)
+	if status == (UserStatus{}) {
+		status = UserStatus{
 			IsOnline: true,
 			LastSeen: time.Now(),
 		}
@@ -705,9 +1510,9 @@ func handleCreateGroup(w http.ResponseWriter, r *http.Request) {
 
 	// Отправляем первое сообщение в группу
 	err := createGroupMessage(username, groupData.Users,
-		fmt.Sprintf("Group '%s' created by %s", groupData.Name, username))
+		fmt.Sprintf("Group '%s' created by %s", groupData.Name, username), clientIP(r))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -728,7 +1533,11 @@ func handleMessageReaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := addReactionToMessage(reqData.MessageID, username, reqData.Emoji); err != nil {
+	if err := addReactionToMessage(reqData.MessageID, username, reqData.Emoji, clientIP(r)); err != nil {
+		if err == ErrMessageNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -736,19 +1545,22 @@ func handleMessageReaction(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleMessageLogs returns the audit trail. Admins see every entry,
+// other users only entries of their own conversations, without IPs.
 func handleMessageLogs(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "session-name")
-	// username can be used for permission check if needed
-	_, ok := session.Values["username"].(string)
+	username, ok := session.Values["username"].(string)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	admin := isAdmin(username)
 
 	// Получаем параметры фильтрации из query
 	action := r.URL.Query().Get("action")
 	startDate := r.URL.Query().Get("start")
 	endDate := r.URL.Query().Get("end")
+	messageID, _ := strconv.Atoi(r.URL.Query().Get("message_id"))
 
 	// Parse dates
 	var start, end time.Time
@@ -757,19 +1569,1048 @@ func handleMessageLogs(w http.ResponseWriter, r *http.Request) {
 	}
 	if endDate != "" {
 		end, _ = time.Parse("2006-01-02", endDate)
+		end = end.AddDate(0, 0, 1) // включая весь последний день
 	}
 
 	logMutex.RLock()
 	defer logMutex.RUnlock()
 
-	var filteredLogs []MessageLog
+	filteredLogs := []MessageLog{}
 	for _, log := range messageLogs {
 		if (action == "" || log.Action == action) &&
+			(messageID == 0 || log.MessageID == messageID) &&
 			(startDate == "" || !log.Timestamp.Before(start)) &&
-			(endDate == "" || !log.Timestamp.After(end)) {
+			(endDate == "" || log.Timestamp.Before(end)) &&
+			(admin || canViewMessageLog(log, username)) {
+			if !admin {
+				log.IP = ""
+			}
 			filteredLogs = append(filteredLogs, log)
 		}
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(filteredLogs)
 }
+
+// handleFile streams an attachment or one of its thumbnails to a
+// participant of its conversation.
+// http.ServeContent takes care of Range and conditional requests.
+func handleFile(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Чужие вложения неотличимы от несуществующих
+	att, msg := findAttachment(mux.Vars(r)["id"])
+	if att == nil || !isParticipant(*msg, username) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Миниатюра отдаётся с теми же проверками, что и оригинал
+	file := *att
+	if size := mux.Vars(r)["size"]; size != "" {
+		thumb := att.findThumbnail(size)
+		if thumb == nil {
+			http.NotFound(w, r)
+			return
+		}
+		file.BlobKey, file.ContentType = thumb.BlobKey, thumb.ContentType
+	}
+
+	blob, _, err := blobStore.Open(r.Context(), file.BlobKey)
+	if errors.Is(err, ErrBlobNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to open blob for attachment %s: %v", att.ID, err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", file.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Content-Disposition", attachmentDisposition(&file, r.URL.Query().Get("download") == "1"))
+	w.Header().Set("ETag", `"`+file.BlobKey+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, att.FileName, att.CreatedAt, blob)
+}
+
+// handleUploads creates resumable uploads (tus creation extension).
+// Upload-Metadata carries filename, to, is_group and an optional content caption.
+func handleUploads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,checksum,expiration,termination")
+		w.Header().Set("Tus-Checksum-Algorithm", "sha256")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxFileSize(), 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Length required", http.StatusBadRequest)
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	target := Message{ToUser: strings.TrimSpace(meta["to"]), IsGroup: meta["is_group"] == "true"}
+	if target.IsGroup {
+		target.GroupUsers = strings.Split(target.ToUser, ",")
+	}
+	upload, err := createUpload(username, meta["filename"], length, target, meta["content"])
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Location", "/api/uploads/"+upload.ID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleUpload reports (HEAD), continues (PATCH) or cancels (DELETE) an upload
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	switch r.Method {
+	case "HEAD":
+		upload, err := findUpload(id, username)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+
+	case "PATCH":
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "Upload-Offset required", http.StatusBadRequest)
+			return
+		}
+
+		upload, msg, att, err := writeUploadChunk(r.Context(), id, username, offset, r.Body, r.Header.Get("Upload-Checksum"), clientIP(r))
+		if upload != nil {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		}
+		switch {
+		case errors.Is(err, ErrUploadNotFound):
+			http.NotFound(w, r)
+			return
+		case errors.Is(err, ErrUploadOffsetMismatch):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, ErrUploadBusy):
+			http.Error(w, err.Error(), http.StatusLocked)
+			return
+		case errors.Is(err, ErrChecksumMismatch):
+			http.Error(w, err.Error(), 460) // код tus для несовпадения контрольной суммы
+			return
+		case err != nil:
+			http.Error(w, err.Error(), storeErrorStatus(err))
+			return
+		}
+		if att != nil {
+			w.Header().Set("Upload-Attachment-Id", att.ID)
+		}
+		if msg != nil {
+			w.Header().Set("Upload-Message-Id", strconv.Itoa(msg.ID))
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		if err := cancelUpload(id, username); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleStorageUsage reports attachment storage used by the user and their groups
+func handleStorageUsage(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, groups := getStorageUsage(username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user":   user,
+		"groups": groups,
+	})
+}
+
+// handleAttachments stages uploaded files (multipart "file" fields with
+// optional "caption" fields) so they can be sent later through the JSON
+// API or the WebSocket. GET lists staged files, DELETE ?id= removes one.
+func handleAttachments(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		staged := []Attachment{}
+		for _, s := range loadStagedAttachments() {
+			if s.Owner == username {
+				staged = append(staged, s.Attachment)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(staged)
+
+	case "POST":
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxAttachmentsPerMessage)*maxFileSize()+1<<20)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		files := r.MultipartForm.File["file"]
+		if len(files) == 0 {
+			http.Error(w, "no files", http.StatusBadRequest)
+			return
+		}
+		atts, release, err := storeAttachments(r.Context(), username, Message{}, files, r.MultipartForm.Value["caption"])
+		if err != nil {
+			http.Error(w, err.Error(), storeErrorStatus(err))
+			return
+		}
+		defer release()
+		if err := stageAttachments(username, atts); err != nil {
+			discardAttachments(atts)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(atts)
+
+	case "DELETE":
+		atts, err := claimStagedAttachments(username, []AttachmentRef{{ID: r.URL.Query().Get("id")}})
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := unstageAttachments(atts); err != nil {
+			unclaimStagedAttachments(atts)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		discardAttachments(atts)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleSendJSON sends a message with staged attachments:
+// {"to": "...", "is_group": false, "content": "...", "attachments": [{"id": "...", "caption": "..."}]}
+func handleSendJSON(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var reqData struct {
+		To          string          `json:"to"`
+		IsGroup     bool            `json:"is_group"`
+		Content     string          `json:"content"`
+		ReplyTo     int             `json:"reply_to"`
+		Attachments []AttachmentRef `json:"attachments"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	target := Message{ToUser: strings.TrimSpace(reqData.To), IsGroup: reqData.IsGroup, ReplyTo: reqData.ReplyTo, ClientIP: clientIP(r)}
+	if target.IsGroup {
+		target.GroupUsers = strings.Split(target.ToUser, ",")
+		if !containsUser(target.GroupUsers, username) {
+			http.Error(w, "you are not a member of this group", http.StatusForbidden)
+			return
+		}
+	}
+	if handled, err := runSlashCommand(username, target, reqData.Content); handled {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	msg, err := sendStagedMessage(username, target, reqData.Content, reqData.Attachments)
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// adminUser returns the logged-in admin or writes 401/403
+func adminUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	if !isAdmin(username) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+	return username, true
+}
+
+// handleAdmin renders the administration console
+func handleAdmin(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !isAdmin(username) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	webhooks := loadIncomingWebhooks()
+	for i := range webhooks {
+		webhooks[i].TokenHash = ""
+	}
+	quarantineMutex.Lock()
+	quarantine := loadQuarantine()
+	quarantineMutex.Unlock()
+
+	reportsMutex.Lock()
+	reports := []Report{}
+	for _, rep := range loadReports() {
+		if rep.Status == ReportOpen {
+			reports = append(reports, rep)
+		}
+	}
+	reportsMutex.Unlock()
+
+	query := r.URL.Query().Get("q")
+	data := struct {
+		CurrentUser string
+		Query       string
+		Require2FA  bool
+		Stats       InstanceStats
+		Reports     []Report
+		Users       []AdminUser
+		Groups      []GroupInfo
+		Webhooks    []IncomingWebhook
+		Bots        []Bot
+		Quarantine  []QuarantinedFile
+	}{
+		CurrentUser: username,
+		Query:       query,
+		Require2FA:  twoFactorRequired(),
+		Stats:       instanceStats(),
+		Reports:     reports,
+		Users:       listUsers(query),
+		Groups:      listGroups(),
+		Webhooks:    webhooks,
+		Bots:        loadBots(),
+		Quarantine:  quarantine,
+	}
+
+	tmpl := template.Must(template.New("admin.html").Funcs(template.FuncMap{
+		"bytes": formatBytes,
+	}).ParseFiles("templates/admin.html"))
+	tmpl.Execute(w, data)
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminUser(w, r); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(instanceStats())
+}
+
+func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminUser(w, r); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listUsers(r.URL.Query().Get("q")))
+}
+
+// handleAdminUser changes (PATCH {"disabled": bool, "role": "..."}) or
+// deletes an account. Admins cannot lock themselves out.
+func handleAdminUser(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+	username := mux.Vars(r)["username"]
+	user := findUser(username)
+	if user == nil || user.Deleted {
+		http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "PATCH":
+		var reqData struct {
+			Disabled *bool  `json:"disabled"`
+			Role     string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if username == admin && ((reqData.Disabled != nil && *reqData.Disabled) || (reqData.Role != "" && reqData.Role != RoleAdmin)) {
+			http.Error(w, "you cannot disable or demote yourself", http.StatusBadRequest)
+			return
+		}
+
+		if reqData.Disabled != nil && *reqData.Disabled != user.Disabled {
+			if err := setUserDisabled(username, *reqData.Disabled); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			action := LogAdminEnableUser
+			if *reqData.Disabled {
+				action = LogAdminDisableUser
+			}
+			logAdminAction(r, admin, action, username, "", "")
+		}
+		if reqData.Role != "" && reqData.Role != user.Role {
+			if err := setUserRole(username, reqData.Role); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logAdminAction(r, admin, LogAdminSetRole, username, user.Role, reqData.Role)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		if username == admin {
+			http.Error(w, "you cannot delete yourself", http.StatusBadRequest)
+			return
+		}
+		if err := deleteUserAccount(username); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logAdminAction(r, admin, LogAdminDeleteUser, username, "", "")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAdminResetPassword sets a temporary password and returns it once
+func handleAdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+	username := mux.Vars(r)["username"]
+	password, err := resetUserPassword(username)
+	if err == ErrUserNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logAdminAction(r, admin, LogAdminResetPassword, username, "", "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"password": password})
+}
+
+// handleTwoFactorStatus reports whether 2FA is enabled for the user
+func handleTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user := findUser(username)
+	if user == nil {
+		http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":             user.TOTPEnabled,
+		"required":            twoFactorRequired(),
+		"recovery_codes_left": len(user.RecoveryCodes),
+	})
+}
+
+// handleTwoFactor manages 2FA: setup, confirm, disable and recovery
+// (new recovery codes). All but setup take {"code"}.
+func handleTwoFactor(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var reqData struct {
+		Code string `json:"code"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var result interface{}
+	var err error
+	switch mux.Vars(r)["action"] {
+	case "setup":
+		var secret, uri string
+		secret, uri, err = beginTwoFactorSetup(username)
+		result = map[string]string{"secret": secret, "uri": uri}
+	case "confirm":
+		var codes []string
+		codes, err = confirmTwoFactor(username, reqData.Code)
+		result = map[string][]string{"recovery_codes": codes}
+	case "disable":
+		err = disableTwoFactor(username, reqData.Code)
+		result = map[string]bool{"enabled": false}
+	case "recovery":
+		var codes []string
+		codes, err = regenerateRecoveryCodes(username, reqData.Code)
+		result = map[string][]string{"recovery_codes": codes}
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case err == ErrInvalidCode:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err == ErrTwoFactorRequired:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleAdminSettings shows or changes instance-wide security settings
+func handleAdminSettings(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == "PATCH" {
+		var reqData struct {
+			Require2FA *bool `json:"require_2fa"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if reqData.Require2FA != nil {
+			before := fmt.Sprint(twoFactorRequired())
+			if err := setTwoFactorRequired(*reqData.Require2FA); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logAdminAction(r, admin, LogAdminRequire2FA, "", before, fmt.Sprint(*reqData.Require2FA))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"require_2fa": twoFactorRequired()})
+}
+
+// handleAdminUnlock lifts a lockout caused by failed logins
+func handleAdminUnlock(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+	username := mux.Vars(r)["username"]
+	if err := unlockAccount(username); err != nil {
+		if err == ErrUserNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logAdminAction(r, admin, LogAdminUnlockUser, username, "", "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminUnlockLink creates a link the owner of a locked account signs
+// in with despite the lockout; the admin passes it on
+func handleAdminUnlockLink(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+	username := mux.Vars(r)["username"]
+	if user := findUser(username); user == nil || user.IsBot || user.Deleted {
+		http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	token, err := issueAccountToken(username, TokenUnlock, admin, clientIP(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logAdminAction(r, admin, LogAdminUnlockLink, username, "", "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"link":       unlockLink(resetBaseURL(r), token),
+		"expires_in": config.PasswordReset.TokenTTL * 60,
+	})
+}
+
+// handleUnlockAccount lets the owner lift the lockout from a session that
+// is still signed in
+func handleUnlockAccount(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := unlockAccount(username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSessions lists the user's active sessions; DELETE signs out all
+// sessions except the current one
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	current := currentSessionID(r)
+
+	if r.Method == "DELETE" {
+		n, err := revokeOtherSessions(username, current)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"revoked": n})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionList(username, current))
+}
+
+// handleSession signs out one of the user's sessions and closes its WebSockets
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := revokeSession(username, mux.Vars(r)["id"]); err != nil {
+		if err == ErrSessionNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleAdminGroups(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminUser(w, r); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listGroups())
+}
+
+// handleAdminWebhooks lists all incoming webhooks or deletes one (?id=)
+func handleAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		hooks := loadIncomingWebhooks()
+		for i := range hooks {
+			hooks[i].TokenHash = ""
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hooks)
+
+	case "DELETE":
+		hook := findIncomingWebhook(r.URL.Query().Get("id"))
+		if hook == nil {
+			http.Error(w, "webhook not found", http.StatusNotFound)
+			return
+		}
+		if err := deleteIncomingWebhook(hook.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logAdminAction(r, admin, LogAdminDeleteWebhook, "group:"+groupKey(hook.GroupUsers), hook.Name, "")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAdminBots lists all bots or deletes one (?username=)
+func handleAdminBots(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		bots := loadBots()
+		for i := range bots {
+			bots[i].TokenHash = ""
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bots)
+
+	case "DELETE":
+		name := r.URL.Query().Get("username")
+		bot := findBot(name)
+		if bot == nil {
+			http.Error(w, "bot not found", http.StatusNotFound)
+			return
+		}
+		if err := deleteBot(bot.Owner, bot.Username); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logAdminAction(r, admin, LogAdminDeleteBot, bot.Username, bot.Owner, "")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAdminStorage reports the storage usage of every user and group
+func handleAdminStorage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminUser(w, r); !ok {
+		return
+	}
+
+	users := make(map[string]StorageUsage)
+	for _, u := range loadUsers() {
+		users[u.Username] = userStorageUsage(u.Username)
+	}
+	groups := []GroupStorageUsage{}
+	for _, g := range listGroups() {
+		groups = append(groups, GroupStorageUsage{
+			GroupKey:     g.GroupKey,
+			Users:        g.Users,
+			StorageUsage: groupStorageUsage(g.Users),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":  users,
+		"groups": groups,
+	})
+}
+
+func handleAdminQuarantine(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminUser(w, r); !ok {
+		return
+	}
+	quarantineMutex.Lock()
+	files := loadQuarantine()
+	quarantineMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
+
+// handlePrivacy reads or updates the caller's privacy settings
+func handlePrivacy(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == "POST" {
+		var privacy PrivacySettings
+		if err := json.NewDecoder(r.Body).Decode(&privacy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := updatePrivacy(username, privacy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	user := findUser(username)
+	if user == nil {
+		http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	user.Privacy.DMPolicy = user.Privacy.dmPolicy()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user.Privacy)
+}
+
+// handleBlocks manages the caller's block list: GET lists, POST
+// {"username": "..."} blocks, DELETE ?username= unblocks
+func handleBlocks(w http.ResponseWriter, r *http.Request) {
+	handleUserList(w, r, func(u *User) []string { return u.Blocked }, blockUser, unblockUser)
+}
+
+// handleContacts manages the caller's contacts the same way as handleBlocks
+func handleContacts(w http.ResponseWriter, r *http.Request) {
+	handleUserList(w, r, func(u *User) []string { return u.Contacts }, addContact, removeContact)
+}
+
+func handleUserList(w http.ResponseWriter, r *http.Request, list func(*User) []string, add, remove func(username, other string) error) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case "POST":
+		var reqData struct {
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = add(username, strings.TrimSpace(reqData.Username))
+	case "DELETE":
+		err = remove(username, r.URL.Query().Get("username"))
+	}
+	if err == ErrUserNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user := findUser(username)
+	if user == nil {
+		http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	users := list(user)
+	if users == nil {
+		users = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// handleReports lets users report a message ({"message_id", "reason"}) or
+// a user ({"username", "reason"}) and see their own reports
+func handleReports(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == "POST" {
+		var reqData struct {
+			MessageID int    `json:"message_id"`
+			Username  string `json:"username"`
+			Reason    string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report, err := createReport(username, reqData.MessageID, strings.TrimSpace(reqData.Username), reqData.Reason)
+		if err == ErrMessageNotFound || err == ErrUserNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": report.ID, "status": report.Status})
+		return
+	}
+
+	// Заявителю не показываем снимок и контекст — только ход рассмотрения
+	type ownReport struct {
+		ID           int       `json:"id"`
+		ReportedUser string    `json:"reported_user"`
+		MessageID    int       `json:"message_id,omitempty"`
+		Reason       string    `json:"reason"`
+		Status       string    `json:"status"`
+		CreatedAt    time.Time `json:"created_at"`
+	}
+	reportsMutex.Lock()
+	reports := loadReports()
+	reportsMutex.Unlock()
+	own := []ownReport{}
+	for _, rep := range reports {
+		if rep.Reporter == username {
+			own = append(own, ownReport{rep.ID, rep.ReportedUser, rep.MessageID, rep.Reason, rep.Status, rep.CreatedAt})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(own)
+}
+
+// handleAdminReports is the moderation queue (?status=open by default)
+func handleAdminReports(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminUser(w, r); !ok {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = ReportOpen
+	}
+
+	reportsMutex.Lock()
+	reports := loadReports()
+	reportsMutex.Unlock()
+	queue := []Report{}
+	for _, rep := range reports {
+		if status == "all" || rep.Status == status {
+			queue = append(queue, rep)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(queue)
+}
+
+// handleAdminReport resolves a report:
+// {"action": "dismiss|delete_message|warn|suspend|ban", "duration_hours": 24, "note": "..."}
+func handleAdminReport(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid report id", http.StatusBadRequest)
+		return
+	}
+
+	var reqData struct {
+		Action        string `json:"action"`
+		DurationHours int    `json:"duration_hours"`
+		Note          string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := resolveReport(id, admin, clientIP(r), reqData.Action,
+		time.Duration(reqData.DurationHours)*time.Hour, strings.TrimSpace(reqData.Note))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleAdminResetLink creates a password reset link for the admin to pass
+// on to the user; it replaces links issued before
+func handleAdminResetLink(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+	username := mux.Vars(r)["username"]
+	if user := findUser(username); user == nil || user.IsBot || user.Deleted {
+		http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	token, err := issueResetToken(username, admin, clientIP(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logAdminAction(r, admin, LogAdminResetLink, username, "", "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"link":       resetLink(resetBaseURL(r), token),
+		"expires_in": config.PasswordReset.TokenTTL * 60,
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HookPhase is a point in the message pipeline where hooks run
+type HookPhase string
+
+const (
+	// PhasePreValidate runs before the built-in validation; Content is
+	// still the Markdown the sender wrote
+	PhasePreValidate HookPhase = "pre_validate"
+	// PhaseTransform runs after validation; Content is already rendered HTML
+	PhaseTransform HookPhase = "transform_content"
+	// PhasePostPersist runs after the message is saved; it cannot reject
+	PhasePostPersist HookPhase = "post_persist"
+	// PhasePreDeliver runs before live delivery to WebSocket clients;
+	// changes only affect the delivered copy
+	PhasePreDeliver HookPhase = "pre_deliver"
+)
+
+const defaultHookTimeout = 2 * time.Second
+
+// HookFunc may modify msg in place, annotate it or reject it with RejectMessage.
+// Any other error is logged and the hook's changes are discarded.
+type HookFunc func(ctx context.Context, msg *Message) error
+
+// MessageHook is a registered extension of the message pipeline
+type MessageHook struct {
+	Name    string
+	Phase   HookPhase
+	Order   int // хуки с меньшим Order выполняются раньше
+	Timeout time.Duration
+	Fn      HookFunc
+}
+
+// HookRejection is returned by a hook that refuses a message
+type HookRejection struct {
+	Hook   string
+	Reason string
+}
+
+func (e *HookRejection) Error() string {
+	return fmt.Sprintf("message rejected by %s: %s", e.Hook, e.Reason)
+}
+
+// RejectMessage is returned from a HookFunc to refuse the message
+func RejectMessage(reason string) error {
+	return &HookRejection{Reason: reason}
+}
+
+// HookRegistry keeps hooks per phase, sorted by order
+type HookRegistry struct {
+	hooks map[HookPhase][]MessageHook
+	mutex sync.RWMutex
+}
+
+var messageHooks = NewHookRegistry()
+
+// NewHookRegistry creates an empty hook registry
+func NewHookRegistry() *HookRegistry {
+	return &HookRegistry{hooks: make(map[HookPhase][]MessageHook)}
+}
+
+// Register adds a hook, replacing a hook with the same name
+func (r *HookRegistry) Register(hook MessageHook) error {
+	if hook.Name == "" || hook.Fn == nil {
+		return errors.New("hook needs a name and a function")
+	}
+	switch hook.Phase {
+	case PhasePreValidate, PhaseTransform, PhasePostPersist, PhasePreDeliver:
+	default:
+		return fmt.Errorf("unknown hook phase %q", hook.Phase)
+	}
+	if hook.Timeout <= 0 {
+		hook.Timeout = defaultHookTimeout
+	}
+
+	r.Unregister(hook.Name)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	hooks := append(r.hooks[hook.Phase], hook)
+	sort.SliceStable(hooks, func(i, j int) bool { return hooks[i].Order < hooks[j].Order })
+	r.hooks[hook.Phase] = hooks
+	return nil
+}
+
+// Unregister removes the hook with the given name from every phase
+func (r *HookRegistry) Unregister(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for phase, hooks := range r.hooks {
+		for i := range hooks {
+			if hooks[i].Name == name {
+				r.hooks[phase] = append(hooks[:i:i], hooks[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Run executes the phase's hooks in order. Each hook works on its own
+// copy of the message, which is adopted only if the hook succeeds, so a
+// hook that fails, panics or times out leaves the message untouched.
+// A rejection stops the chain, except in PhasePostPersist.
+func (r *HookRegistry) Run(ctx context.Context, phase HookPhase, msg *Message) error {
+	r.mutex.RLock()
+	hooks := append([]MessageHook(nil), r.hooks[phase]...)
+	r.mutex.RUnlock()
+
+	for _, hook := range hooks {
+		result, err := runHook(ctx, hook, *msg)
+		var rejection *HookRejection
+		switch {
+		case err == nil:
+			*msg = result
+		case errors.As(err, &rejection):
+			rejection.Hook = hook.Name
+			if phase == PhasePostPersist {
+				log.Printf("Hook %s cannot reject in %s, ignored: %s", hook.Name, phase, rejection.Reason)
+				continue
+			}
+			return rejection
+		default:
+			log.Printf("Hook %s (%s) failed: %v", hook.Name, phase, err)
+		}
+	}
+	return nil
+}
+
+func runHook(ctx context.Context, hook MessageHook, msg Message) (Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, hook.Timeout)
+	defer cancel()
+
+	working := cloneMessage(msg)
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("panic: %v", p)
+			}
+		}()
+		done <- hook.Fn(ctx, &working)
+	}()
+
+	select {
+	case err := <-done:
+		return working, err
+	case <-ctx.Done():
+		return msg, fmt.Errorf("timed out after %s", hook.Timeout)
+	}
+}
+
+// cloneMessage copies msg deep enough that a hook running on the copy
+// (possibly after a timeout) cannot change the original
+func cloneMessage(msg Message) Message {
+	msg.GroupUsers = append([]string(nil), msg.GroupUsers...)
+	msg.Mentions = append([]string(nil), msg.Mentions...)
+	msg.Reactions = append([]MessageReaction(nil), msg.Reactions...)
+	if msg.Attachments != nil {
+		attachments := make([]Attachment, len(msg.Attachments))
+		for i, att := range msg.Attachments {
+			att.Thumbnails = append([]Thumbnail(nil), att.Thumbnails...)
+			attachments[i] = att
+		}
+		msg.Attachments = attachments
+	}
+	if msg.Annotations != nil {
+		annotations := make(map[string]string, len(msg.Annotations))
+		for k, v := range msg.Annotations {
+			annotations[k] = v
+		}
+		msg.Annotations = annotations
+	}
+	return msg
+}
+
+// Annotate attaches a hook-provided key/value to the message
+func (m *Message) Annotate(key, value string) {
+	if m.Annotations == nil {
+		m.Annotations = make(map[string]string)
+	}
+	m.Annotations[key] = value
+}
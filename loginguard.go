@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// LoginConfig holds the brute-force protection settings
+type LoginConfig struct {
+	DelayAfter     int `json:"delay_after"`      // неудачных попыток до появления задержки
+	MaxDelay       int `json:"max_delay"`        // seconds
+	LockoutAfter   int `json:"lockout_after"`    // неудачных попыток до блокировки аккаунта
+	IPLockoutAfter int `json:"ip_lockout_after"` // неудачных попыток с одного IP до его блокировки
+	LockoutMinutes int `json:"lockout_minutes"`
+	HistorySize    int `json:"history_size"` // записей истории входов на пользователя
+}
+
+// LoginRecord is an entry of a user's login history
+type LoginRecord struct {
+	Username  string    `json:"username"`
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason,omitempty"` // причина неудачи
+}
+
+// Audit actions of an admin lifting a lockout or creating an unlock link
+const (
+	LogAdminUnlockUser = "admin_unlock_user"
+	LogAdminUnlockLink = "admin_unlock_link"
+)
+
+// loginFailures counts failed attempts from one IP address; accounts keep
+// their counters in User so a restart does not lift a lockout
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+var (
+	loginHistoryFile  = "data/login_history.json"
+	loginHistoryMutex sync.Mutex
+
+	ipFailures      = make(map[string]*loginFailures)
+	ipFailuresMutex sync.Mutex
+)
+
+func defaultLoginConfig() LoginConfig {
+	return LoginConfig{
+		DelayAfter:     3,
+		MaxDelay:       60,
+		LockoutAfter:   10,
+		IPLockoutAfter: 50,
+		LockoutMinutes: 15,
+		HistorySize:    50,
+	}
+}
+
+// failureWindow is how long failed attempts are remembered
+func failureWindow() time.Duration {
+	return time.Duration(config.Login.LockoutMinutes) * time.Minute
+}
+
+// loginDelay is the pause required after the given number of failures:
+// 1s after DelayAfter failures, doubling with every further one
+func loginDelay(failures int) time.Duration {
+	if failures < config.Login.DelayAfter {
+		return 0
+	}
+	seconds := math.Min(math.Pow(2, float64(failures-config.Login.DelayAfter)), float64(config.Login.MaxDelay))
+	return time.Duration(seconds) * time.Second
+}
+
+// loginWait returns how long a login from ip to user must wait; zero means
+// the password may be checked. locked tells a lockout from a delay.
+func loginWait(user *User, ip string) (wait time.Duration, locked bool) {
+	return waitBeforeLogin(user, ip, true)
+}
+
+// lockoutBypassWait is loginWait without the lockout of the account, for
+// logins that prove more than the password: an unlock link or a second
+// factor. Otherwise anyone could keep the owner out with wrong passwords.
+// The lockout of the IP address and the delays still apply.
+func lockoutBypassWait(user *User, ip string) (wait time.Duration, locked bool) {
+	return waitBeforeLogin(user, ip, false)
+}
+
+// passwordLoginWait is the wait before a login with a password, on every
+// login path. Users with 2FA are not held by the lockout of their account:
+// the password alone does not sign them in.
+func passwordLoginWait(user *User, ip string) (wait time.Duration, locked bool) {
+	if user != nil && user.TOTPEnabled && user.isLocked() {
+		return lockoutBypassWait(user, ip)
+	}
+	return loginWait(user, ip)
+}
+
+// confirmIdentity asks a signed-in user for more than the session before a
+// change that could take the account over: a code from the authenticator
+// with 2FA, the password otherwise. Failures count as failed logins.
+func confirmIdentity(r *http.Request, user *User, password, code string) error {
+	if wait, _ := passwordLoginWait(user, clientIP(r)); wait > 0 {
+		return errors.New("too many failed attempts, try again later")
+	}
+	if user.TOTPEnabled {
+		if err := checkSecondFactor(user.Username, code); err != nil {
+			recordLoginFailure(r, user.Username, user, "invalid two-factor code")
+			return err
+		}
+		return nil
+	}
+	if !validateUser(user.Username, password) {
+		recordLoginFailure(r, user.Username, user, "invalid password")
+		return errors.New("current password is incorrect")
+	}
+	return nil
+}
+
+func waitBeforeLogin(user *User, ip string, accountLockout bool) (wait time.Duration, locked bool) {
+	now := time.Now()
+
+	ipFailuresMutex.Lock()
+	if f, ok := ipFailures[ip]; ok {
+		if now.Before(f.lockedUntil) {
+			ipFailuresMutex.Unlock()
+			return f.lockedUntil.Sub(now), true
+		}
+		if now.Sub(f.last) < failureWindow() {
+			wait = time.Until(f.last.Add(loginDelay(f.count)))
+		}
+	}
+	ipFailuresMutex.Unlock()
+
+	if user == nil {
+		return wait, false
+	}
+	if accountLockout && user.isLocked() {
+		return user.LockedUntil.Sub(now), true
+	}
+	if now.Sub(user.LastFailedLogin) < failureWindow() {
+		if w := time.Until(user.LastFailedLogin.Add(loginDelay(user.FailedLogins))); w > wait {
+			wait = w
+		}
+	}
+	return wait, false
+}
+
+// isLocked reports whether failed logins have locked the account
+func (u *User) isLocked() bool {
+	return time.Now().Before(u.LockedUntil)
+}
+
+// recordLoginFailure counts a failed attempt against the IP and, if the
+// account exists, against the account. Reaching the limits locks them out.
+func recordLoginFailure(r *http.Request, username string, user *User, reason string) {
+	ip := clientIP(r)
+	now := time.Now()
+
+	ipFailuresMutex.Lock()
+	f, ok := ipFailures[ip]
+	if !ok || now.Sub(f.last) >= failureWindow() {
+		f = &loginFailures{}
+		ipFailures[ip] = f
+	}
+	f.count++
+	f.last = now
+	if config.Login.IPLockoutAfter > 0 && f.count >= config.Login.IPLockoutAfter {
+		f.lockedUntil = now.Add(failureWindow())
+	}
+	ipFailuresMutex.Unlock()
+
+	if user == nil {
+		return
+	}
+	addLoginRecord(LoginRecord{Username: username, IP: ip, UserAgent: r.UserAgent(), Reason: reason})
+
+	var failures int
+	var locked bool
+	updateUser(username, func(u *User) {
+		if now.Sub(u.LastFailedLogin) >= failureWindow() {
+			u.FailedLogins = 0
+		}
+		u.FailedLogins++
+		u.LastFailedLogin = now
+		if config.Login.LockoutAfter > 0 && u.FailedLogins >= config.Login.LockoutAfter && !u.isLocked() {
+			u.LockedUntil = now.Add(failureWindow())
+			locked = true
+		}
+		failures = u.FailedLogins
+	})
+
+	switch {
+	case locked:
+		notificationService.AddWithPriority(username, "security_account_locked",
+			fmt.Sprintf("Your account was locked until %s after %d failed login attempts (last from %s). "+
+				"To sign in before then, use the unlock link sent to your email or ask an admin for one; a session that is still signed in can unlock it on the profile page.",
+				now.Add(failureWindow()).Format("2006-01-02 15:04"), failures, ip), PriorityHigh)
+		// Владелец не может войти, поэтому ссылка для разблокировки идёт вне приложения
+		go requestAccountUnlock(username, ip)
+	case failures == config.Login.DelayAfter:
+		notificationService.AddWithPriority(username, "security_failed_logins",
+			fmt.Sprintf("%d failed login attempts to your account (last from %s)", failures, ip), PriorityHigh)
+	}
+}
+
+// recordLoginSuccess resets the failure counter and warns the owner about
+// logins from an address the account has not been used from before
+func recordLoginSuccess(r *http.Request, username string) {
+	ip := clientIP(r)
+	known, first := false, true
+	for _, rec := range loginHistory(username) {
+		if rec.Success {
+			first = false
+			if rec.IP == ip {
+				known = true
+			}
+		}
+	}
+	addLoginRecord(LoginRecord{Username: username, IP: ip, UserAgent: r.UserAgent(), Success: true})
+	updateUser(username, func(u *User) {
+		u.FailedLogins = 0
+	})
+	if !known && !first {
+		notificationService.AddWithPriority(username, "security_new_login",
+			fmt.Sprintf("New login to your account from %s (%s)", ip, r.UserAgent()), PriorityHigh)
+	}
+}
+
+// requestAccountUnlock sends the owner of a locked account an unlock link
+// through the password reset channel
+func requestAccountUnlock(username, ip string) {
+	user := findUser(username)
+	if user == nil || user.IsBot || user.Disabled {
+		return
+	}
+	if err := resetChannel.RequestUnlock(user, ip); err != nil {
+		log.Printf("Unlock link for %s failed: %v", username, err)
+	}
+}
+
+// unlockAccount lifts a lockout and forgets the failed attempts
+func unlockAccount(username string) error {
+	return updateUser(username, func(u *User) {
+		u.LockedUntil = time.Time{}
+		u.FailedLogins = 0
+	})
+}
+
+func loadLoginHistory() []LoginRecord {
+	data, err := os.ReadFile(loginHistoryFile)
+	if err != nil {
+		return []LoginRecord{}
+	}
+
+	var records []LoginRecord
+	json.Unmarshal(data, &records)
+	return records
+}
+
+func saveLoginHistory(records []LoginRecord) error {
+	data, err := json.MarshalIndent(records, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(loginHistoryFile, data, 0600)
+}
+
+// addLoginRecord appends to the history, keeping the last HistorySize
+// records of the user
+func addLoginRecord(record LoginRecord) {
+	record.Time = time.Now()
+
+	loginHistoryMutex.Lock()
+	defer loginHistoryMutex.Unlock()
+	records := append(loadLoginHistory(), record)
+
+	count := 0
+	for _, rec := range records {
+		if rec.Username == record.Username {
+			count++
+		}
+	}
+	kept := make([]LoginRecord, 0, len(records))
+	for _, rec := range records {
+		// Сначала отбрасываются самые старые записи пользователя
+		if rec.Username == record.Username && count > config.Login.HistorySize {
+			count--
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	saveLoginHistory(kept)
+}
+
+// loginHistory returns the user's logins, newest first
+func loginHistory(username string) []LoginRecord {
+	loginHistoryMutex.Lock()
+	records := loadLoginHistory()
+	loginHistoryMutex.Unlock()
+
+	var result []LoginRecord
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Username == username {
+			result = append(result, records[i])
+		}
+	}
+	return result
+}
+
+// pruneLoginFailures forgets addresses whose failures are outside the window
+func pruneLoginFailures() {
+	ipFailuresMutex.Lock()
+	defer ipFailuresMutex.Unlock()
+	for ip, f := range ipFailures {
+		if time.Since(f.last) >= failureWindow() && time.Now().After(f.lockedUntil) {
+			delete(ipFailures, ip)
+		}
+	}
+}
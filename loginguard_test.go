@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPasswordLoginWaitLetsTwoFactorUsersPastLockout(t *testing.T) {
+	locked := &User{Username: "alice", LockedUntil: time.Now().Add(time.Hour)}
+	if wait, isLocked := passwordLoginWait(locked, "198.51.100.7"); wait <= 0 || !isLocked {
+		t.Fatalf("locked account without 2FA: wait %v, locked %v; want a lockout", wait, isLocked)
+	}
+
+	// С двумя факторами одного пароля мало, поэтому блокировка не мешает войти
+	withTOTP := &User{Username: "bob", TOTPEnabled: true, LockedUntil: time.Now().Add(time.Hour)}
+	if wait, _ := passwordLoginWait(withTOTP, "198.51.100.7"); wait != 0 {
+		t.Fatalf("locked account with 2FA must wait %v, want no wait", wait)
+	}
+}
+
+func TestConfirmIdentityRequiresPassword(t *testing.T) {
+	oldUsers := usersFile
+	usersFile = filepath.Join(t.TempDir(), "users.json")
+	t.Cleanup(func() { usersFile = oldUsers })
+	if err := createUser("alice", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/profile", nil)
+	r.RemoteAddr = "198.51.100.8:1234"
+	if err := confirmIdentity(r, findUser("alice"), "wrong", ""); err == nil {
+		t.Fatal("wrong password confirmed the identity")
+	}
+	if user := findUser("alice"); user.FailedLogins != 1 {
+		t.Fatalf("failed attempts = %d, want the wrong password counted", user.FailedLogins)
+	}
+	if err := confirmIdentity(r, findUser("alice"), "secret123", ""); err != nil {
+		t.Fatalf("correct password = %v", err)
+	}
+}
@@ -11,24 +11,86 @@ import (
 )
 
 var (
-	store    = sessions.NewCookieStore([]byte("secret-key"))
+	store    *sessions.CookieStore // ключ задаёт initSessionKeys
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 		CheckOrigin:     func(r *http.Request) bool { return true },
 	}
-	jwtKey              = []byte("your-secret-key")
+	jwtKey              []byte
 	clients             = make(map[string]*websocket.Conn)
 	clientsMutex        sync.RWMutex
 	notificationService *NotificationService
+	pushService         *PushService
+	blobStore           BlobStore
+	config              Config
 )
 
 func init() {
+	config = loadConfig()
 	notificationService = NewNotificationService()
 }
 
+func hasLiveConnection(username string) bool {
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
+	_, ok := clients[username]
+	return ok
+}
+
+// sendToClient writes v to the user's WebSocket, if the user is connected
+func sendToClient(username string, v interface{}) bool {
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
+	conn, ok := clients[username]
+	if !ok {
+		return false
+	}
+	return conn.WriteJSON(v) == nil
+}
+
 func main() {
+	if err := initSessionKeys(config.Sessions); err != nil {
+		log.Fatalf("Session keys init failed: %v", err)
+	}
+	var err error
+	blobStore, err = NewBlobStore(config.Storage)
+	if err != nil {
+		log.Fatalf("Blob storage init failed: %v", err)
+	}
+	fileScanner, err = NewScanner(config.Scan)
+	if err != nil {
+		log.Fatalf("Malware scanner init failed: %v", err)
+	}
+	resetChannel, err = NewResetChannel(config.PasswordReset)
+	if err != nil {
+		log.Fatalf("Password reset init failed: %v", err)
+	}
+	if err := loadMessageLogs(); err != nil {
+		log.Fatalf("Message log load failed: %v", err)
+	}
+	if err := migrateAttachments(); err != nil {
+		log.Fatalf("Attachment migration failed: %v", err)
+	}
+	startUploadJanitor()
+	startThumbnailWorkers()
+	startRateLimitJanitor()
+	if err := startContentFilter(); err != nil {
+		log.Fatalf("Content filter init failed: %v", err)
+	}
+
+	if config.Push.Enabled {
+		pushService, err = NewPushService(config.Push)
+		if err != nil {
+			log.Fatalf("Web Push init failed: %v", err)
+		}
+		notificationService.SetPushService(pushService)
+	}
+
 	r := mux.NewRouter()
+	r.Use(accountGuard)
+	r.Use(rateLimit)
+	r.Use(requireTwoFactor)
 
 	// Static files
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
@@ -36,7 +98,12 @@ func main() {
 	// Auth routes
 	r.HandleFunc("/register", handleRegister).Methods("GET", "POST")
 	r.HandleFunc("/login", handleLogin).Methods("GET", "POST")
+	r.HandleFunc("/login/2fa", handleLoginTwoFactor).Methods("GET", "POST")
+	r.HandleFunc("/api/token", handleToken).Methods("POST")
 	r.HandleFunc("/logout", handleLogout).Methods("GET")
+	r.HandleFunc("/password/forgot", handleForgotPassword).Methods("GET", "POST")
+	r.HandleFunc("/password/reset", handleResetPassword).Methods("GET", "POST")
+	r.HandleFunc("/login/unlock", handleUnlockLink).Methods("GET", "POST")
 
 	// Message routes
 	r.HandleFunc("/messages", handleMessages).Methods("GET")
@@ -47,6 +114,11 @@ func main() {
 
 	// Profile routes
 	r.HandleFunc("/profile", handleProfile).Methods("GET", "POST")
+	r.HandleFunc("/api/account/unlock", handleUnlockAccount).Methods("POST")
+	r.HandleFunc("/api/sessions", handleSessions).Methods("GET", "DELETE")
+	r.HandleFunc("/api/sessions/{id}", handleSession).Methods("DELETE")
+	r.HandleFunc("/api/2fa", handleTwoFactorStatus).Methods("GET")
+	r.HandleFunc("/api/2fa/{action}", handleTwoFactor).Methods("POST")
 	// Remove undefined handler
 
 	// Enhanced API routes with JWT middleware
@@ -57,11 +129,36 @@ func main() {
 	r.HandleFunc("/api/messages", handleAPI)
 	r.HandleFunc("/api/users/online", handleAPI)
 	r.HandleFunc("/api/messages/delete", handleAPI)
+	r.HandleFunc("/api/messages/read", handleAPI).Methods("POST")
+	r.HandleFunc("/api/history", handleAPI).Methods("GET")
 	r.HandleFunc("/api/messages/edit", handleEditMessage).Methods("POST") // Добавляем маршрут для редактирования
+	r.HandleFunc("/api/mentions", handleMentions).Methods("GET")
+	r.HandleFunc("/api/files/{id}", handleFile).Methods("GET", "HEAD")
+	r.HandleFunc("/api/files/{id}/thumbnails/{size}", handleFile).Methods("GET", "HEAD")
+	r.HandleFunc("/api/messages/upload", handleAPI).Methods("POST")
+	r.HandleFunc("/api/messages/send", handleSendJSON).Methods("POST")
+	r.HandleFunc("/api/attachments", handleAttachments).Methods("GET", "POST", "DELETE")
+	r.HandleFunc("/api/storage/usage", handleStorageUsage).Methods("GET")
+	r.HandleFunc("/api/uploads", handleUploads).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/uploads/{id}", handleUpload).Methods("HEAD", "PATCH", "DELETE")
 	api.HandleFunc("/messages/reply", handleReplyMessage).Methods("POST") // Добавляем маршрут для ответов
 
 	// Notification routes
 	r.HandleFunc("/api/notifications", handleNotifications).Methods("GET", "POST")
+	r.HandleFunc("/api/push/key", handlePushKey).Methods("GET")
+	r.HandleFunc("/api/push/subscribe", handlePushSubscribe).Methods("POST", "DELETE")
+
+	// Slash commands
+	r.HandleFunc("/api/commands", handleCommands).Methods("GET", "POST", "DELETE")
+
+	// Bots
+	r.HandleFunc("/api/bots", handleBots).Methods("GET", "POST", "PUT", "DELETE")
+	r.HandleFunc("/api/bots/{name}/token", handleBotToken).Methods("POST")
+	r.HandleFunc("/bot{token}/{method}", handleBotAPI).Methods("GET", "POST")
+
+	// Incoming webhooks
+	r.HandleFunc("/api/webhooks", handleWebhooks).Methods("GET", "POST", "DELETE")
+	r.HandleFunc("/hooks/{id}/{token}", handleIncomingWebhook).Methods("POST")
 
 	// Добавляем новые API endpoints
 	api.HandleFunc("/messages/search", handleMessageSearch).Methods("GET")
@@ -76,6 +173,32 @@ func main() {
 	// Add message logs endpoint
 	api.HandleFunc("/messages/logs", handleMessageLogs).Methods("GET")
 
+	// Privacy
+	r.HandleFunc("/api/privacy", handlePrivacy).Methods("GET", "POST")
+	r.HandleFunc("/api/blocks", handleBlocks).Methods("GET", "POST", "DELETE")
+	r.HandleFunc("/api/contacts", handleContacts).Methods("GET", "POST", "DELETE")
+
+	// Reports and moderation
+	r.HandleFunc("/api/reports", handleReports).Methods("GET", "POST")
+	r.HandleFunc("/api/admin/reports", handleAdminReports).Methods("GET")
+	r.HandleFunc("/api/admin/reports/{id}", handleAdminReport).Methods("POST")
+
+	// Administration
+	r.HandleFunc("/admin", handleAdmin).Methods("GET")
+	r.HandleFunc("/api/admin/stats", handleAdminStats).Methods("GET")
+	r.HandleFunc("/api/admin/settings", handleAdminSettings).Methods("GET", "PATCH")
+	r.HandleFunc("/api/admin/users", handleAdminUsers).Methods("GET")
+	r.HandleFunc("/api/admin/users/{username}", handleAdminUser).Methods("PATCH", "DELETE")
+	r.HandleFunc("/api/admin/users/{username}/password", handleAdminResetPassword).Methods("POST")
+	r.HandleFunc("/api/admin/users/{username}/unlock", handleAdminUnlock).Methods("POST")
+	r.HandleFunc("/api/admin/users/{username}/reset-link", handleAdminResetLink).Methods("POST")
+	r.HandleFunc("/api/admin/users/{username}/unlock-link", handleAdminUnlockLink).Methods("POST")
+	r.HandleFunc("/api/admin/groups", handleAdminGroups).Methods("GET")
+	r.HandleFunc("/api/admin/webhooks", handleAdminWebhooks).Methods("GET", "DELETE")
+	r.HandleFunc("/api/admin/bots", handleAdminBots).Methods("GET", "DELETE")
+	r.HandleFunc("/api/admin/storage", handleAdminStorage).Methods("GET")
+	r.HandleFunc("/api/admin/quarantine", handleAdminQuarantine).Methods("GET")
+
 	// Home page
 	r.HandleFunc("/", handleHome).Methods("GET")
 
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	mentionHere = "here"
+	mentionAll  = "all"
+)
+
+// @username, перед которым нет буквы/цифры (чтобы не ловить e-mail адреса)
+var mentionPattern = regexp.MustCompile(`(^|[^\p{L}\p{N}_@/])@([\p{L}\p{N}_.\-]+)`)
+
+// mentionSkipTags are the elements whose text is not a mention: links
+// and code. Attribute values are never looked at.
+var mentionSkipTags = map[string]bool{"a": true, "code": true, "pre": true}
+
+// extractMentionNames returns the raw names written after "@" in the text
+// of the HTML content
+func extractMentionNames(content string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	mapHTMLText(content, mentionSkipTags, func(text string) string {
+		for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+			name := strings.TrimRight(m[2], ".-")
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		return text
+	})
+	return names
+}
+
+// resolveMentions validates the mentioned names against existing users and
+// the conversation participants. @here expands to the online group members,
+// @all to every group member; both are only valid in group messages.
+func resolveMentions(msg Message) []string {
+	var participants []string
+	if msg.IsGroup {
+		participants = msg.GroupUsers
+	} else {
+		participants = []string{msg.ToUser}
+	}
+
+	resolved := make(map[string]bool)
+	for _, name := range extractMentionNames(msg.Content) {
+		switch {
+		case msg.IsGroup && name == mentionAll:
+			for _, u := range participants {
+				resolved[u] = true
+			}
+		case msg.IsGroup && name == mentionHere:
+			for _, u := range participants {
+				if hasLiveConnection(u) {
+					resolved[u] = true
+				}
+			}
+		case containsUser(participants, name) && findUser(name) != nil:
+			resolved[name] = true
+		}
+	}
+	delete(resolved, msg.FromUser)
+
+	mentions := make([]string, 0, len(resolved))
+	for u := range resolved {
+		mentions = append(mentions, u)
+	}
+	sort.Strings(mentions)
+	return mentions
+}
+
+// renderMentions turns valid mentions in the text of the HTML content into
+// profile links
+func renderMentions(msg Message) string {
+	return mapHTMLText(msg.Content, mentionSkipTags, func(text string) string {
+		return renderMentionsInText(msg, text)
+	})
+}
+
+func renderMentionsInText(msg Message, text string) string {
+	return mentionPattern.ReplaceAllStringFunc(text, func(match string) string {
+		m := mentionPattern.FindStringSubmatch(match)
+		prefix, name := m[1], strings.TrimRight(m[2], ".-")
+		rest := strings.TrimPrefix(m[2], name)
+
+		switch {
+		case msg.IsGroup && (name == mentionAll || name == mentionHere):
+			return fmt.Sprintf(`%s<span class="mention mention-%s">@%s</span>%s`, prefix, name, name, rest)
+		case containsUser(msg.Mentions, name):
+			return fmt.Sprintf(`%s<a href="/profile?user=%s" class="mention">@%s</a>%s`,
+				prefix, html.EscapeString(name), html.EscapeString(name), rest)
+		}
+		return match
+	})
+}
+
+// applyMentions fills msg.Mentions and links the mentions in the content
+func applyMentions(msg *Message) {
+	msg.Mentions = resolveMentions(*msg)
+	if len(msg.Mentions) > 0 {
+		msg.Content = renderMentions(*msg)
+	}
+}
+
+// notifyMentions sends a high-priority notification to every mentioned user
+func notifyMentions(msg Message) {
+	for _, u := range msg.Mentions {
+		conversation := conversationKey(msg, u)
+		notificationService.Notify(Notification{
+			UserID:       u,
+			Type:         "mention",
+			Message:      fmt.Sprintf("%s mentioned you", msg.FromUser),
+			Priority:     PriorityHigh,
+			CollapseKey:  "mention:" + conversation,
+			Conversation: conversation,
+			Preview:      notificationPreview(msg.Content),
+		})
+	}
+}
+
+// getMentions returns the messages mentioning username, newest first
+func getMentions(username string) []Message {
+	messages := loadMessages()
+	var mentions []Message
+	for i := len(messages) - 1; i >= 0; i-- {
+		if containsUser(messages[i].Mentions, username) {
+			mentions = append(mentions, messages[i])
+		}
+	}
+	return mentions
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -24,13 +26,38 @@ type UserSettings struct {
 }
 
 type User struct {
-	ID       int          `json:"id"`
-	Username string       `json:"username"`
-	Password string       `json:"password"`
-	LastSeen time.Time    `json:"last_seen"`
-	IsOnline bool         `json:"is_online"`
-	Avatar   string       `json:"avatar"` // Base64 encoded image
-	Settings UserSettings `json:"settings"`
+	ID          int             `json:"id"`
+	Username    string          `json:"username"`
+	Password    string          `json:"password"`
+	LastSeen    time.Time       `json:"last_seen"`
+	IsOnline    bool            `json:"is_online"`
+	Avatar      string          `json:"avatar"` // Base64 encoded image
+	DisplayName string          `json:"display_name,omitempty"`
+	Bio         string          `json:"bio,omitempty"`
+	Settings    UserSettings    `json:"settings"`
+	IsBot       bool            `json:"is_bot,omitempty"`
+	BotOwner    string          `json:"bot_owner,omitempty"`
+	Role        string          `json:"role,omitempty"`     // user или admin
+	Disabled    bool            `json:"disabled,omitempty"` // заблокирован администратором
+	Deleted     bool            `json:"deleted,omitempty"`  // учётная запись удалена, имя остаётся занятым
+	Privacy     PrivacySettings `json:"privacy"`
+	Blocked     []string        `json:"blocked,omitempty"`  // пользователи, заблокированные этим пользователем
+	Contacts    []string        `json:"contacts,omitempty"` // для dm_policy "contacts"
+	// Временная блокировка модератором; Disabled — бессрочная
+	SuspendedUntil time.Time `json:"suspended_until,omitempty"`
+	// Неудачные попытки входа и блокировка после их превышения
+	FailedLogins    int       `json:"failed_logins,omitempty"`
+	LastFailedLogin time.Time `json:"last_failed_login,omitempty"`
+	LockedUntil     time.Time `json:"locked_until,omitempty"`
+	// Двухфакторная аутентификация (TOTP); коды восстановления хранятся хешами
+	TOTPEnabled   bool     `json:"totp_enabled,omitempty"`
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPPending   string   `json:"totp_pending,omitempty"` // секрет до подтверждения
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	// Адрес для сброса пароля; сессии и токены старше PasswordChangedAt недействительны
+	Email             string    `json:"email,omitempty"`
+	PasswordChangedAt time.Time `json:"password_changed_at,omitempty"`
 }
 
 type MessageReaction struct {
@@ -40,21 +67,31 @@ type MessageReaction struct {
 }
 
 type Message struct {
-	ID         int               `json:"id"`
-	FromUser   string            `json:"from_user"`
-	ToUser     string            `json:"to_user"`
-	Content    string            `json:"content"`
-	CreatedAt  time.Time         `json:"created_at"`
-	IsRead     bool              `json:"is_read"`
-	IsGroup    bool              `json:"is_group"`
-	GroupUsers []string          `json:"group_users,omitempty"`
-	HasFile    bool              `json:"has_file"`
-	FileName   string            `json:"file_name,omitempty"`
-	FileData   string            `json:"file_data,omitempty"` // Base64 encoded file
-	IsEdited   bool              `json:"is_edited"`
-	EditedAt   time.Time         `json:"edited_at,omitempty"`
-	ReplyTo    int               `json:"reply_to,omitempty"`
-	Reactions  []MessageReaction `json:"reactions,omitempty"`
+	ID          int               `json:"id"`
+	FromUser    string            `json:"from_user"`
+	ToUser      string            `json:"to_user"`
+	Content     string            `json:"content"`
+	CreatedAt   time.Time         `json:"created_at"`
+	IsRead      bool              `json:"is_read"`
+	IsGroup     bool              `json:"is_group"`
+	GroupUsers  []string          `json:"group_users,omitempty"`
+	HasFile     bool              `json:"has_file"`
+	FileName    string            `json:"file_name,omitempty"`
+	FileData    string            `json:"file_data,omitempty"`  // устаревшее: base64, переносится в хранилище при запуске
+	Attachment  *Attachment       `json:"attachment,omitempty"` // устаревшее: одно вложение, переносится в Attachments при запуске
+	Attachments []Attachment      `json:"attachments,omitempty"`
+	IsEdited    bool              `json:"is_edited"`
+	EditedAt    time.Time         `json:"edited_at,omitempty"`
+	ReplyTo     int               `json:"reply_to,omitempty"`
+	Reactions   []MessageReaction `json:"reactions,omitempty"`
+	Mentions    []string          `json:"mentions,omitempty"`
+	Webhook     string            `json:"webhook,omitempty"`     // ID входящего вебхука-отправителя
+	SenderName  string            `json:"sender_name,omitempty"` // подпись отправителя из вебхука, только для показа
+	Command     string            `json:"command,omitempty"`     // slash-команда, результатом которой является сообщение
+	FromBot     bool              `json:"from_bot,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"` // метки, добавленные хуками
+	Ephemeral   bool              `json:"ephemeral,omitempty"`   // виден только автору команды, не сохраняется
+	ClientIP    string            `json:"-"`                     // адрес отправителя для журнала, не сохраняется
 }
 
 type Group struct {
@@ -72,8 +109,6 @@ type UserStatus struct {
 
 type UserProfile struct {
 	User
-	Bio          string    `json:"bio"`
-	DisplayName  string    `json:"display_name"`
 	ProfileImage string    `json:"profile_image"`
 	JoinedAt     time.Time `json:"joined_at"`
 }
@@ -83,14 +118,6 @@ type Claims struct {
 	jwt.StandardClaims
 }
 
-type MessageLog struct {
-	MessageID int       `json:"message_id"`
-	Action    string    `json:"action"` // create, edit, delete, react
-	UserID    string    `json:"user_id"`
-	Timestamp time.Time `json:"timestamp"`
-	Details   string    `json:"details"`
-}
-
 var (
 	userMutex    sync.RWMutex
 	messageMutex sync.RWMutex
@@ -105,6 +132,14 @@ var (
 	cacheExpiry  = 5 * time.Minute
 	messageLogs  = make([]MessageLog, 0)
 	logMutex     sync.RWMutex
+
+	// messagesUpdateMutex держится на всё чтение-изменение-запись (см. updateMessages)
+	messagesUpdateMutex sync.Mutex
+)
+
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrNotGroupMember  = errors.New("you are not a member of this group")
 )
 
 func init() {
@@ -170,10 +205,30 @@ func saveMessages(messages []Message) error {
 	return os.WriteFile(messagesFile, data, 0644)
 }
 
+// updateMessages loads the messages, applies fn and saves the result while
+// holding messagesUpdateMutex, so concurrent updates do not overwrite each
+// other. Nothing is saved if fn returns an error or a nil slice.
+func updateMessages(fn func(messages []Message) ([]Message, error)) error {
+	messagesUpdateMutex.Lock()
+	defer messagesUpdateMutex.Unlock()
+
+	messages, err := fn(loadMessages())
+	if err != nil || messages == nil {
+		return err
+	}
+	return saveMessages(messages)
+}
+
 func createUser(username, password string) error {
 	// Validate input
-	if len(username) < 3 || len(password) < 6 {
-		return errors.New("username must be at least 3 characters and password at least 6 characters")
+	if len(username) < 3 {
+		return errors.New("username must be at least 3 characters")
+	}
+	if strings.HasPrefix(strings.TrimSpace(username), webhookSenderPrefix) {
+		return ErrReservedUsername
+	}
+	if err := validatePassword(password, username); err != nil {
+		return err
 	}
 
 	// Hash password
@@ -184,7 +239,7 @@ func createUser(username, password string) error {
 
 	users := loadUsers()
 	newUser := User{
-		ID:       len(users) + 1,
+		ID:       nextUserID(users),
 		Username: strings.TrimSpace(username),
 		Password: string(hashedPassword),
 	}
@@ -216,13 +271,26 @@ func updateUserSettings(username string, settings UserSettings) error {
 
 func validateUser(username, password string) bool {
 	user := findUser(username)
-	if user == nil {
+	if user == nil || user.IsBot || user.Disabled {
 		return false
 	}
 	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	return err == nil
 }
 
+// nextUserID returns an ID above every existing one, deleted accounts included
+func nextUserID(users []User) int {
+	id := 0
+	for _, u := range users {
+		if u.ID > id {
+			id = u.ID
+		}
+	}
+	return id + 1
+}
+
+// findUser returns the user with this name. Deleted accounts are returned
+// too, so their names stay taken; check Deleted where it matters.
 func findUser(username string) *User {
 	users := loadUsers()
 	for _, u := range users {
@@ -233,25 +301,131 @@ func findUser(username string) *User {
 	return nil
 }
 
-func createMessage(from, to, content string) error {
-	// Validate input
-	if len(content) == 0 {
+func createMessage(from, to, content, ip string) error {
+	return appendMessage(&Message{
+		FromUser:  from,
+		ToUser:    to,
+		Content:   strings.TrimSpace(content),
+		CreatedAt: time.Now(),
+		ClientIP:  ip,
+	})
+}
+
+func nextMessageID(messages []Message) int {
+	maxID := 0
+	for _, msg := range messages {
+		if msg.ID > maxID {
+			maxID = msg.ID
+		}
+	}
+	return maxID + 1
+}
+
+// validateMessage performs the built-in checks every new message must pass
+func validateMessage(msg Message) error {
+	if len(strings.TrimSpace(msg.Content)) == 0 && !msg.HasFile {
 		return errors.New("message content cannot be empty")
 	}
-	if findUser(to) == nil {
+	if msg.IsGroup {
+		if len(msg.GroupUsers) < 2 {
+			return errors.New("group must have at least 2 recipients")
+		}
+		// Писать в группу могут только её участники; вебхук и бот пишут
+		// по своим собственным правам
+		switch {
+		case msg.Webhook != "":
+		case isBotUser(msg.FromUser):
+			if bot := findBot(msg.FromUser); bot == nil || !bot.canPost(msg) {
+				return errors.New("bot is not allowed to post in this conversation")
+			}
+		case !containsUser(msg.GroupUsers, msg.FromUser):
+			return ErrNotGroupMember
+		}
+		// Создание группы — это добавление в неё участников
+		if !groupExists(msg.GroupUsers) {
+			return canAddToGroup(msg.FromUser, msg.GroupUsers)
+		}
+		return nil
+	}
+	to := findUser(msg.ToUser)
+	if to == nil || to.Deleted {
 		return errors.New("recipient user does not exist")
 	}
+	return canDirectMessage(msg.FromUser, to)
+}
 
-	messages := loadMessages()
-	newMessage := Message{
-		ID:        len(messages) + 1,
-		FromUser:  from,
-		ToUser:    to,
-		Content:   strings.TrimSpace(content),
-		CreatedAt: time.Now(),
+// appendMessage runs msg through the pipeline: pre-validate hooks on the
+// raw Markdown, validation, formatting to HTML, transform hooks, mentions,
+// persisting (with the next free ID), post-persist hooks and notifications.
+// Live delivery is up to the caller.
+func appendMessage(msg *Message) error {
+	ctx := context.Background()
+	if err := messageHooks.Run(ctx, PhasePreValidate, msg); err != nil {
+		return err
+	}
+	if err := validateMessage(*msg); err != nil {
+		return err
+	}
+	msg.Content = processMessageContent(msg.Content)
+	// Фильтр вызывается напрямую, а не хуком: его сбой отклоняет сообщение
+	flagged, err := filterMessage(msg)
+	if err != nil {
+		return err
+	}
+	if err := messageHooks.Run(ctx, PhaseTransform, msg); err != nil {
+		return err
+	}
+
+	// Значок бота выставляется только сервером, клиенту не доверяем
+	msg.FromBot = msg.Webhook == "" && isBotUser(msg.FromUser)
+	applyMentions(msg)
+
+	// Первое сообщение группы создаёт её: состав записывается в журнал
+	newGroup := msg.IsGroup
+	if err := updateMessages(func(messages []Message) ([]Message, error) {
+		if msg.IsGroup {
+			key := groupKey(msg.GroupUsers)
+			for _, m := range messages {
+				if m.IsGroup && groupKey(m.GroupUsers) == key {
+					newGroup = false
+					break
+				}
+			}
+		}
+		msg.ID = nextMessageID(messages)
+		return append(messages, *msg), nil
+	}); err != nil {
+		return err
+	}
+	if newGroup {
+		logMessageAction(LogMembers, Message{IsGroup: true, GroupUsers: msg.GroupUsers}, msg.FromUser, msg.ClientIP,
+			"", strings.Join(msg.GroupUsers, ","))
+	}
+	logMessageAction(LogCreate, *msg, msg.FromUser, msg.ClientIP, "", msg.Content)
+	if len(flagged) > 0 {
+		flagMessage(*msg, flagged)
+	}
+
+	messageHooks.Run(ctx, PhasePostPersist, msg)
+
+	notifyMentions(*msg)
+	notifyNewMessage(*msg)
+	dispatchBotUpdates(*msg)
+	return nil
+}
+
+// deliverMessage pushes a saved message to the live WebSocket connections
+// of its recipients after the pre-deliver hooks
+func deliverMessage(msg Message) {
+	if err := messageHooks.Run(context.Background(), PhasePreDeliver, &msg); err != nil {
+		log.Printf("Delivery of message %d stopped: %v", msg.ID, err)
+		return
+	}
+	if msg.IsGroup {
+		broadcastGroupMessage(msg)
+	} else {
+		sendToClient(msg.ToUser, msg)
 	}
-	messages = append(messages, newMessage)
-	return saveMessages(messages)
 }
 
 func updateUserStatus(username string, online bool) error {
@@ -266,59 +440,101 @@ func updateUserStatus(username string, online bool) error {
 	return errors.New("user not found")
 }
 
-func getOnlineUsers() []string {
+// getOnlineUsers lists the users viewer can see online
+func getOnlineUsers(viewer string) []string {
 	users := loadUsers()
 	var onlineUsers []string
 	for _, u := range users {
-		if u.IsOnline {
+		if visibleStatus(viewer, &u).IsOnline {
 			onlineUsers = append(onlineUsers, u.Username)
 		}
 	}
 	return onlineUsers
 }
 
-func deleteMessage(messageID int, username string) error {
-	messages := loadMessages()
-	for i, msg := range messages {
-		if msg.ID == messageID {
-			if msg.FromUser != username {
-				return errors.New("can only delete your own messages")
+func deleteMessage(messageID int, username, ip string) error {
+	return removeMessage(messageID, username, ip, func(msg Message) error {
+		if msg.FromUser != username || msg.Webhook != "" {
+			return errors.New("can only delete your own messages")
+		}
+		return nil
+	})
+}
+
+// removeMessage deletes the message if allow permits it and releases its files
+func removeMessage(messageID int, actor, ip string, allow func(Message) error) error {
+	var msg Message
+	err := updateMessages(func(messages []Message) ([]Message, error) {
+		for i := range messages {
+			if messages[i].ID == messageID {
+				if err := allow(messages[i]); err != nil {
+					return nil, err
+				}
+				msg = messages[i]
+				return append(messages[:i], messages[i+1:]...), nil
 			}
-			messages = append(messages[:i], messages[i+1:]...)
-			return saveMessages(messages)
 		}
+		return nil, ErrMessageNotFound
+	})
+	if err != nil {
+		return err
 	}
-	return errors.New("message not found")
-}
 
-func markMessageAsRead(messageID int, username string) error {
-	messages := loadMessages()
-	for i := range messages {
-		if messages[i].ID == messageID && messages[i].ToUser == username {
-			messages[i].IsRead = true
-			return saveMessages(messages)
+	logMessageAction(LogDelete, msg, actor, ip, msg.Content, "")
+	for _, att := range msg.Attachments {
+		for _, key := range att.blobKeys() {
+			releaseBlob(key)
 		}
 	}
-	return errors.New("message not found")
+	return nil
 }
 
-func createGroupMessage(from string, groupUsers []string, content string) error {
-	if len(groupUsers) < 2 {
-		return errors.New("group must have at least 2 recipients")
+// markMessageAsRead marks a direct message to username as read and clears
+// the notifications about its conversation. Group messages have no read
+// flag per member, so for them only the notifications are cleared.
+func markMessageAsRead(messageID int, username, ip string) error {
+	var msg Message
+	var wasRead bool
+	err := updateMessages(func(messages []Message) ([]Message, error) {
+		for i := range messages {
+			if messages[i].ID != messageID {
+				continue
+			}
+			if messages[i].IsGroup && containsUser(messages[i].GroupUsers, username) {
+				msg, wasRead = messages[i], true
+				return nil, nil
+			}
+			if messages[i].ToUser == username {
+				wasRead = messages[i].IsRead
+				messages[i].IsRead = true
+				msg = messages[i]
+				return messages, nil
+			}
+			break
+		}
+		return nil, errors.New("message not found")
+	})
+	if err != nil {
+		return err
 	}
 
-	messages := loadMessages()
-	newMessage := Message{
-		ID:         len(messages) + 1,
+	if !wasRead {
+		logMessageAction(LogRead, msg, username, ip, "", "")
+	}
+	notificationService.MarkConversationRead(username, conversationKey(msg, username))
+	return nil
+}
+
+func createGroupMessage(from string, groupUsers []string, content, ip string) error {
+	return appendMessage(&Message{
 		FromUser:   from,
 		ToUser:     "group",
 		Content:    strings.TrimSpace(content),
 		CreatedAt:  time.Now(),
 		IsGroup:    true,
 		GroupUsers: groupUsers,
-	}
-	messages = append(messages, newMessage)
-	return saveMessages(messages)
+		ClientIP:   ip,
+	})
 }
 
 func getUserGroups(username string) [][]string {
@@ -338,6 +554,24 @@ func getUserGroups(username string) [][]string {
 	return uniqueGroups
 }
 
+// groupKey identifies a group by its sorted member list
+func groupKey(users []string) string {
+	sorted := append([]string(nil), users...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// conversationKey identifies the conversation msg belongs to, as seen by viewer
+func conversationKey(msg Message, viewer string) string {
+	if msg.IsGroup {
+		return "group:" + groupKey(msg.GroupUsers)
+	}
+	if msg.FromUser == viewer {
+		return "dm:" + msg.ToUser
+	}
+	return "dm:" + msg.FromUser
+}
+
 func containsUser(users []string, username string) bool {
 	for _, u := range users {
 		if u == username {
@@ -370,6 +604,22 @@ func getMessageHistory(user1, user2 string) []Message {
 	return history
 }
 
+// getGroupHistory returns the messages of the group with these members;
+// only members can read it
+func getGroupHistory(username string, members []string) ([]Message, error) {
+	if !containsUser(members, username) {
+		return nil, ErrNotGroupMember
+	}
+	key := groupKey(members)
+	history := []Message{}
+	for _, msg := range loadMessages() {
+		if msg.IsGroup && groupKey(msg.GroupUsers) == key {
+			history = append(history, msg)
+		}
+	}
+	return history, nil
+}
+
 func processMessageContent(content string) string {
 	// Convert Markdown to HTML
 	unsafe := blackfriday.Run([]byte(content))
@@ -390,20 +640,81 @@ func processMessageContent(content string) string {
 	return processed
 }
 
-func editMessage(messageID int, username, newContent string) error {
-	messages := loadMessages()
-	for i := range messages {
-		if messages[i].ID == messageID {
-			if messages[i].FromUser != username {
-				return errors.New("can only edit your own messages")
+// editMessage replaces the content of an own message. The new text goes
+// through the same pipeline as a new message: hooks, validation,
+// formatting, the content filter and mentions.
+func editMessage(messageID int, username, newContent, ip string) error {
+	var original *Message
+	for _, m := range loadMessages() {
+		if m.ID == messageID {
+			original = &m
+			break
+		}
+	}
+	if original == nil {
+		return errors.New("message not found")
+	}
+	if original.FromUser != username || original.Webhook != "" {
+		return errors.New("can only edit your own messages")
+	}
+
+	ctx := context.Background()
+	edited := cloneMessage(*original)
+	edited.Content = newContent
+	edited.ClientIP = ip
+	if err := messageHooks.Run(ctx, PhasePreValidate, &edited); err != nil {
+		return err
+	}
+	if err := validateMessage(edited); err != nil {
+		return err
+	}
+	edited.Content = processMessageContent(edited.Content)
+	flagged, err := filterMessage(&edited)
+	if err != nil {
+		return err
+	}
+	if err := messageHooks.Run(ctx, PhaseTransform, &edited); err != nil {
+		return err
+	}
+	applyMentions(&edited)
+
+	var msg Message
+	var before string
+	err = updateMessages(func(messages []Message) ([]Message, error) {
+		for i := range messages {
+			if messages[i].ID == messageID {
+				before = messages[i].Content
+				messages[i].Content = edited.Content
+				messages[i].Mentions = edited.Mentions
+				messages[i].IsEdited = true
+				messages[i].EditedAt = time.Now()
+				msg = messages[i]
+				return messages, nil
 			}
-			messages[i].Content = newContent
-			messages[i].IsEdited = true
-			messages[i].EditedAt = time.Now()
-			return saveMessages(messages)
 		}
+		return nil, errors.New("message not found")
+	})
+	if err != nil {
+		return err
 	}
-	return errors.New("message not found")
+
+	logMessageAction(LogEdit, msg, username, ip, before, msg.Content)
+	if len(flagged) > 0 {
+		flagMessage(msg, flagged)
+	}
+	// Уведомляются только пользователи, упомянутые впервые
+	var added []string
+	for _, u := range msg.Mentions {
+		if !containsUser(original.Mentions, u) {
+			added = append(added, u)
+		}
+	}
+	if len(added) > 0 {
+		notified := msg
+		notified.Mentions = added
+		notifyMentions(notified)
+	}
+	return nil
 }
 
 func searchMessageHistory(username, query string, startDate, endDate time.Time) []Message {
@@ -441,61 +752,16 @@ func getUserStatus(username string) UserStatus {
 }
 
 func validateFileUpload(fileName string, fileSize int64) error {
-	// Check file size (max 10MB)
-	if fileSize > 10*1024*1024 {
-		return errors.New("file too large (max 10MB)")
-	}
-
-	// Check file extension
-	ext := strings.ToLower(filepath.Ext(fileName))
-	allowedExts := map[string]bool{
-		".jpg": true, ".jpeg": true, ".png": true,
-		".gif": true, ".pdf": true, ".doc": true,
-		".docx": true, ".txt": true,
-	}
-
-	if !allowedExts[ext] {
-		return errors.New("unsupported file type")
-	}
-
-	return nil
+	return validateMediaFile(fileName, fileSize)
 }
 
+// validateMediaFile checks the extension and the per-file size limit
+// (see QuotaConfig.MaxFileSize); the content is verified when the file is stored
 func validateMediaFile(fileName string, fileSize int64) error {
-	// Расширяем список разрешенных форматов
-	allowedExts := map[string]bool{
-		".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
-		".mp4": true, ".webm": true, ".mov": true,
-		".pdf": true, ".doc": true, ".docx": true, ".txt": true,
-	}
-
-	maxSizes := map[string]int64{
-		"image":    10 * 1024 * 1024, // 10MB
-		"video":    50 * 1024 * 1024, // 50MB
-		"document": 20 * 1024 * 1024, // 20MB
-	}
-
-	ext := strings.ToLower(filepath.Ext(fileName))
-	if !allowedExts[ext] {
-		return errors.New("unsupported file type")
-	}
-
-	// Определяем тип файла и проверяем размер
-	switch {
-	case strings.HasPrefix(ext, ".jp"), ext == ".png", ext == ".gif":
-		if fileSize > maxSizes["image"] {
-			return errors.New("image too large (max 10MB)")
-		}
-	case ext == ".mp4", ext == ".webm", ext == ".mov":
-		if fileSize > maxSizes["video"] {
-			return errors.New("video too large (max 50MB)")
-		}
-	default:
-		if fileSize > maxSizes["document"] {
-			return errors.New("file too large (max 20MB)")
-		}
+	if !isAllowedExtension(filepath.Ext(fileName)) {
+		return ErrFileTypeNotAllowed
 	}
-	return nil
+	return checkFileSize(fileName, fileSize)
 }
 
 func sanitizeContent(content string) string {
@@ -533,12 +799,40 @@ func exportMessageHistory(username string) ([]byte, error) {
 }
 
 func updateProfile(username string, profile UserProfile) error {
+	fields := map[string]*string{"display_name": &profile.DisplayName, "bio": &profile.Bio}
+	profile.Email = strings.TrimSpace(profile.Email)
+	if err := validateEmail(profile.Email); err != nil {
+		return err
+	}
+	flagged := make(map[string][]string)
+	for name, value := range fields {
+		filtered := contentFilter.Check(strings.TrimSpace(*value), false)
+		if filtered.Rejected != "" {
+			return filterRejection(name)
+		}
+		*value = filtered.Text
+		if len(filtered.Flagged) > 0 {
+			flagged[name] = filtered.Flagged
+		}
+	}
+
 	users := loadUsers()
 	for i := range users {
 		if users[i].Username == username {
-			users[i].Avatar = profile.Avatar
+			if profile.Avatar != "" {
+				users[i].Avatar = profile.Avatar
+			}
+			users[i].Email = profile.Email
+			users[i].DisplayName = profile.DisplayName
+			users[i].Bio = profile.Bio
 			// Additional profile fields...
-			return saveUsers(users)
+			if err := saveUsers(users); err != nil {
+				return err
+			}
+			for name, rules := range flagged {
+				flagProfile(username, name, *fields[name], rules)
+			}
+			return nil
 		}
 	}
 	return errors.New("user not found")
@@ -567,49 +861,39 @@ func cacheMessages(username string, messages []Message) {
 	}()
 }
 
-func formatMessage(msg Message) Message {
-	// Форматируем текст сообщения
-	msg.Content = processMessageContent(msg.Content)
-
-	// Добавляем метаданные
-	if msg.IsGroup {
-		msg.Content = fmt.Sprintf("[Group Message] %s", msg.Content)
-	}
-
-	// Добавляем информацию о файле
-	if msg.HasFile {
-		fileInfo := fmt.Sprintf("\n[Attachment: %s]", msg.FileName)
-		msg.Content = msg.Content + fileInfo
-	}
-
-	// Добавляем информацию о редактировании
-	if msg.IsEdited {
-		msg.Content = fmt.Sprintf("%s (edited at %s)",
-			msg.Content,
-			msg.EditedAt.Format("15:04:05"))
-	}
-
-	return msg
-}
-
-func addReactionToMessage(messageID int, userID string, emoji string) error {
-	messages := loadMessages()
-	for i := range messages {
-		if messages[i].ID == messageID {
-			// Проверяем, не ставил ли пользователь уже такую реакцию
-			for _, reaction := range messages[i].Reactions {
-				if reaction.UserID == userID && reaction.Emoji == emoji {
-					return nil
+func addReactionToMessage(messageID int, userID, emoji, ip string) error {
+	var msg Message
+	var added bool
+	err := updateMessages(func(messages []Message) ([]Message, error) {
+		for i := range messages {
+			if messages[i].ID == messageID {
+				// Чужие сообщения выглядят как несуществующие
+				if !isParticipant(messages[i], userID) {
+					return nil, ErrMessageNotFound
+				}
+				// Проверяем, не ставил ли пользователь уже такую реакцию
+				for _, reaction := range messages[i].Reactions {
+					if reaction.UserID == userID && reaction.Emoji == emoji {
+						return nil, nil
+					}
 				}
-			}
 
-			messages[i].Reactions = append(messages[i].Reactions, MessageReaction{
-				UserID:    userID,
-				Emoji:     emoji,
-				CreatedAt: time.Now(),
-			})
-			return saveMessages(messages)
+				messages[i].Reactions = append(messages[i].Reactions, MessageReaction{
+					UserID:    userID,
+					Emoji:     emoji,
+					CreatedAt: time.Now(),
+				})
+				msg, added = messages[i], true
+				return messages, nil
+			}
 		}
+		return nil, ErrMessageNotFound
+	})
+	if err != nil || !added {
+		return err
 	}
-	return errors.New("message not found")
+
+	logMessageAction(LogReact, msg, userID, ip, "", emoji)
+	notifyReaction(msg, userID, emoji)
+	return nil
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTempMessageLog points the audit log at a temporary file
+func useTempMessageLog(t *testing.T) {
+	old := messageLogsFile
+	messageLogsFile = filepath.Join(t.TempDir(), "message_logs.jsonl")
+	t.Cleanup(func() { messageLogsFile = old })
+}
+
+func TestAddReactionRequiresParticipant(t *testing.T) {
+	useTempBlobStore(t)
+	useTempMessageLog(t)
+	if err := saveMessages([]Message{{ID: 1, FromUser: "alice", ToUser: "bob", Content: "hi"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := addReactionToMessage(1, "mallory", "👍", "127.0.0.1"); err != ErrMessageNotFound {
+		t.Fatalf("reaction of a non-participant = %v, want ErrMessageNotFound", err)
+	}
+	if err := addReactionToMessage(1, "bob", "👍", "127.0.0.1"); err != nil {
+		t.Fatalf("reaction of the recipient = %v", err)
+	}
+	if reactions := loadMessages()[0].Reactions; len(reactions) != 1 || reactions[0].UserID != "bob" {
+		t.Fatalf("reactions = %+v, want only bob's", reactions)
+	}
+}
+
+func TestAppendMessageLogsNewGroupMembers(t *testing.T) {
+	useTempBlobStore(t)
+	useTempMessageLog(t)
+	oldUsers := usersFile
+	usersFile = filepath.Join(t.TempDir(), "users.json")
+	t.Cleanup(func() { usersFile = oldUsers })
+	for _, u := range []string{"alice", "bob"} {
+		if err := createUser(u, "secret123"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logMutex.RLock()
+	start := len(messageLogs)
+	logMutex.RUnlock()
+	for _, content := range []string{"first", "second"} {
+		msg := Message{FromUser: "alice", ToUser: "group", Content: content, IsGroup: true,
+			GroupUsers: []string{"alice", "bob"}, ClientIP: "192.0.2.1"}
+		if err := appendMessage(&msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logMutex.RLock()
+	entries := append([]MessageLog{}, messageLogs[start:]...)
+	logMutex.RUnlock()
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+		if e.IP != "192.0.2.1" {
+			t.Errorf("%s entry without the client IP: %+v", e.Action, e)
+		}
+	}
+	if len(actions) != 3 || actions[0] != LogMembers || actions[1] != LogCreate || actions[2] != LogCreate {
+		t.Fatalf("actions = %v, want members once, then two creates", actions)
+	}
+	if entries[0].After != "alice,bob" {
+		t.Fatalf("members entry = %+v", entries[0])
+	}
+}
+
+func TestEditMessageSanitizesContent(t *testing.T) {
+	useTempBlobStore(t)
+	useTempMessageLog(t)
+	oldUsers := usersFile
+	usersFile = filepath.Join(t.TempDir(), "users.json")
+	t.Cleanup(func() { usersFile = oldUsers })
+	for _, u := range []string{"alice", "bob"} {
+		if err := createUser(u, "secret123"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := Message{FromUser: "alice", ToUser: "bob", Content: "hi"}
+	if err := appendMessage(&msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Правка проходит тот же конвейер, что и новое сообщение
+	if err := editMessage(msg.ID, "alice", `<img src=x onerror=alert(1)> hey @bob`, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	stored := loadMessages()[0]
+	if strings.Contains(stored.Content, "onerror") || strings.Contains(stored.Content, "alert") {
+		t.Fatalf("stored content = %q, want the handler removed", stored.Content)
+	}
+	if !stored.IsEdited || len(stored.Mentions) != 1 || stored.Mentions[0] != "bob" {
+		t.Fatalf("edited message = %+v, want it marked edited and mentioning bob", stored)
+	}
+
+	if err := editMessage(msg.ID, "alice", "   ", "192.0.2.1"); err == nil {
+		t.Fatal("empty edit was accepted")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Report is a user's complaint about a message or another user
+type Report struct {
+	ID           int       `json:"id"`
+	Reporter     string    `json:"reporter"` // пусто, если жалобу подал фильтр контента
+	ReportedUser string    `json:"reported_user"`
+	MessageID    int       `json:"message_id,omitempty"`
+	Reason       string    `json:"reason"`
+	Status       string    `json:"status"`
+	Snapshot     *Message  `json:"snapshot,omitempty"` // сообщение на момент жалобы
+	Context      []Message `json:"context,omitempty"`  // соседние сообщения беседы
+	CreatedAt    time.Time `json:"created_at"`
+	ResolvedBy   string    `json:"resolved_by,omitempty"`
+	ResolvedAt   time.Time `json:"resolved_at,omitempty"`
+	Action       string    `json:"action,omitempty"`
+	Note         string    `json:"note,omitempty"`
+}
+
+// Report statuses
+const (
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+// Moderator actions on a report
+const (
+	ModDismiss       = "dismiss"
+	ModDeleteMessage = "delete_message"
+	ModWarn          = "warn"
+	ModSuspend       = "suspend"
+	ModBan           = "ban"
+)
+
+// reportContextSize is how many messages before and after the reported
+// one are kept with the report
+const reportContextSize = 5
+
+var (
+	reportsFile  = "data/reports.json"
+	reportsMutex sync.Mutex
+)
+
+func loadReports() []Report {
+	data, err := os.ReadFile(reportsFile)
+	if err != nil {
+		return []Report{}
+	}
+
+	var reports []Report
+	json.Unmarshal(data, &reports)
+	return reports
+}
+
+func saveReports(reports []Report) error {
+	data, err := json.MarshalIndent(reports, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(reportsFile, data, 0644)
+}
+
+// conversationMessages returns the messages of the conversation msg
+// belongs to, oldest first
+func conversationMessages(messages []Message, msg Message) []Message {
+	var result []Message
+	for _, m := range messages {
+		switch {
+		case msg.IsGroup:
+			if m.IsGroup && groupKey(m.GroupUsers) == groupKey(msg.GroupUsers) {
+				result = append(result, m)
+			}
+		case !m.IsGroup && ((m.FromUser == msg.FromUser && m.ToUser == msg.ToUser) ||
+			(m.FromUser == msg.ToUser && m.ToUser == msg.FromUser)):
+			result = append(result, m)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.Before(result[j].CreatedAt) })
+	return result
+}
+
+// createReport files a report about a message (messageID != 0) or a user.
+// The reporter must be able to see the message.
+func createReport(reporter string, messageID int, reportedUser, reason string) (Report, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return Report{}, errors.New("reason is required")
+	}
+	report := Report{
+		Reporter:  reporter,
+		MessageID: messageID,
+		Reason:    reason,
+	}
+
+	messages := loadMessages()
+	if messageID != 0 {
+		var found *Message
+		for i := range messages {
+			if messages[i].ID == messageID {
+				found = &messages[i]
+				break
+			}
+		}
+		if found == nil || !isParticipant(*found, reporter) {
+			return Report{}, ErrMessageNotFound
+		}
+		snapshot := cloneMessage(*found)
+		report.Snapshot = &snapshot
+		report.ReportedUser = found.FromUser
+		report.Context = messageContext(messages, *found)
+	} else {
+		if findUser(reportedUser) == nil {
+			return Report{}, ErrUserNotFound
+		}
+		report.ReportedUser = reportedUser
+		// Контекст жалобы на пользователя — его последние сообщения заявителю
+		conversation := conversationMessages(messages, Message{FromUser: reportedUser, ToUser: reporter})
+		if len(conversation) > 2*reportContextSize {
+			conversation = conversation[len(conversation)-2*reportContextSize:]
+		}
+		report.Context = conversation
+	}
+	if report.ReportedUser == reporter {
+		return Report{}, errors.New("you cannot report yourself")
+	}
+
+	return fileReport(report)
+}
+
+// fileReport adds an open report to the queue. Reports without a
+// Reporter come from the content filter.
+func fileReport(report Report) (Report, error) {
+	reportsMutex.Lock()
+	defer reportsMutex.Unlock()
+	reports := loadReports()
+	report.ID = 1
+	for _, r := range reports {
+		if r.ID >= report.ID {
+			report.ID = r.ID + 1
+		}
+	}
+	report.Status = ReportOpen
+	report.CreatedAt = time.Now()
+	if err := saveReports(append(reports, report)); err != nil {
+		return Report{}, err
+	}
+	return report, nil
+}
+
+// messageContext returns the reported message with up to
+// reportContextSize messages of the conversation on each side
+func messageContext(messages []Message, msg Message) []Message {
+	conversation := conversationMessages(messages, msg)
+	for i, m := range conversation {
+		if m.ID == msg.ID {
+			start, end := i-reportContextSize, i+reportContextSize+1
+			if start < 0 {
+				start = 0
+			}
+			if end > len(conversation) {
+				end = len(conversation)
+			}
+			return conversation[start:end]
+		}
+	}
+	return nil
+}
+
+// resolveReport applies a moderator action and notifies the reporter.
+// duration is only used by ModSuspend.
+func resolveReport(id int, moderator, ip, action string, duration time.Duration, note string) (Report, error) {
+	reportsMutex.Lock()
+	defer reportsMutex.Unlock()
+
+	reports := loadReports()
+	var report *Report
+	for i := range reports {
+		if reports[i].ID == id {
+			report = &reports[i]
+			break
+		}
+	}
+	if report == nil {
+		return Report{}, errors.New("report not found")
+	}
+	if report.Status != ReportOpen {
+		return Report{}, errors.New("report is already resolved")
+	}
+
+	target := report.ReportedUser
+	switch action {
+	case ModDismiss:
+	case ModDeleteMessage:
+		if report.MessageID == 0 {
+			return Report{}, errors.New("the report is not about a message")
+		}
+		err := removeMessage(report.MessageID, moderator, ip, func(Message) error { return nil })
+		if err != nil && err != ErrMessageNotFound {
+			return Report{}, err
+		}
+	case ModWarn:
+		text := "You received a warning from a moderator"
+		if note != "" {
+			text += ": " + note
+		}
+		notificationService.AddWithPriority(target, "moderation_warning", text, PriorityHigh)
+	case ModSuspend:
+		if duration <= 0 {
+			return Report{}, errors.New("suspension duration is required")
+		}
+		if err := suspendUser(target, time.Now().Add(duration)); err != nil {
+			return Report{}, err
+		}
+	case ModBan:
+		if err := setUserDisabled(target, true); err != nil {
+			return Report{}, err
+		}
+	default:
+		return Report{}, errors.New("unknown action")
+	}
+
+	report.Status = ReportResolved
+	if action == ModDismiss {
+		report.Status = ReportDismissed
+	}
+	report.Action = action
+	report.Note = note
+	report.ResolvedBy = moderator
+	report.ResolvedAt = time.Now()
+	if err := saveReports(reports); err != nil {
+		return Report{}, err
+	}
+
+	after := action
+	if action == ModSuspend {
+		after = fmt.Sprintf("%s %s", action, duration)
+	}
+	recordMessageLog(MessageLog{
+		MessageID: report.MessageID,
+		Action:    "moderation_" + action,
+		UserID:    moderator,
+		Target:    target,
+		After:     after,
+		IP:        ip,
+		Details:   fmt.Sprintf("report %d", report.ID),
+	})
+
+	if report.Reporter != "" {
+		outcome := "no action was taken"
+		if action != ModDismiss {
+			outcome = "action was taken"
+		}
+		notificationService.Add(report.Reporter, "report_resolved",
+			fmt.Sprintf("Your report about %s was reviewed: %s", target, outcome))
+	}
+	return *report, nil
+}
+
+// suspendUser blocks the account until the given time and signs it out
+func suspendUser(username string, until time.Time) error {
+	if err := updateUser(username, func(u *User) {
+		u.SuspendedUntil = until
+		u.IsOnline = false
+	}); err != nil {
+		return err
+	}
+	revokeUserSessions(username)
+	notificationService.AddWithPriority(username, "moderation_suspended",
+		"Your account is suspended until "+until.Format("2006-01-02 15:04"), PriorityHigh)
+	return nil
+}
+
+// isSuspended reports whether a moderator suspension is in effect
+func (u *User) isSuspended() bool {
+	return time.Now().Before(u.SuspendedUntil)
+}
+
+// isActive reports whether the account may act, itself or through its
+// bots and webhooks: it exists and is not disabled, deleted or suspended
+func (u *User) isActive() bool {
+	return u != nil && !u.Disabled && !u.Deleted && !u.isSuspended()
+}
@@ -2,26 +2,44 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/microcosm-cc/bluemonday"
 )
 
-// Notification represents a single notification
+// Notification represents a single notification.
+// Notifications with the same collapse key are merged while unread:
+// Count grows and Preview holds the latest content.
 type Notification struct {
-	ID        int       `json:"id"`
-	UserID    string    `json:"user_id"`
-	Type      string    `json:"type"`
-	Message   string    `json:"message"`
-	Read      bool      `json:"read"`
-	CreatedAt time.Time `json:"created_at"`
+	ID           int       `json:"id"`
+	UserID       string    `json:"user_id"`
+	Type         string    `json:"type"`
+	Message      string    `json:"message"`
+	Priority     string    `json:"priority,omitempty"`
+	CollapseKey  string    `json:"collapse_key,omitempty"`
+	Conversation string    `json:"conversation,omitempty"`
+	Count        int       `json:"count"`
+	Preview      string    `json:"preview,omitempty"`
+	Read         bool      `json:"read"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
+const (
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
 // NotificationService represents the notification service structure
 type NotificationService struct {
 	notifications map[string][]Notification
 	mutex         sync.RWMutex
 	webhooks      []string
+	push          *PushService
 }
 
 // NewNotificationService creates a new notification service
@@ -33,35 +51,58 @@ func NewNotificationService() *NotificationService {
 }
 
 func (s *NotificationService) Add(userId string, notifType string, message string) {
+	s.AddWithPriority(userId, notifType, message, PriorityNormal)
+}
+
+// AddWithPriority adds a notification; high priority ones are pushed with high urgency
+func (s *NotificationService) AddWithPriority(userId string, notifType string, message string, priority string) {
+	s.Notify(Notification{
+		UserID:   userId,
+		Type:     notifType,
+		Message:  message,
+		Priority: priority,
+	})
+}
+
+// Notify adds the notification, collapsing it into an unread one with the same key
+func (s *NotificationService) Notify(notif Notification) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	notif := Notification{
-		ID:        len(s.notifications[userId]) + 1,
-		UserID:    userId,
-		Type:      notifType,
-		Message:   message,
-		CreatedAt: time.Now(),
-	}
-
-	s.notifications[userId] = append(s.notifications[userId], notif)
+	notif = s.addLocked(notif)
 	s.triggerWebhooks(notif)
+	s.triggerPush(notif)
 }
 
-func (s *NotificationService) AddGroupNotification(groupUsers []string, message string) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+func (s *NotificationService) addLocked(notif Notification) Notification {
+	now := time.Now()
+	list := s.notifications[notif.UserID]
 
-	for _, userId := range groupUsers {
-		notif := Notification{
-			ID:        len(s.notifications[userId]) + 1,
-			UserID:    userId,
-			Type:      "group_message",
-			Message:   message,
-			CreatedAt: time.Now(),
+	if notif.CollapseKey != "" {
+		for i := range list {
+			if list[i].Read || list[i].CollapseKey != notif.CollapseKey {
+				continue
+			}
+			list[i].Count++
+			list[i].Message = notif.Message
+			list[i].Preview = notif.Preview
+			list[i].UpdatedAt = now
+			if notif.Priority == PriorityHigh {
+				list[i].Priority = PriorityHigh
+			}
+			return list[i]
 		}
-		s.notifications[userId] = append(s.notifications[userId], notif)
 	}
+
+	notif.ID = len(list) + 1
+	notif.Count = 1
+	notif.CreatedAt = now
+	notif.UpdatedAt = now
+	if notif.Priority == "" {
+		notif.Priority = PriorityNormal
+	}
+	s.notifications[notif.UserID] = append(list, notif)
+	return notif
 }
 
 func (s *NotificationService) GetUnread(userId string) []Notification {
@@ -119,6 +160,34 @@ func (s *NotificationService) triggerWebhooks(notif Notification) {
 	}()
 }
 
+// MarkConversationRead marks every notification about the conversation as read
+func (s *NotificationService) MarkConversationRead(userId string, conversation string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.notifications[userId] {
+		if s.notifications[userId][i].Conversation == conversation {
+			s.notifications[userId][i].Read = true
+		}
+	}
+}
+
+// SetPushService enables Web Push delivery for users without a live connection
+func (s *NotificationService) SetPushService(push *PushService) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.push = push
+}
+
+// triggerPush sends the notification via Web Push when the user has
+// no open WebSocket, i.e. the chat tab is closed
+func (s *NotificationService) triggerPush(notif Notification) {
+	if s.push == nil || hasLiveConnection(notif.UserID) {
+		return
+	}
+	go s.push.Send(notif.UserID, notif)
+}
+
 // Добавляем новые методы в NotificationService
 func (s *NotificationService) GetAllByUser(userId string) []Notification {
 	s.mutex.RLock()
@@ -139,3 +208,63 @@ func (s *NotificationService) MarkAllRead(userId string) {
 		s.notifications[userId][i].Read = true
 	}
 }
+
+// notifyNewMessage notifies the recipients of msg, collapsing bursts from
+// the same conversation (or the same reply thread) into one entry.
+// Mentioned users already got a high-priority mention notification.
+func notifyNewMessage(msg Message) {
+	recipients := []string{msg.ToUser}
+	if msg.IsGroup {
+		recipients = msg.GroupUsers
+	}
+
+	for _, u := range recipients {
+		if u == msg.FromUser || containsUser(msg.Mentions, u) {
+			continue
+		}
+
+		conversation := conversationKey(msg, u)
+		notif := Notification{
+			UserID:       u,
+			Type:         "new_message",
+			Message:      fmt.Sprintf("New message from %s", msg.FromUser),
+			CollapseKey:  conversation,
+			Conversation: conversation,
+			Preview:      notificationPreview(msg.Content),
+		}
+		if msg.IsGroup {
+			notif.Type = "group_message"
+		}
+		if msg.ReplyTo != 0 {
+			notif.Type = "reply"
+			notif.Message = fmt.Sprintf("%s replied in a thread", msg.FromUser)
+			notif.CollapseKey = fmt.Sprintf("thread:%d", msg.ReplyTo)
+		}
+		notificationService.Notify(notif)
+	}
+}
+
+// notifyReaction notifies the message author about a new reaction
+func notifyReaction(msg Message, from string, emoji string) {
+	if msg.FromUser == from {
+		return
+	}
+	notificationService.Notify(Notification{
+		UserID:       msg.FromUser,
+		Type:         "reaction",
+		Message:      fmt.Sprintf("%s reacted to your message", from),
+		CollapseKey:  fmt.Sprintf("reaction:%d", msg.ID),
+		Conversation: conversationKey(msg, msg.FromUser),
+		Preview:      emoji,
+	})
+}
+
+// notificationPreview returns a short preview of message content with
+// all markup stripped (the text stays HTML-escaped)
+func notificationPreview(content string) string {
+	text := strings.Join(strings.Fields(bluemonday.StrictPolicy().Sanitize(content)), " ")
+	if runes := []rune(text); len(runes) > 80 {
+		text = string(runes[:80]) + "…"
+	}
+	return text
+}
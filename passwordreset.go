@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordResetConfig selects how reset links reach the user
+type PasswordResetConfig struct {
+	Channel  string     `json:"channel"`   // smtp или admin
+	BaseURL  string     `json:"base_url"`  // адрес сервера в ссылках из писем, например https://chat.example.com
+	TokenTTL int        `json:"token_ttl"` // minutes
+	SMTP     SMTPConfig `json:"smtp"`
+}
+
+// SMTPConfig holds the mail server used by the smtp channel
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	From     string `json:"from"`
+}
+
+// Password reset channels
+const (
+	ResetChannelSMTP  = "smtp"
+	ResetChannelAdmin = "admin"
+)
+
+// Audit actions of password resets
+const (
+	LogPasswordReset       = "password_reset"
+	LogAdminResetLink      = "admin_reset_link"
+	minPasswordLength      = 8
+	passphraseLength       = 16 // парольной фразе этой длины не нужны разные классы символов
+	resetTokenBytes        = 32
+	resetRequestMessage    = "If the account exists, instructions to reset the password have been sent."
+	resetInvalidLinkReason = "This reset link is invalid or has expired."
+)
+
+// Purposes of the tokens kept with the password resets
+const (
+	TokenPasswordReset = ""
+	TokenUnlock        = "unlock" // вход в обход блокировки после неудачных попыток
+)
+
+// PasswordReset is an issued reset or unlock token; only its hash is stored
+type PasswordReset struct {
+	TokenHash string    `json:"token_hash"`
+	Purpose   string    `json:"purpose,omitempty"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedBy string    `json:"created_by,omitempty"` // администратор, создавший ссылку
+	IP        string    `json:"ip,omitempty"`
+}
+
+// ResetChannel delivers password resets requested by users and unlock
+// links of accounts locked after failed logins
+type ResetChannel interface {
+	RequestReset(user *User, ip string) error
+	RequestUnlock(user *User, ip string) error
+}
+
+// SMTPResetChannel mails a reset link to the user's address
+type SMTPResetChannel struct {
+	Config  SMTPConfig
+	BaseURL string
+}
+
+// AdminResetChannel asks the admins to create a reset link and pass it on
+type AdminResetChannel struct{}
+
+var (
+	ErrWeakPassword = errors.New("password is too weak")
+
+	passwordResetsFile  = "data/password_resets.json"
+	passwordResetsMutex sync.Mutex
+
+	resetChannel ResetChannel
+
+	// Самые распространённые пароли, которые проходят остальные проверки
+	commonPasswords = map[string]bool{
+		"password1": true, "password123": true, "qwerty123": true, "12345678a": true,
+		"iloveyou1": true, "welcome1": true, "admin123": true, "letmein1": true,
+		"qwerty12345": true, "1q2w3e4r": true, "1qaz2wsx": true, "zaq12wsx": true,
+		"passw0rd": true, "p@ssw0rd": true, "abc12345": true, "pa$$word": true,
+	}
+)
+
+// NewResetChannel creates the configured channel
+func NewResetChannel(cfg PasswordResetConfig) (ResetChannel, error) {
+	switch cfg.Channel {
+	case ResetChannelAdmin, "":
+		return AdminResetChannel{}, nil
+	case ResetChannelSMTP:
+		// Ссылку нельзя строить по заголовку Host запроса: его подставляет клиент
+		if cfg.BaseURL == "" {
+			return nil, errors.New("password_reset.base_url is required for the smtp channel")
+		}
+		if cfg.SMTP.Host == "" || cfg.SMTP.From == "" {
+			return nil, errors.New("password_reset.smtp needs host and from")
+		}
+		return &SMTPResetChannel{Config: cfg.SMTP, BaseURL: cfg.BaseURL}, nil
+	}
+	return nil, fmt.Errorf("unknown password reset channel %q", cfg.Channel)
+}
+
+func (c *SMTPResetChannel) RequestReset(user *User, ip string) error {
+	if user.Email == "" {
+		return nil // сообщать некуда; ответ клиенту от этого не зависит
+	}
+	token, err := issueResetToken(user.Username, "", ip)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Someone (IP %s) asked to reset the password of %s.\r\n\r\n"+
+		"Open this link within %d minutes to choose a new password:\r\n%s\r\n\r\n"+
+		"If it was not you, ignore this email; your password stays the same.\r\n",
+		ip, user.Username, config.PasswordReset.TokenTTL, resetLink(c.BaseURL, token))
+	return c.send(user, "Password reset", body)
+}
+
+func (c *SMTPResetChannel) RequestUnlock(user *User, ip string) error {
+	if user.Email == "" {
+		return nil
+	}
+	token, err := issueAccountToken(user.Username, TokenUnlock, "", ip)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Your account %s was locked after failed login attempts (last from IP %s).\r\n\r\n"+
+		"To sign in before the lock runs out, open this link within %d minutes and enter your password:\r\n%s\r\n\r\n"+
+		"If the attempts were not yours, someone is guessing your password; consider changing it.\r\n",
+		user.Username, ip, config.PasswordReset.TokenTTL, unlockLink(c.BaseURL, token))
+	return c.send(user, "Account locked", body)
+}
+
+// send mails body to the user's address
+func (c *SMTPResetChannel) send(user *User, subject, body string) error {
+	msg := "From: " + c.Config.From + "\r\n" +
+		"To: " + user.Email + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" + body
+
+	port := c.Config.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if c.Config.Username != "" {
+		auth = smtp.PlainAuth("", c.Config.Username, c.Config.Password, c.Config.Host)
+	}
+	return smtp.SendMail(fmt.Sprintf("%s:%d", c.Config.Host, port), auth, c.Config.From, []string{user.Email}, []byte(msg))
+}
+
+func (AdminResetChannel) RequestReset(user *User, ip string) error {
+	for _, admin := range adminUsernames() {
+		notificationService.AddWithPriority(admin, "password_reset_request",
+			fmt.Sprintf("%s asked for a password reset (IP %s). Create a reset link in the admin console and pass it on.", user.Username, ip),
+			PriorityHigh)
+	}
+	return nil
+}
+
+func (AdminResetChannel) RequestUnlock(user *User, ip string) error {
+	for _, admin := range adminUsernames() {
+		notificationService.AddWithPriority(admin, "account_locked",
+			fmt.Sprintf("%s was locked after failed logins (last from %s). If the owner asks, create an unlock link in the admin console and pass it on.", user.Username, ip),
+			PriorityHigh)
+	}
+	return nil
+}
+
+// adminUsernames lists everyone isAdmin accepts
+func adminUsernames() []string {
+	var admins []string
+	for _, u := range loadUsers() {
+		if isAdmin(u.Username) {
+			admins = append(admins, u.Username)
+		}
+	}
+	return admins
+}
+
+func resetLink(baseURL, token string) string {
+	return strings.TrimRight(baseURL, "/") + "/password/reset?token=" + url.QueryEscape(token)
+}
+
+func unlockLink(baseURL, token string) string {
+	return strings.TrimRight(baseURL, "/") + "/login/unlock?token=" + url.QueryEscape(token)
+}
+
+// validatePassword is the strength check for new passwords: at least
+// minPasswordLength characters with two kinds of characters (or a long
+// passphrase), not a common password and not the username
+func validatePassword(password, username string) error {
+	if len([]rune(password)) < minPasswordLength {
+		return fmt.Errorf("%w: use at least %d characters", ErrWeakPassword, minPasswordLength)
+	}
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return fmt.Errorf("%w: this password is too common", ErrWeakPassword)
+	}
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		return fmt.Errorf("%w: do not use your username in the password", ErrWeakPassword)
+	}
+
+	var hasLower, hasUpper, hasDigit, hasOther bool
+	distinct := make(map[rune]bool)
+	for _, r := range password {
+		distinct[r] = true
+		switch {
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasOther = true
+		}
+	}
+	if len(distinct) < 4 {
+		return fmt.Errorf("%w: too many repeated characters", ErrWeakPassword)
+	}
+	classes := 0
+	for _, has := range []bool{hasLower, hasUpper, hasDigit, hasOther} {
+		if has {
+			classes++
+		}
+	}
+	if classes < 2 && len([]rune(password)) < passphraseLength {
+		return fmt.Errorf("%w: mix letters with digits or symbols, or use at least %d characters", ErrWeakPassword, passphraseLength)
+	}
+	return nil
+}
+
+func loadPasswordResets() []PasswordReset {
+	data, err := os.ReadFile(passwordResetsFile)
+	if err != nil {
+		return []PasswordReset{}
+	}
+
+	var resets []PasswordReset
+	json.Unmarshal(data, &resets)
+	return resets
+}
+
+func savePasswordResets(resets []PasswordReset) error {
+	data, err := json.MarshalIndent(resets, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(passwordResetsFile, data, 0600)
+}
+
+// issueResetToken creates a password reset token for the user
+func issueResetToken(username, admin, ip string) (string, error) {
+	return issueAccountToken(username, TokenPasswordReset, admin, ip)
+}
+
+// issueAccountToken creates a token for the user, replacing the ones with
+// the same purpose issued before, and drops expired tokens
+func issueAccountToken(username, purpose, admin, ip string) (string, error) {
+	token, err := randomToken(resetTokenBytes)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+
+	passwordResetsMutex.Lock()
+	defer passwordResetsMutex.Unlock()
+	kept := []PasswordReset{}
+	for _, reset := range loadPasswordResets() {
+		if (reset.Username != username || reset.Purpose != purpose) && now.Before(reset.ExpiresAt) {
+			kept = append(kept, reset)
+		}
+	}
+	kept = append(kept, PasswordReset{
+		TokenHash: hashToken(token),
+		Purpose:   purpose,
+		Username:  username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(config.PasswordReset.TokenTTL) * time.Minute),
+		CreatedBy: admin,
+		IP:        ip,
+	})
+	return token, savePasswordResets(kept)
+}
+
+// dropPasswordResets removes every reset and unlock token of the user
+func dropPasswordResets(username string) {
+	passwordResetsMutex.Lock()
+	defer passwordResetsMutex.Unlock()
+	kept := []PasswordReset{}
+	for _, reset := range loadPasswordResets() {
+		if reset.Username != username {
+			kept = append(kept, reset)
+		}
+	}
+	savePasswordResets(kept)
+}
+
+// findPasswordReset returns the user a valid reset token belongs to
+func findPasswordReset(token string) (string, bool) {
+	return findAccountToken(token, TokenPasswordReset)
+}
+
+// findAccountToken returns the user a valid token with this purpose belongs to
+func findAccountToken(token, purpose string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	hash := hashToken(token)
+	passwordResetsMutex.Lock()
+	defer passwordResetsMutex.Unlock()
+	for _, reset := range loadPasswordResets() {
+		if reset.TokenHash == hash && reset.Purpose == purpose && time.Now().Before(reset.ExpiresAt) {
+			return reset.Username, true
+		}
+	}
+	return "", false
+}
+
+// takeAccountToken uses up a valid token: it is removed, together with the
+// user's other tokens of the same purpose, before the caller acts on it,
+// so two requests with the same token cannot both succeed
+func takeAccountToken(token, purpose string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	hash := hashToken(token)
+	passwordResetsMutex.Lock()
+	defer passwordResetsMutex.Unlock()
+	resets := loadPasswordResets()
+	username := ""
+	for _, reset := range resets {
+		if reset.TokenHash == hash && reset.Purpose == purpose && time.Now().Before(reset.ExpiresAt) {
+			username = reset.Username
+			break
+		}
+	}
+	if username == "" {
+		return "", false
+	}
+	kept := []PasswordReset{}
+	for _, reset := range resets {
+		if reset.Username != username || reset.Purpose != purpose {
+			kept = append(kept, reset)
+		}
+	}
+	if err := savePasswordResets(kept); err != nil {
+		return "", false
+	}
+	return username, true
+}
+
+// requestPasswordReset starts a reset for the account with this username
+// or email. Unknown accounts are ignored silently, so the response does
+// not tell which accounts exist.
+func requestPasswordReset(identifier, ip string) {
+	identifier = strings.TrimSpace(identifier)
+	if identifier == "" {
+		return
+	}
+	var user *User
+	for _, u := range loadUsers() {
+		if u.Username == identifier || (u.Email != "" && strings.EqualFold(u.Email, identifier)) {
+			u := u
+			user = &u
+			break
+		}
+	}
+	if user == nil || user.IsBot || user.Disabled {
+		return
+	}
+	if err := resetChannel.RequestReset(user, ip); err != nil {
+		log.Printf("Password reset for %s failed: %v", user.Username, err)
+	}
+}
+
+// resetPassword sets a new password with a reset token. The token and
+// every other token of the user are used up, the lockout after failed
+// logins is lifted, and all sessions and API tokens are invalidated.
+func resetPassword(token, password, ip string) error {
+	username, ok := findPasswordReset(token)
+	if !ok {
+		return errors.New(resetInvalidLinkReason)
+	}
+	if err := validatePassword(password, username); err != nil {
+		return err
+	}
+	// Токен удаляется до смены пароля: из двух одновременных запросов
+	// с одной ссылкой пройдёт только один
+	if _, ok := takeAccountToken(token, TokenPasswordReset); !ok {
+		return errors.New(resetInvalidLinkReason)
+	}
+	if user := findUser(username); user == nil || user.Deleted {
+		return errors.New(resetInvalidLinkReason)
+	}
+	if err := setPassword(username, password); err != nil {
+		return err
+	}
+	dropPasswordResets(username)
+
+	unlockAccount(username)
+	recordMessageLog(MessageLog{Action: LogPasswordReset, UserID: username, Target: username, IP: ip})
+	notificationService.AddWithPriority(username, "security_password_changed",
+		fmt.Sprintf("Your password was reset from %s and all sessions were signed out", ip), PriorityHigh)
+	return nil
+}
+
+// setPassword stores a new password and signs the user out everywhere:
+// sessions and JWTs issued before PasswordChangedAt are no longer accepted
+func setPassword(username, password string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if err := updateUser(username, func(u *User) {
+		u.Password = string(hashed)
+		u.PasswordChangedAt = time.Now()
+		u.IsOnline = false
+	}); err != nil {
+		return err
+	}
+	return revokeUserSessions(username)
+}
+
+// sessionValid reports whether a session or token issued at authTime
+// (Unix seconds) survived the last password change
+func sessionValid(user *User, authTime int64) bool {
+	return user.PasswordChangedAt.IsZero() || authTime >= user.PasswordChangedAt.Unix()
+}
+
+// validateEmail accepts an empty address (email is optional) or a plain one
+func validateEmail(email string) error {
+	if email == "" {
+		return nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("invalid email address")
+	}
+	return nil
+}
+
+// resetBaseURL is the server address for links created by admins: the
+// configured base URL, or the address the admin reached the server at
+func resetBaseURL(r *http.Request) string {
+	if config.PasswordReset.BaseURL != "" {
+		return config.PasswordReset.BaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestResetPasswordTokenIsSingleUse(t *testing.T) {
+	dir := t.TempDir()
+	oldUsers, oldResets, oldSessions, oldLogs := usersFile, passwordResetsFile, userSessionsFile, messageLogsFile
+	usersFile = filepath.Join(dir, "users.json")
+	passwordResetsFile = filepath.Join(dir, "password_resets.json")
+	userSessionsFile = filepath.Join(dir, "sessions.json")
+	messageLogsFile = filepath.Join(dir, "message_logs.jsonl")
+	t.Cleanup(func() {
+		usersFile, passwordResetsFile, userSessionsFile, messageLogsFile = oldUsers, oldResets, oldSessions, oldLogs
+	})
+
+	if err := createUser("alice", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := issueResetToken("alice", "", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Несколько запросов одновременно с одной ссылкой: пароль меняет только один
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded []string
+	)
+	for _, password := range []string{"first-pass1", "second-pass2", "third-pass3", "fourth-pass4"} {
+		wg.Add(1)
+		go func(password string) {
+			defer wg.Done()
+			if err := resetPassword(token, password, "127.0.0.1"); err == nil {
+				mu.Lock()
+				succeeded = append(succeeded, password)
+				mu.Unlock()
+			}
+		}(password)
+	}
+	wg.Wait()
+
+	if len(succeeded) != 1 {
+		t.Fatalf("%d resets with one token succeeded, want 1", len(succeeded))
+	}
+	if !validateUser("alice", succeeded[0]) {
+		t.Fatalf("password of the successful reset does not work")
+	}
+	if _, ok := findPasswordReset(token); ok {
+		t.Fatalf("token still valid after the reset")
+	}
+}
+
+func TestResetPasswordKeepsTokenOnWeakPassword(t *testing.T) {
+	dir := t.TempDir()
+	oldUsers, oldResets := usersFile, passwordResetsFile
+	usersFile = filepath.Join(dir, "users.json")
+	passwordResetsFile = filepath.Join(dir, "password_resets.json")
+	t.Cleanup(func() { usersFile, passwordResetsFile = oldUsers, oldResets })
+
+	if err := createUser("alice", "secret123"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := issueResetToken("alice", "", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resetPassword(token, "short", "127.0.0.1"); err == nil {
+		t.Fatalf("weak password accepted")
+	}
+	if _, ok := findPasswordReset(token); !ok {
+		t.Fatalf("a rejected password used up the token")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Who may start direct messages with a user
+const (
+	DMEveryone = "everyone"
+	DMContacts = "contacts"
+	DMNobody   = "nobody"
+)
+
+// PrivacySettings control who can reach the user and what others see
+type PrivacySettings struct {
+	DMPolicy     string `json:"dm_policy"` // everyone, contacts или nobody
+	HideLastSeen bool   `json:"hide_last_seen"`
+	HideOnline   bool   `json:"hide_online"`
+}
+
+// ErrMessageNotAllowed is returned when the recipient does not accept
+// messages from the sender. Blocking and privacy settings are not told
+// apart, so the sender cannot find out that they are blocked.
+var ErrMessageNotAllowed = errors.New("this user does not accept messages from you")
+
+func (p PrivacySettings) dmPolicy() string {
+	if p.DMPolicy == "" {
+		return DMEveryone
+	}
+	return p.DMPolicy
+}
+
+// hasBlocked reports whether user has blocked other
+func (u *User) hasBlocked(other string) bool {
+	return containsUser(u.Blocked, other)
+}
+
+// canDirectMessage applies the recipient's block list and DM policy
+func canDirectMessage(from string, to *User) error {
+	if from == to.Username {
+		return nil
+	}
+	if to.hasBlocked(from) {
+		return ErrMessageNotAllowed
+	}
+	switch to.Privacy.dmPolicy() {
+	case DMNobody:
+		return ErrMessageNotAllowed
+	case DMContacts:
+		if !containsUser(to.Contacts, from) {
+			return ErrMessageNotAllowed
+		}
+	}
+	return nil
+}
+
+// canAddToGroup checks that none of the members of a new group has
+// blocked its creator
+func canAddToGroup(from string, members []string) error {
+	for _, member := range members {
+		if member == from {
+			continue
+		}
+		if u := findUser(member); u != nil && (u.Deleted || u.hasBlocked(from)) {
+			return errors.New(member + " cannot be added to the group")
+		}
+	}
+	return nil
+}
+
+// groupExists reports whether messages were already sent to the group
+func groupExists(users []string) bool {
+	key := groupKey(users)
+	for _, msg := range loadMessages() {
+		if msg.IsGroup && groupKey(msg.GroupUsers) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleStatus is the presence of user as seen by viewer
+func visibleStatus(viewer string, user *User) UserStatus {
+	status := UserStatus{IsOnline: user.IsOnline, LastSeen: user.LastSeen}
+	if viewer == user.Username {
+		return status
+	}
+	if user.hasBlocked(viewer) {
+		return UserStatus{}
+	}
+	if user.Privacy.HideOnline {
+		status.IsOnline = false
+	}
+	if user.Privacy.HideLastSeen {
+		status.LastSeen = time.Time{}
+	}
+	return status
+}
+
+func updatePrivacy(username string, privacy PrivacySettings) error {
+	switch privacy.DMPolicy {
+	case DMEveryone, DMContacts, DMNobody:
+	case "":
+		privacy.DMPolicy = DMEveryone
+	default:
+		return errors.New("unknown dm_policy")
+	}
+	return updateUser(username, func(u *User) {
+		u.Privacy = privacy
+	})
+}
+
+// blockUser adds other to the user's block list and removes them from contacts
+func blockUser(username, other string) error {
+	if other == username {
+		return errors.New("you cannot block yourself")
+	}
+	if findUser(other) == nil {
+		return ErrUserNotFound
+	}
+	return updateUser(username, func(u *User) {
+		u.Blocked = addUser(u.Blocked, other)
+		u.Contacts = removeUser(u.Contacts, other)
+	})
+}
+
+func unblockUser(username, other string) error {
+	return updateUser(username, func(u *User) {
+		u.Blocked = removeUser(u.Blocked, other)
+	})
+}
+
+func addContact(username, other string) error {
+	if other == username {
+		return errors.New("you cannot add yourself")
+	}
+	if findUser(other) == nil {
+		return ErrUserNotFound
+	}
+	return updateUser(username, func(u *User) {
+		u.Contacts = addUser(u.Contacts, other)
+	})
+}
+
+func removeContact(username, other string) error {
+	return updateUser(username, func(u *User) {
+		u.Contacts = removeUser(u.Contacts, other)
+	})
+}
+
+func addUser(users []string, username string) []string {
+	if containsUser(users, username) {
+		return users
+	}
+	users = append(users, strings.TrimSpace(username))
+	sort.Strings(users)
+	return users
+}
+
+func removeUser(users []string, username string) []string {
+	kept := users[:0]
+	for _, u := range users {
+		if u != username {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
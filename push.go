@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/hkdf"
+)
+
+// PushSubscription is the browser PushSubscription object plus device info
+type PushSubscription struct {
+	Endpoint       string    `json:"endpoint"`
+	ExpirationTime *int64    `json:"expirationTime,omitempty"`
+	Keys           PushKeys  `json:"keys"`
+	Device         string    `json:"device,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type PushKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// PushService delivers notifications through the Web Push protocol
+type PushService struct {
+	subscriptions map[string][]PushSubscription
+	mutex         sync.RWMutex
+	privateKey    *ecdsa.PrivateKey
+	publicKey     string // base64url, uncompressed P-256 point
+	subject       string
+	ttl           int
+	client        *http.Client
+}
+
+var (
+	pushSubscriptionsFile = "data/push_subscriptions.json"
+	vapidKeysFile         = "data/vapid.json"
+)
+
+const pushRecordSize = 4096
+
+// NewPushService creates a push service, loading or generating VAPID keys
+func NewPushService(cfg PushConfig) (*PushService, error) {
+	s := &PushService{
+		subscriptions: make(map[string][]PushSubscription),
+		subject:       cfg.Subject,
+		ttl:           cfg.TTL,
+		client:        &http.Client{Timeout: 15 * time.Second},
+	}
+
+	priv, err := loadVAPIDKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.privateKey = priv
+	s.publicKey = base64.RawURLEncoding.EncodeToString(
+		elliptic.Marshal(elliptic.P256(), priv.X, priv.Y))
+
+	if data, err := os.ReadFile(pushSubscriptionsFile); err == nil {
+		json.Unmarshal(data, &s.subscriptions)
+	}
+	return s, nil
+}
+
+// loadVAPIDKeys uses the configured key pair, then the stored one,
+// and generates (and stores) a new pair as the last resort
+func loadVAPIDKeys(cfg PushConfig) (*ecdsa.PrivateKey, error) {
+	if cfg.PrivateKey != "" {
+		return decodeVAPIDPrivateKey(cfg.PrivateKey)
+	}
+
+	var stored struct {
+		PublicKey  string `json:"public_key"`
+		PrivateKey string `json:"private_key"`
+	}
+	if data, err := os.ReadFile(vapidKeysFile); err == nil {
+		if err := json.Unmarshal(data, &stored); err == nil && stored.PrivateKey != "" {
+			return decodeVAPIDPrivateKey(stored.PrivateKey)
+		}
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	stored.PrivateKey = base64.RawURLEncoding.EncodeToString(priv.D.FillBytes(make([]byte, 32)))
+	stored.PublicKey = base64.RawURLEncoding.EncodeToString(
+		elliptic.Marshal(elliptic.P256(), priv.X, priv.Y))
+
+	data, err := json.MarshalIndent(stored, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(vapidKeysFile, data, 0600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+func decodeVAPIDPrivateKey(encoded string) (*ecdsa.PrivateKey, error) {
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("invalid VAPID private key")
+	}
+	curve := elliptic.P256()
+	priv := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	priv.PublicKey.Curve = curve
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(d)
+	return priv, nil
+}
+
+// PublicKey returns the application server key for PushManager.subscribe
+func (s *PushService) PublicKey() string {
+	return s.publicKey
+}
+
+func (s *PushService) saveSubscriptions() error {
+	data, err := json.MarshalIndent(s.subscriptions, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(pushSubscriptionsFile, data, 0644)
+}
+
+// Subscribe stores a subscription for the user, replacing one with the same endpoint
+func (s *PushService) Subscribe(userId string, sub PushSubscription) error {
+	if !strings.HasPrefix(sub.Endpoint, "https://") {
+		return errors.New("push endpoint must be an https URL")
+	}
+	if _, err := decodePushKey(sub.Keys.P256dh, 65); err != nil {
+		return errors.New("invalid p256dh key")
+	}
+	if _, err := decodePushKey(sub.Keys.Auth, 16); err != nil {
+		return errors.New("invalid auth secret")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sub.CreatedAt = time.Now()
+	subs := s.subscriptions[userId]
+	for i := range subs {
+		if subs[i].Endpoint == sub.Endpoint {
+			subs[i] = sub
+			return s.saveSubscriptions()
+		}
+	}
+	s.subscriptions[userId] = append(subs, sub)
+	return s.saveSubscriptions()
+}
+
+// Unsubscribe removes the subscription with the given endpoint
+func (s *PushService) Unsubscribe(userId, endpoint string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	subs := s.subscriptions[userId]
+	for i := range subs {
+		if subs[i].Endpoint == endpoint {
+			s.subscriptions[userId] = append(subs[:i], subs[i+1:]...)
+			if len(s.subscriptions[userId]) == 0 {
+				delete(s.subscriptions, userId)
+			}
+			return s.saveSubscriptions()
+		}
+	}
+	return errors.New("subscription not found")
+}
+
+// Send delivers the notification to every device the user subscribed from.
+// Subscriptions rejected by the push service with 404/410 are removed.
+func (s *PushService) Send(userId string, notif Notification) {
+	s.mutex.RLock()
+	subs := append([]PushSubscription(nil), s.subscriptions[userId]...)
+	s.mutex.RUnlock()
+
+	if len(subs) == 0 {
+		return
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"id":         notif.ID,
+		"type":       notif.Type,
+		"title":      "Chat",
+		"body":       notif.Message,
+		"priority":   notif.Priority,
+		"tag":        notif.CollapseKey,
+		"count":      notif.Count,
+		"preview":    notif.Preview,
+		"url":        "/messages",
+		"created_at": notif.CreatedAt,
+	})
+
+	for _, sub := range subs {
+		status, err := s.sendOne(sub, payload, notif)
+		if err != nil {
+			log.Printf("Push to %s failed: %v", userId, err)
+			continue
+		}
+		switch status {
+		case http.StatusNotFound, http.StatusGone:
+			// Подписка истекла или отозвана браузером
+			s.Unsubscribe(userId, sub.Endpoint)
+		case http.StatusCreated, http.StatusOK, http.StatusAccepted:
+		default:
+			log.Printf("Push to %s rejected with status %d", userId, status)
+		}
+	}
+}
+
+func (s *PushService) sendOne(sub PushSubscription, payload []byte, notif Notification) (int, error) {
+	body, err := encryptPushPayload(sub.Keys, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	authHeader, err := s.vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", fmt.Sprint(s.ttl))
+	if notif.Priority == PriorityHigh {
+		req.Header.Set("Urgency", "high")
+	} else {
+		req.Header.Set("Urgency", "normal")
+	}
+	if notif.CollapseKey != "" {
+		// Push-сервис заменит ещё не доставленное сообщение с тем же Topic
+		sum := sha256.Sum256([]byte(notif.CollapseKey))
+		req.Header.Set("Topic", base64.RawURLEncoding.EncodeToString(sum[:24]))
+	}
+	req.Header.Set("Authorization", authHeader)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// vapidAuthorization builds the RFC 8292 "vapid" Authorization header
+func (s *PushService) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.StandardClaims{
+		Audience:  u.Scheme + "://" + u.Host,
+		ExpiresAt: time.Now().Add(12 * time.Hour).Unix(),
+		Subject:   s.subject,
+	})
+	signed, err := token.SignedString(s.privateKey)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("vapid t=%s, k=%s", signed, s.publicKey), nil
+}
+
+// encryptPushPayload encrypts the payload as described in RFC 8291
+// using the aes128gcm content coding from RFC 8188 (single record)
+func encryptPushPayload(keys PushKeys, plaintext []byte) ([]byte, error) {
+	uaPublicBytes, err := decodePushKey(keys.P256dh, 65)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := decodePushKey(keys.Auth, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	curve := ecdh.P256()
+	uaPublic, err := curve.NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+	asPrivate, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public, 32)
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Один record: данные + разделитель последнего record (0x02)
+	if len(plaintext)+1+gcm.Overhead() > pushRecordSize {
+		return nil, errors.New("push payload too large")
+	}
+	record := append(append([]byte(nil), plaintext...), 0x02)
+
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, pushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+func decodePushKey(encoded string, size int) ([]byte, error) {
+	encoded = strings.TrimRight(encoded, "=")
+	key, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.RawStdEncoding.DecodeString(encoded)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("expected %d byte key, got %d", size, len(key))
+	}
+	return key, nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// QuotaConfig limits attachment storage. Sizes are in bytes; 0 means
+// unlimited.
+type QuotaConfig struct {
+	UserBytes  int64            `json:"user_bytes"`
+	GroupBytes int64            `json:"group_bytes"`
+	Users      map[string]int64 `json:"users,omitempty"`  // индивидуальные квоты пользователей
+	Groups     map[string]int64 `json:"groups,omitempty"` // квоты групп по groupKey
+	// Максимальный размер одного файла по категориям: image, video, document
+	MaxFileSize map[string]int64 `json:"max_file_size"`
+}
+
+// ErrQuotaExceeded is returned when an upload does not fit into a quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// StorageUsage is the attachment storage used under one quota
+type StorageUsage struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"` // 0 - без ограничений
+}
+
+// GroupStorageUsage is the usage of a group conversation
+type GroupStorageUsage struct {
+	GroupKey string   `json:"group_key"`
+	Users    []string `json:"users"`
+	StorageUsage
+}
+
+// quotaReservation is space taken by files that are being stored and are
+// not counted by the usage yet
+type quotaReservation struct {
+	user  string
+	group string // groupKey, пусто для личных сообщений и черновиков
+	size  int64
+}
+
+var (
+	// quotaMutex makes checking a quota and reserving space one step;
+	// quotaReservationsMutex only guards the map, usage reads it as well
+	quotaMutex             sync.Mutex
+	quotaReservationsMutex sync.Mutex
+	quotaReservations      = make(map[int]quotaReservation)
+	nextReservationID      int
+)
+
+// fileCategory sorts files by extension into the per-file limit categories
+func fileCategory(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return "image"
+	case ".mp4", ".webm", ".mov", ".mp3":
+		return "video"
+	}
+	return "document"
+}
+
+// maxFileSize returns the largest per-file limit
+func maxFileSize() int64 {
+	var max int64
+	for _, size := range config.Quotas.MaxFileSize {
+		if size > max {
+			max = size
+		}
+	}
+	return max
+}
+
+// checkFileSize applies the per-file limit of the file's category
+func checkFileSize(fileName string, fileSize int64) error {
+	category := fileCategory(fileName)
+	limit := config.Quotas.MaxFileSize[category]
+	if limit > 0 && fileSize > limit {
+		return fmt.Errorf("%w: %s too large (max %s)", ErrQuotaExceeded, category, formatBytes(limit))
+	}
+	return nil
+}
+
+func userQuota(username string) int64 {
+	if limit, ok := config.Quotas.Users[username]; ok {
+		return limit
+	}
+	return config.Quotas.UserBytes
+}
+
+func groupQuota(key string) int64 {
+	if limit, ok := config.Quotas.Groups[key]; ok {
+		return limit
+	}
+	return config.Quotas.GroupBytes
+}
+
+// userStorageUsage counts the attachments the user has sent or staged
+// plus the space reserved by the user's unfinished uploads
+func userStorageUsage(username string) StorageUsage {
+	usage := StorageUsage{Limit: userQuota(username)}
+	for _, msg := range loadMessages() {
+		if msg.FromUser == username {
+			usage.Used += attachmentsSize(msg.Attachments)
+		}
+	}
+	stagedMutex.Lock()
+	for _, s := range loadStagedAttachments() {
+		if s.Owner == username {
+			usage.Used += s.Attachment.Size
+		}
+	}
+	stagedMutex.Unlock()
+	uploadsMutex.Lock()
+	for _, u := range loadUploads() {
+		if u.Owner == username {
+			usage.Used += u.Length
+		}
+	}
+	uploadsMutex.Unlock()
+	usage.Used += reservedBytes(func(r quotaReservation) bool { return r.user == username })
+	return usage
+}
+
+// groupStorageUsage counts the attachments sent to the group
+func groupStorageUsage(users []string) StorageUsage {
+	key := groupKey(users)
+	usage := StorageUsage{Limit: groupQuota(key)}
+	for _, msg := range loadMessages() {
+		if msg.IsGroup && groupKey(msg.GroupUsers) == key {
+			usage.Used += attachmentsSize(msg.Attachments)
+		}
+	}
+	uploadsMutex.Lock()
+	for _, u := range loadUploads() {
+		if u.IsGroup && groupKey(u.GroupUsers) == key {
+			usage.Used += u.Length
+		}
+	}
+	uploadsMutex.Unlock()
+	usage.Used += reservedBytes(func(r quotaReservation) bool { return r.group == key })
+	return usage
+}
+
+// reservedBytes sums the reservations matching fn
+func reservedBytes(fn func(quotaReservation) bool) int64 {
+	quotaReservationsMutex.Lock()
+	defer quotaReservationsMutex.Unlock()
+	var size int64
+	for _, r := range quotaReservations {
+		if fn(r) {
+			size += r.size
+		}
+	}
+	return size
+}
+
+func attachmentsSize(atts []Attachment) int64 {
+	var size int64
+	for _, att := range atts {
+		size += att.Size
+	}
+	return size
+}
+
+// reserveQuota checks that size more bytes fit into the sender's quota
+// and, for group messages, into the group's quota, and reserves them in
+// the same step, so parallel uploads cannot pass the check together.
+// The caller calls release once the files are saved, staged or recorded
+// as an upload (and counted by the usage), or have been discarded.
+func reserveQuota(from string, target Message, size int64) (release func(), err error) {
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	if err := checkQuota(from, target, size); err != nil {
+		return nil, err
+	}
+
+	r := quotaReservation{user: from, size: size}
+	if target.IsGroup {
+		r.group = groupKey(target.GroupUsers)
+	}
+	return addReservation(r), nil
+}
+
+// reserveGroupQuota checks and reserves size bytes in the group's quota
+// only. It is used for staged files: their owner's quota already counts
+// them.
+func reserveGroupQuota(users []string, size int64) (release func(), err error) {
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	if err := checkGroupQuota(users, size); err != nil {
+		return nil, err
+	}
+	return addReservation(quotaReservation{group: groupKey(users), size: size}), nil
+}
+
+// addReservation records r and returns its idempotent release
+func addReservation(r quotaReservation) func() {
+	quotaReservationsMutex.Lock()
+	nextReservationID++
+	id := nextReservationID
+	quotaReservations[id] = r
+	quotaReservationsMutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			quotaReservationsMutex.Lock()
+			delete(quotaReservations, id)
+			quotaReservationsMutex.Unlock()
+		})
+	}
+}
+
+// checkQuota makes sure a new file of size bytes fits into the sender's
+// quota and, for group messages, into the group's quota. It is called
+// with quotaMutex held, see reserveQuota.
+func checkQuota(from string, target Message, size int64) error {
+	if usage := userStorageUsage(from); usage.Limit > 0 && usage.Used+size > usage.Limit {
+		return fmt.Errorf("%w: %s of %s used", ErrQuotaExceeded, formatBytes(usage.Used), formatBytes(usage.Limit))
+	}
+	if target.IsGroup {
+		return checkGroupQuota(target.GroupUsers, size)
+	}
+	return nil
+}
+
+func checkGroupQuota(users []string, size int64) error {
+	if usage := groupStorageUsage(users); usage.Limit > 0 && usage.Used+size > usage.Limit {
+		return fmt.Errorf("%w: group has %s of %s used", ErrQuotaExceeded, formatBytes(usage.Used), formatBytes(usage.Limit))
+	}
+	return nil
+}
+
+// getStorageUsage reports the user's own usage and that of their groups
+func getStorageUsage(username string) (StorageUsage, []GroupStorageUsage) {
+	groups := []GroupStorageUsage{}
+	seen := make(map[string]bool)
+	for _, users := range getUserGroups(username) {
+		key := groupKey(users)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		groups = append(groups, GroupStorageUsage{
+			GroupKey:     key,
+			Users:        users,
+			StorageUsage: groupStorageUsage(users),
+		})
+	}
+	return userStorageUsage(username), groups
+}
+
+func formatBytes(n int64) string {
+	const mb = 1024 * 1024
+	if n >= mb {
+		return fmt.Sprintf("%.1f MB", float64(n)/mb)
+	}
+	if n >= 1024 {
+		return fmt.Sprintf("%d KB", n/1024)
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// uploadErrorStatus maps upload validation errors to HTTP status codes
+func uploadErrorStatus(err error) int {
+	if errors.Is(err, ErrQuotaExceeded) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// storeErrorStatus tells rejected files and exceeded quotas apart from
+// storage failures
+func storeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusRequestEntityTooLarge
+	case isRejectedUpload(err), errors.Is(err, ErrTooManyAttachments):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
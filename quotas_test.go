@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReserveQuotaParallel(t *testing.T) {
+	useTempBlobStore(t)
+	oldUploads, oldQuotas := uploadsFile, config.Quotas
+	uploadsFile = filepath.Join(t.TempDir(), "uploads.json")
+	config.Quotas = QuotaConfig{UserBytes: 100}
+	t.Cleanup(func() { uploadsFile, config.Quotas = oldUploads, oldQuotas })
+
+	// Десять загрузок по 30 байт при квоте 100: место есть только для трёх
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted int
+		releases []func()
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := reserveQuota("alice", Message{}, 30)
+			if err != nil {
+				if !errors.Is(err, ErrQuotaExceeded) {
+					t.Error(err)
+				}
+				return
+			}
+			mu.Lock()
+			accepted++
+			releases = append(releases, release)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if accepted != 3 {
+		t.Fatalf("%d reservations of 30 bytes fit into 100, want 3", accepted)
+	}
+	if used := userStorageUsage("alice").Used; used != 90 {
+		t.Fatalf("usage with reservations = %d, want 90", used)
+	}
+
+	for _, release := range releases {
+		release()
+		release() // повторный вызов ничего не меняет
+	}
+	if used := userStorageUsage("alice").Used; used != 0 {
+		t.Fatalf("usage after release = %d, want 0", used)
+	}
+}
+
+func TestSendStagedChecksGroupQuota(t *testing.T) {
+	useTempBlobStore(t)
+	useTempMessageLog(t)
+	oldUsers, oldUploads, oldQuotas := usersFile, uploadsFile, config.Quotas
+	usersFile = filepath.Join(t.TempDir(), "users.json")
+	uploadsFile = filepath.Join(t.TempDir(), "uploads.json")
+	config.Quotas = QuotaConfig{GroupBytes: 100}
+	t.Cleanup(func() { usersFile, uploadsFile, config.Quotas = oldUsers, oldUploads, oldQuotas })
+
+	group := []string{"alice", "bob"}
+	if err := saveMessages([]Message{{ID: 1, FromUser: "bob", ToUser: "group", IsGroup: true, GroupUsers: group,
+		Content: "old", Attachments: []Attachment{{ID: "old", Size: 50}}}}); err != nil {
+		t.Fatal(err)
+	}
+	// Черновики считаются только в квоте пользователя, группу проверяет отправка
+	if err := stageAttachments("alice", []Attachment{{ID: "big", Size: 60}, {ID: "small", Size: 40}}); err != nil {
+		t.Fatal(err)
+	}
+	target := Message{ToUser: "alice,bob", IsGroup: true, GroupUsers: group}
+
+	if _, err := sendStagedMessage("alice", target, "big", []AttachmentRef{{ID: "big"}}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("send over the group quota = %v, want ErrQuotaExceeded", err)
+	}
+	if _, err := sendStagedMessage("alice", target, "small", []AttachmentRef{{ID: "small"}}); err != nil {
+		t.Fatalf("send within the group quota = %v", err)
+	}
+	if used := groupStorageUsage(group).Used; used != 90 {
+		t.Fatalf("group usage = %d, want 90", used)
+	}
+	// Неотправленный файл остаётся черновиком
+	if staged := loadStagedAttachments(); len(staged) != 1 || staged[0].Attachment.ID != "big" {
+		t.Fatalf("staged after the sends = %+v, want only the refused file", staged)
+	}
+}
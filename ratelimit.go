@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a token bucket limiter keyed by an arbitrary string
+// (bot name, user, IP...)
+type RateLimiter struct {
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+}
+
+// RateLimitResult describes the bucket after a request took a token
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int           // размер бакета
+	Remaining  int           // оставшиеся токены
+	RetryAfter time.Duration // через сколько появится следующий токен, если запрос отклонён
+	Reset      time.Duration // через сколько бакет снова будет полным
+}
+
+// NewRateLimiter allows perMinute requests per key with bursts up to burst
+func NewRateLimiter(perMinute int, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token for key. When the bucket is empty it returns false
+// and how long to wait until the next token is available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	res := l.Take(key)
+	return res.Allowed, res.RetryAfter
+}
+
+// Take is Allow with the state of the bucket for rate limit headers
+func (l *RateLimiter) Take(key string) RateLimitResult {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	res := RateLimitResult{Limit: int(l.burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else if l.rate <= 0 {
+		res.RetryAfter = time.Minute
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	res.Remaining = int(b.tokens)
+	if l.rate > 0 {
+		res.Reset = time.Duration((l.burst - b.tokens) / l.rate * float64(time.Second))
+	}
+	return res
+}
+
+// Prune forgets buckets that have refilled completely, so keys seen once
+// (IP addresses, for example) do not pile up
+func (l *RateLimiter) Prune() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimitConfig holds the request budgets and which routes use them
+type RateLimitConfig struct {
+	Enabled bool                  `json:"enabled"`
+	Budgets map[string]RateBudget `json:"budgets"`
+	// Маршрут → бюджет. Ключ с "/" на конце — префикс пути, иначе точный путь;
+	// пустой бюджет снимает ограничение
+	Routes    map[string]string    `json:"routes"`
+	WebSocket WebSocketLimitConfig `json:"websocket"`
+}
+
+// RateBudget is a token bucket: PerMinute tokens are added each minute,
+// up to Burst
+type RateBudget struct {
+	PerMinute int `json:"per_minute"`
+	Burst     int `json:"burst"`
+}
+
+// WebSocketLimitConfig limits what a client may push over /ws
+type WebSocketLimitConfig struct {
+	MaxFrameBytes int64 `json:"max_frame_bytes"`
+	FramesPerMin  int   `json:"frames_per_minute"`
+	Burst         int   `json:"burst"`
+	MaxViolations int   `json:"max_violations"` // после стольких превышений соединение закрывается
+}
+
+// Rate limit budgets
+const (
+	BudgetLogin  = "login"
+	BudgetSend   = "send"
+	BudgetUpload = "upload"
+	BudgetRead   = "read"
+)
+
+var (
+	rateLimiters  = make(map[string]*RateLimiter)
+	rateLimitsMux sync.Mutex
+)
+
+func defaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Enabled: true,
+		Budgets: map[string]RateBudget{
+			BudgetLogin:  {PerMinute: 10, Burst: 5},
+			BudgetSend:   {PerMinute: 60, Burst: 20},
+			BudgetUpload: {PerMinute: 20, Burst: 10},
+			BudgetRead:   {PerMinute: 300, Burst: 100},
+		},
+		Routes: map[string]string{
+			"/login":               BudgetLogin,
+			"/register":            BudgetLogin,
+			"/login/2fa":           BudgetLogin,
+			"/login/unlock":        BudgetLogin,
+			"/api/token":           BudgetLogin,
+			"/password/":           BudgetLogin,
+			"/send":                BudgetSend,
+			"/api/messages/send":   BudgetSend,
+			"/api/messages/reply":  BudgetSend,
+			"/api/messages/edit":   BudgetSend,
+			"/hooks/":              BudgetSend,
+			"/api/messages/upload": BudgetUpload,
+			"/api/attachments":     BudgetUpload,
+			"/api/uploads":         BudgetUpload,
+			"/api/uploads/":        "", // части tus-загрузки не ограничиваются
+			"/api/":                BudgetRead,
+			"/ws":                  BudgetRead,
+		},
+		WebSocket: WebSocketLimitConfig{
+			MaxFrameBytes: 64 * 1024,
+			FramesPerMin:  120,
+			Burst:         30,
+			MaxViolations: 10,
+		},
+	}
+}
+
+// limiterFor returns the shared limiter of a budget, or nil if the budget
+// is not configured
+func limiterFor(budget string) *RateLimiter {
+	b, ok := config.RateLimits.Budgets[budget]
+	if !ok {
+		return nil
+	}
+	rateLimitsMux.Lock()
+	defer rateLimitsMux.Unlock()
+	limiter, ok := rateLimiters[budget]
+	if !ok {
+		limiter = NewRateLimiter(b.PerMinute, b.Burst)
+		rateLimiters[budget] = limiter
+	}
+	return limiter
+}
+
+// routeBudget finds the budget of a path: an exact route wins, then the
+// longest matching prefix
+func routeBudget(path string) string {
+	if budget, ok := config.RateLimits.Routes[path]; ok {
+		return budget
+	}
+	budget, longest := "", 0
+	for route, b := range config.RateLimits.Routes {
+		if strings.HasSuffix(route, "/") && strings.HasPrefix(path, route) && len(route) > longest {
+			budget, longest = b, len(route)
+		}
+	}
+	return budget
+}
+
+// rateLimitKey is the signed-in user, or the client IP for anonymous
+// requests and logins
+func rateLimitKey(r *http.Request, budget string) string {
+	if budget != BudgetLogin {
+		session, _ := store.Get(r, "session-name")
+		if username, ok := session.Values["username"].(string); ok {
+			return "user:" + username
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// takeToken charges the budget and sets the X-RateLimit headers. A nil
+// result means the budget is not limited.
+func takeToken(w http.ResponseWriter, budget, key string) *RateLimitResult {
+	limiter := limiterFor(budget)
+	if limiter == nil {
+		return nil
+	}
+	res := limiter.Take(key)
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", fmt.Sprint(res.Limit))
+	h.Set("X-RateLimit-Remaining", fmt.Sprint(res.Remaining))
+	h.Set("X-RateLimit-Reset", fmt.Sprint(int(math.Ceil(res.Reset.Seconds()))))
+	return &res
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(retryAfter.Seconds()) + 1
+	w.Header().Set("Retry-After", fmt.Sprint(seconds))
+	http.Error(w, fmt.Sprintf("Too Many Requests: retry after %d", seconds), http.StatusTooManyRequests)
+}
+
+// rateLimit applies the budget of the route to every request
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config.RateLimits.Enabled || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		budget := routeBudget(r.URL.Path)
+		if budget == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if res := takeToken(w, budget, rateLimitKey(r, budget)); res != nil && !res.Allowed {
+			writeTooManyRequests(w, res.RetryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowSend charges a message sent over the WebSocket against the same
+// budget as HTTP sends
+func allowSend(username string) (bool, time.Duration) {
+	if !config.RateLimits.Enabled {
+		return true, 0
+	}
+	limiter := limiterFor(BudgetSend)
+	if limiter == nil {
+		return true, 0
+	}
+	return limiter.Allow("user:" + username)
+}
+
+// wsFrameLimiter counts the frames of one WebSocket connection
+type wsFrameLimiter struct {
+	limiter    *RateLimiter
+	violations int
+}
+
+func newWSFrameLimiter() *wsFrameLimiter {
+	cfg := config.RateLimits.WebSocket
+	if !config.RateLimits.Enabled || cfg.FramesPerMin <= 0 {
+		return &wsFrameLimiter{}
+	}
+	return &wsFrameLimiter{limiter: NewRateLimiter(cfg.FramesPerMin, cfg.Burst)}
+}
+
+// allow takes a token for a received frame. It returns false for a frame
+// over the limit and abusive=true once the connection should be closed.
+func (l *wsFrameLimiter) allow() (ok bool, retryAfter time.Duration, abusive bool) {
+	if l.limiter == nil {
+		return true, 0, false
+	}
+	ok, retryAfter = l.limiter.Allow("frames")
+	if ok {
+		return true, 0, false
+	}
+	l.violations++
+	max := config.RateLimits.WebSocket.MaxViolations
+	return false, retryAfter, max > 0 && l.violations >= max
+}
+
+// startRateLimitJanitor periodically drops idle buckets and stale
+// failed login counters
+func startRateLimitJanitor() {
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			rateLimitsMux.Lock()
+			limiters := make([]*RateLimiter, 0, len(rateLimiters))
+			for _, l := range rateLimiters {
+				limiters = append(limiters, l)
+			}
+			rateLimitsMux.Unlock()
+			for _, l := range limiters {
+				l.Prune()
+			}
+			pruneLoginFailures()
+		}
+	}()
+}
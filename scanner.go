@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScanConfig configures malware scanning of uploads
+type ScanConfig struct {
+	Enabled bool   `json:"enabled"`
+	Clamd   string `json:"clamd"`   // tcp:127.0.0.1:3310 или unix:/var/run/clamav/clamd.ctl
+	Policy  string `json:"policy"`  // fail_closed или fail_open: что делать, если сканер недоступен
+	Timeout int    `json:"timeout"` // seconds
+}
+
+const (
+	ScanPolicyFailClosed = "fail_closed"
+	ScanPolicyFailOpen   = "fail_open"
+)
+
+// Scan statuses stored in Attachment.ScanStatus
+const (
+	ScanClean     = "clean"
+	ScanInfected  = "infected"
+	ScanUnscanned = "unscanned" // сканер недоступен
+)
+
+// ScanResult is the verdict of a scanner
+type ScanResult struct {
+	Clean  bool
+	Threat string // имя сигнатуры, если файл заражён
+}
+
+// Scanner checks file contents for malware
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (ScanResult, error)
+}
+
+// ErrFileRejected is returned when an upload is quarantined
+var ErrFileRejected = errors.New("file rejected by malware scan")
+
+// QuarantinedFile is an upload that was not published because it is
+// infected or could not be scanned
+type QuarantinedFile struct {
+	Attachment Attachment `json:"attachment"`
+	Uploader   string     `json:"uploader"`
+	Status     string     `json:"status"`
+	Reason     string     `json:"reason"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+var (
+	fileScanner     Scanner
+	quarantineFile  = "data/quarantine.json"
+	quarantineMutex sync.Mutex
+)
+
+// NewScanner creates the scanner from the config, or nil when scanning is off
+func NewScanner(cfg ScanConfig) (Scanner, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	network, address, ok := strings.Cut(cfg.Clamd, ":")
+	if !ok || (network != "tcp" && network != "unix") {
+		return nil, fmt.Errorf("invalid clamd address %q", cfg.Clamd)
+	}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	return &ClamdScanner{Network: network, Address: address, Timeout: timeout}, nil
+}
+
+// ClamdScanner talks to clamd using the INSTREAM command
+type ClamdScanner struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+const clamdChunkSize = 64 * 1024
+
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(s.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, err
+	}
+	// Данные передаются кусками: 4 байта длины (big endian) и сами байты,
+	// кусок нулевой длины завершает поток
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return ScanResult{}, err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return ScanResult{}, readErr
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanResult{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return ScanResult{}, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply understands "stream: OK", "stream: <name> FOUND"
+// and "<message> ERROR"
+func parseClamdReply(reply string) (ScanResult, error) {
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return ScanResult{Clean: true}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		threat := strings.TrimSuffix(reply, " FOUND")
+		threat = strings.TrimSpace(strings.TrimPrefix(threat, "stream:"))
+		return ScanResult{Threat: threat}, nil
+	}
+	return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+}
+
+// scanAttachment runs the scanner over a stored attachment before it is
+// published. Infected files, and files that could not be scanned under
+// the fail-closed policy, are quarantined and the uploader is notified.
+func scanAttachment(ctx context.Context, uploader string, att *Attachment) error {
+	if fileScanner == nil {
+		return nil
+	}
+
+	blob, _, err := blobStore.Open(ctx, att.BlobKey)
+	if err != nil {
+		return err
+	}
+	result, err := fileScanner.Scan(ctx, blob)
+	blob.Close()
+
+	switch {
+	case err != nil:
+		if config.Scan.Policy == ScanPolicyFailOpen {
+			log.Printf("Scan of %s failed, publishing unscanned (fail_open): %v", att.FileName, err)
+			att.ScanStatus = ScanUnscanned
+			return nil
+		}
+		log.Printf("Scan of %s failed, file quarantined: %v", att.FileName, err)
+		return quarantineAttachment(uploader, att, ScanUnscanned, "the file could not be scanned")
+	case !result.Clean:
+		log.Printf("Infected upload %s by %s: %s", att.FileName, uploader, result.Threat)
+		return quarantineAttachment(uploader, att, ScanInfected, "malware detected ("+result.Threat+")")
+	}
+	att.ScanStatus = ScanClean
+	return nil
+}
+
+func quarantineAttachment(uploader string, att *Attachment, status, reason string) error {
+	att.ScanStatus = status
+
+	quarantineMutex.Lock()
+	files := loadQuarantine()
+	files = append(files, QuarantinedFile{
+		Attachment: *att,
+		Uploader:   uploader,
+		Status:     status,
+		Reason:     reason,
+		CreatedAt:  time.Now(),
+	})
+	err := saveQuarantine(files)
+	quarantineMutex.Unlock()
+	if err != nil {
+		log.Printf("Failed to save quarantine: %v", err)
+	}
+
+	notificationService.AddWithPriority(uploader, "upload_rejected",
+		fmt.Sprintf("File %s was rejected: %s", att.FileName, reason), PriorityHigh)
+	return fmt.Errorf("%w: %s", ErrFileRejected, reason)
+}
+
+func loadQuarantine() []QuarantinedFile {
+	data, err := os.ReadFile(quarantineFile)
+	if err != nil {
+		return []QuarantinedFile{}
+	}
+
+	var files []QuarantinedFile
+	json.Unmarshal(data, &files)
+	return files
+}
+
+func saveQuarantine(files []QuarantinedFile) error {
+	data, err := json.MarshalIndent(files, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(quarantineFile, data, 0644)
+}
+
+// isQuarantined reports whether a quarantined file still holds the blob
+func isQuarantined(key string) bool {
+	quarantineMutex.Lock()
+	defer quarantineMutex.Unlock()
+
+	for _, f := range loadQuarantine() {
+		if f.Attachment.BlobKey == key {
+			return true
+		}
+	}
+	return false
+}
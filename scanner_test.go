@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd accepts one INSTREAM session per connection, records the
+// chunks it received and answers with reply
+type fakeClamd struct {
+	listener net.Listener
+	reply    string
+	streams  chan clamdStream
+}
+
+type clamdStream struct {
+	command string
+	chunks  []int
+	data    []byte
+	err     error
+}
+
+func newFakeClamd(t *testing.T, reply string) *fakeClamd {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeClamd{listener: ln, reply: reply, streams: make(chan clamdStream, 4)}
+	t.Cleanup(func() { ln.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeClamd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	var s clamdStream
+	s.command, s.err = r.ReadString(0)
+	for s.err == nil {
+		var size uint32
+		if s.err = binary.Read(r, binary.BigEndian, &size); s.err != nil {
+			break
+		}
+		if size == 0 {
+			break
+		}
+		chunk := make([]byte, size)
+		if _, s.err = io.ReadFull(r, chunk); s.err != nil {
+			break
+		}
+		s.chunks = append(s.chunks, int(size))
+		s.data = append(s.data, chunk...)
+	}
+	f.streams <- s
+	if s.err == nil {
+		conn.Write([]byte(f.reply + "\x00"))
+	}
+}
+
+func (f *fakeClamd) scanner() *ClamdScanner {
+	return &ClamdScanner{Network: "tcp", Address: f.listener.Addr().String(), Timeout: 5 * time.Second}
+}
+
+func TestClamdScannerStreamsChunks(t *testing.T) {
+	clamd := newFakeClamd(t, "stream: OK")
+	content := bytes.Repeat([]byte("0123456789"), 15000) // 150000 байт: два полных куска и остаток
+
+	result, err := clamd.scanner().Scan(context.Background(), bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if !result.Clean {
+		t.Fatalf("Scan = %+v, want clean", result)
+	}
+
+	s := <-clamd.streams
+	if s.err != nil {
+		t.Fatalf("clamd read: %v", s.err)
+	}
+	if s.command != "zINSTREAM\x00" {
+		t.Fatalf("command = %q", s.command)
+	}
+	want := []int{clamdChunkSize, clamdChunkSize, len(content) - 2*clamdChunkSize}
+	if len(s.chunks) != len(want) {
+		t.Fatalf("chunks = %v, want %v", s.chunks, want)
+	}
+	for i := range want {
+		if s.chunks[i] != want[i] {
+			t.Fatalf("chunks = %v, want %v", s.chunks, want)
+		}
+	}
+	if !bytes.Equal(s.data, content) {
+		t.Fatalf("clamd received %d bytes that differ from the file", len(s.data))
+	}
+}
+
+func TestClamdScannerReplies(t *testing.T) {
+	tests := []struct {
+		reply   string
+		clean   bool
+		threat  string
+		wantErr string
+	}{
+		{reply: "stream: OK", clean: true},
+		{reply: "stream: Eicar-Test-Signature FOUND", threat: "Eicar-Test-Signature"},
+		{reply: "INSTREAM size limit exceeded. ERROR", wantErr: "size limit exceeded"},
+	}
+	for _, tt := range tests {
+		clamd := newFakeClamd(t, tt.reply)
+		result, err := clamd.scanner().Scan(context.Background(), strings.NewReader("data"))
+		<-clamd.streams
+
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%q: err = %v, want %q", tt.reply, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.reply, err)
+			continue
+		}
+		if result.Clean != tt.clean || result.Threat != tt.threat {
+			t.Errorf("%q: result = %+v", tt.reply, result)
+		}
+	}
+}
+
+func TestClamdScannerEmptyFile(t *testing.T) {
+	clamd := newFakeClamd(t, "stream: OK")
+	if _, err := clamd.scanner().Scan(context.Background(), bytes.NewReader(nil)); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if s := <-clamd.streams; len(s.chunks) != 0 || s.err != nil {
+		t.Fatalf("empty file sent chunks %v (err %v)", s.chunks, s.err)
+	}
+}
+
+// stubScanner returns a fixed verdict
+type stubScanner struct {
+	result ScanResult
+	err    error
+}
+
+func (s stubScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	io.Copy(io.Discard, r)
+	return s.result, s.err
+}
+
+func TestScanAttachmentPolicies(t *testing.T) {
+	tests := []struct {
+		name        string
+		scanner     Scanner
+		policy      string
+		wantStatus  string
+		wantReject  bool
+		quarantined bool
+	}{
+		{"clean", stubScanner{result: ScanResult{Clean: true}}, ScanPolicyFailClosed, ScanClean, false, false},
+		{"infected", stubScanner{result: ScanResult{Threat: "Eicar"}}, ScanPolicyFailOpen, ScanInfected, true, true},
+		{"unavailable, fail_open", stubScanner{err: errors.New("connection refused")}, ScanPolicyFailOpen, ScanUnscanned, false, false},
+		{"unavailable, fail_closed", stubScanner{err: errors.New("connection refused")}, ScanPolicyFailClosed, ScanUnscanned, true, true},
+	}
+
+	oldScanner, oldPolicy := fileScanner, config.Scan.Policy
+	t.Cleanup(func() { fileScanner, config.Scan.Policy = oldScanner, oldPolicy })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempBlobStore(t)
+			fileScanner, config.Scan.Policy = tt.scanner, tt.policy
+
+			info, err := blobStore.Put(context.Background(), strings.NewReader("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			att := &Attachment{ID: "a", BlobKey: info.Key, FileName: "a.bin"}
+
+			err = scanAttachment(context.Background(), "alice", att)
+			if tt.wantReject != errors.Is(err, ErrFileRejected) {
+				t.Fatalf("scanAttachment = %v, reject %v", err, tt.wantReject)
+			}
+			if !tt.wantReject && err != nil {
+				t.Fatalf("scanAttachment = %v", err)
+			}
+			if att.ScanStatus != tt.wantStatus {
+				t.Fatalf("ScanStatus = %q, want %q", att.ScanStatus, tt.wantStatus)
+			}
+			if isQuarantined(info.Key) != tt.quarantined {
+				t.Fatalf("quarantined = %v, want %v", !tt.quarantined, tt.quarantined)
+			}
+		})
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/gorilla/websocket"
+)
+
+// SessionsConfig holds the keys that sign session cookies and JWTs, in
+// base64. Empty keys are generated on first start and kept in
+// data/session_keys.json.
+type SessionsConfig struct {
+	CookieKey string `json:"cookie_key,omitempty"`
+	JWTKey    string `json:"jwt_key,omitempty"`
+}
+
+// UserSession is the server-side record of a signed-in browser. The
+// cookie carries a random token; only its hash is stored, and a session
+// without a record is not accepted, so every session can be revoked.
+type UserSession struct {
+	ID         string    `json:"id"` // открытый идентификатор для списка и отзыва
+	TokenHash  string    `json:"token_hash"`
+	Username   string    `json:"username"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastActive time.Time `json:"last_active"`
+}
+
+const (
+	// sessionIdleTimeout matches the lifetime of the session cookie
+	sessionIdleTimeout = 30 * 24 * time.Hour
+	// LastActive is written at most this often, not on every request
+	sessionTouchInterval = time.Minute
+)
+
+// SessionInfo is a session as shown to its owner
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastActive time.Time `json:"last_active"`
+	Current    bool      `json:"current"` // сессия, из которой сделан запрос
+}
+
+// wsSession links a WebSocket to the session that opened it
+type wsSession struct {
+	username  string
+	sessionID string
+}
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+
+	userSessionsFile  = "data/sessions.json"
+	userSessionsMutex sync.Mutex
+
+	wsConns      = make(map[*websocket.Conn]wsSession)
+	wsConnsMutex sync.Mutex
+)
+
+var sessionKeysFile = "data/session_keys.json"
+
+// sessionKeySize is the size of generated keys and the minimum for configured ones
+const sessionKeySize = 32
+
+// initSessionKeys sets up the cookie store and the JWT key. Without its
+// keys the server does not start: a known key would let anyone forge them.
+func initSessionKeys(cfg SessionsConfig) error {
+	cookieKey, err := loadSessionKey("cookie_key", cfg.CookieKey)
+	if err != nil {
+		return err
+	}
+	key, err := loadSessionKey("jwt_key", cfg.JWTKey)
+	if err != nil {
+		return err
+	}
+	store = sessions.NewCookieStore(cookieKey)
+	jwtKey = key
+	return nil
+}
+
+// loadSessionKey uses the configured key, then the stored one, and
+// generates (and stores) a new key as the last resort
+func loadSessionKey(name, configured string) ([]byte, error) {
+	if configured != "" {
+		return decodeSessionKey(name, configured)
+	}
+
+	stored := map[string]string{}
+	data, err := os.ReadFile(sessionKeysFile)
+	if err == nil {
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("%s: %v", sessionKeysFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if encoded, ok := stored[name]; ok {
+		return decodeSessionKey(name, encoded)
+	}
+
+	key := make([]byte, sessionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	stored[name] = base64.StdEncoding.EncodeToString(key)
+	if data, err = json.MarshalIndent(stored, "", "    "); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(sessionKeysFile, data, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func decodeSessionKey(name, encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) < sessionKeySize {
+		return nil, fmt.Errorf("invalid %s: need at least %d bytes in base64", name, sessionKeySize)
+	}
+	return key, nil
+}
+
+func loadUserSessions() []UserSession {
+	data, err := os.ReadFile(userSessionsFile)
+	if err != nil {
+		return []UserSession{}
+	}
+
+	var list []UserSession
+	json.Unmarshal(data, &list)
+	return list
+}
+
+func saveUserSessions(list []UserSession) error {
+	data, err := json.MarshalIndent(list, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(userSessionsFile, data, 0600)
+}
+
+func (s *UserSession) expired() bool {
+	return time.Since(s.LastActive) > sessionIdleTimeout
+}
+
+// createSession records a new session for the request and returns the
+// token to keep in the cookie. Expired sessions are dropped on the way.
+func createSession(r *http.Request, username string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	id, err := randomToken(8)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+
+	userSessionsMutex.Lock()
+	defer userSessionsMutex.Unlock()
+	kept := []UserSession{}
+	for _, s := range loadUserSessions() {
+		if !s.expired() {
+			kept = append(kept, s)
+		}
+	}
+	kept = append(kept, UserSession{
+		ID:         id,
+		TokenHash:  hashToken(token),
+		Username:   username,
+		Device:     deviceName(r.UserAgent()),
+		IP:         clientIP(r),
+		UserAgent:  r.UserAgent(),
+		CreatedAt:  now,
+		LastActive: now,
+	})
+	return token, saveUserSessions(kept)
+}
+
+// touchSession returns the live session for a cookie token and updates
+// its last activity and address
+func touchSession(r *http.Request, token string) *UserSession {
+	if token == "" {
+		return nil
+	}
+	hash := hashToken(token)
+
+	userSessionsMutex.Lock()
+	defer userSessionsMutex.Unlock()
+	list := loadUserSessions()
+	for i := range list {
+		s := &list[i]
+		if s.TokenHash != hash {
+			continue
+		}
+		if s.expired() {
+			return nil
+		}
+		ip := clientIP(r)
+		if time.Since(s.LastActive) >= sessionTouchInterval || s.IP != ip {
+			s.LastActive = time.Now()
+			s.IP = ip
+			saveUserSessions(list)
+		}
+		found := *s
+		return &found
+	}
+	return nil
+}
+
+// currentSessionID returns the ID of the session the request belongs to
+func currentSessionID(r *http.Request) string {
+	session, _ := store.Get(r, "session-name")
+	token, _ := session.Values["sid"].(string)
+	if token == "" {
+		return ""
+	}
+	hash := hashToken(token)
+
+	userSessionsMutex.Lock()
+	defer userSessionsMutex.Unlock()
+	for _, s := range loadUserSessions() {
+		if s.TokenHash == hash {
+			return s.ID
+		}
+	}
+	return ""
+}
+
+// userSessions lists the live sessions of the user, most recently active first
+func userSessions(username string) []UserSession {
+	userSessionsMutex.Lock()
+	list := loadUserSessions()
+	userSessionsMutex.Unlock()
+
+	var result []UserSession
+	for _, s := range list {
+		if s.Username == username && !s.expired() {
+			result = append(result, s)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastActive.After(result[j].LastActive)
+	})
+	return result
+}
+
+// sessionList is userSessions without the token hashes, with the
+// current session marked
+func sessionList(username, currentID string) []SessionInfo {
+	list := []SessionInfo{}
+	for _, s := range userSessions(username) {
+		list = append(list, SessionInfo{
+			ID:         s.ID,
+			Device:     s.Device,
+			IP:         s.IP,
+			UserAgent:  s.UserAgent,
+			CreatedAt:  s.CreatedAt,
+			LastActive: s.LastActive,
+			Current:    s.ID == currentID,
+		})
+	}
+	return list
+}
+
+// removeSessions deletes the user's sessions matching fn, closes their
+// WebSockets and returns how many were removed
+func removeSessions(username string, fn func(UserSession) bool) (int, error) {
+	userSessionsMutex.Lock()
+	kept := []UserSession{}
+	var removed []string
+	for _, s := range loadUserSessions() {
+		if s.Username == username && fn(s) {
+			removed = append(removed, s.ID)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	var err error
+	if len(removed) > 0 {
+		err = saveUserSessions(kept)
+	}
+	userSessionsMutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range removed {
+		closeSessionConns(id)
+	}
+	return len(removed), nil
+}
+
+// revokeSession signs one of the user's sessions out
+func revokeSession(username, id string) error {
+	n, err := removeSessions(username, func(s UserSession) bool { return s.ID == id })
+	if err == nil && n == 0 {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+// revokeOtherSessions signs out every session of the user except keepID
+func revokeOtherSessions(username, keepID string) (int, error) {
+	return removeSessions(username, func(s UserSession) bool { return s.ID != keepID })
+}
+
+// revokeUserSessions signs the user out everywhere and closes all of the
+// user's WebSockets
+func revokeUserSessions(username string) error {
+	_, err := revokeOtherSessions(username, "")
+	disconnectUser(username)
+	return err
+}
+
+// endSession removes the session of a cookie token, on logout
+func endSession(username, token string) {
+	if token == "" {
+		return
+	}
+	hash := hashToken(token)
+	removeSessions(username, func(s UserSession) bool { return s.TokenHash == hash })
+}
+
+// trackSessionConn remembers which session opened a WebSocket, so revoking
+// the session closes it; the returned func forgets the connection
+func trackSessionConn(conn *websocket.Conn, username, sessionID string) func() {
+	wsConnsMutex.Lock()
+	wsConns[conn] = wsSession{username: username, sessionID: sessionID}
+	wsConnsMutex.Unlock()
+	return func() {
+		wsConnsMutex.Lock()
+		delete(wsConns, conn)
+		wsConnsMutex.Unlock()
+	}
+}
+
+// closeSessionConns closes the WebSockets opened by a session
+func closeSessionConns(sessionID string) {
+	closeConns(func(ws wsSession) bool { return ws.sessionID == sessionID })
+}
+
+func closeConns(match func(wsSession) bool) {
+	wsConnsMutex.Lock()
+	var conns []*websocket.Conn
+	for conn, ws := range wsConns {
+		if match(ws) {
+			conns = append(conns, conn)
+		}
+	}
+	wsConnsMutex.Unlock()
+
+	for _, conn := range conns {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked"),
+			time.Now().Add(time.Second))
+		conn.Close()
+	}
+}
+
+// deviceName is a short description of the browser and OS for the session list
+func deviceName(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	var browser, system string
+	// Порядок важен: Edge и Opera содержат "chrome", Chrome содержит "safari"
+	switch {
+	case strings.Contains(ua, "edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "opr/") || strings.Contains(ua, "opera"):
+		browser = "Opera"
+	case strings.Contains(ua, "firefox"):
+		browser = "Firefox"
+	case strings.Contains(ua, "chrome") || strings.Contains(ua, "crios"):
+		browser = "Chrome"
+	case strings.Contains(ua, "safari"):
+		browser = "Safari"
+	case strings.Contains(ua, "curl"):
+		browser = "curl"
+	}
+	switch {
+	case strings.Contains(ua, "android"):
+		system = "Android"
+	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad"):
+		system = "iOS"
+	case strings.Contains(ua, "windows"):
+		system = "Windows"
+	case strings.Contains(ua, "mac os"):
+		system = "macOS"
+	case strings.Contains(ua, "linux"):
+		system = "Linux"
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	return "Unknown device"
+}
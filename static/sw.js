@@ -0,0 +1,17 @@
+// Service worker для Web Push уведомлений
+self.addEventListener('push', event => {
+    const data = event.data ? event.data.json() : {};
+    event.waitUntil(
+        self.registration.showNotification(data.title || 'Chat', {
+            body: data.count > 1 ? `${data.body} (${data.count})\n${data.preview}` : (data.preview || data.body || 'New notification'),
+            tag: data.tag || data.type,
+            renotify: true,
+            data: { url: data.url || '/messages' }
+        })
+    );
+});
+
+self.addEventListener('notificationclick', event => {
+    event.notification.close();
+    event.waitUntil(clients.openWindow(event.notification.data.url));
+});
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"math"
+	"sort"
+	"strings"
+
+	_ "image/gif"
+)
+
+// ThumbnailsConfig controls preview generation for image attachments
+type ThumbnailsConfig struct {
+	Enabled bool           `json:"enabled"`
+	Workers int            `json:"workers"`
+	Sizes   map[string]int `json:"sizes"` // имя размера -> максимальная сторона в пикселях
+}
+
+// Thumbnail is a downscaled copy of an image attachment
+type Thumbnail struct {
+	Size        string `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ContentType string `json:"content_type"`
+	BlobKey     string `json:"blob_key"`
+}
+
+// maxImagePixels protects the workers from decompression bombs
+const maxImagePixels = 40 * 1000 * 1000
+
+var thumbnailJobs chan string
+
+// startThumbnailWorkers starts the worker pool and queues images that
+// have no preview yet (uploaded before previews existed or while the
+// server was stopped)
+func startThumbnailWorkers() {
+	if !config.Thumbnails.Enabled {
+		return
+	}
+	workers := config.Thumbnails.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	thumbnailJobs = make(chan string, 1024)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for id := range thumbnailJobs {
+				if err := generatePreviews(id); err != nil {
+					log.Printf("Preview for attachment %s failed: %v", id, err)
+				}
+			}
+		}()
+	}
+
+	messageHooks.Register(MessageHook{
+		Name:  "thumbnails",
+		Phase: PhasePostPersist,
+		Fn: func(ctx context.Context, msg *Message) error {
+			for i := range msg.Attachments {
+				if needsPreview(&msg.Attachments[i]) {
+					queuePreview(msg.Attachments[i].ID)
+				}
+			}
+			return nil
+		},
+	})
+
+	go func() {
+		for _, msg := range loadMessages() {
+			for i := range msg.Attachments {
+				if needsPreview(&msg.Attachments[i]) {
+					thumbnailJobs <- msg.Attachments[i].ID
+				}
+			}
+		}
+	}()
+}
+
+func needsPreview(att *Attachment) bool {
+	if att == nil || att.Width != 0 {
+		return false
+	}
+	switch att.ContentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+func queuePreview(id string) {
+	select {
+	case thumbnailJobs <- id:
+	default:
+		// Очередь переполнена: превью создастся при следующем запуске
+		log.Printf("Preview queue is full, attachment %s skipped", id)
+	}
+}
+
+// generatePreviews decodes the image, stores its thumbnails and records
+// dimensions, blurhash and thumbnails in the attachment metadata
+func generatePreviews(id string) (err error) {
+	att, _ := findAttachment(id)
+	if !needsPreview(att) {
+		return nil // сообщение удалено или превью уже есть
+	}
+	ctx := context.Background()
+
+	blob, _, err := blobStore.Open(ctx, att.BlobKey)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	cfg, _, err := image.DecodeConfig(blob)
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return fmt.Errorf("image too large to preview (%dx%d)", cfg.Width, cfg.Height)
+	}
+	if _, err := blob.Seek(0, 0); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(blob)
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	preview := Attachment{
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+	}
+
+	// Миниатюры, которые не попали в сообщение, и заменённые старые
+	// освобождаются, иначе они остались бы в хранилище навсегда
+	var unused []string
+	defer func() {
+		if err != nil {
+			unused = thumbnailKeys(preview.Thumbnails)
+		}
+		for _, key := range unused {
+			releaseBlob(key)
+		}
+	}()
+	small := resizeImage(img, fitSize(bounds.Dx(), bounds.Dy(), 32))
+	preview.BlurHash = blurHash(small, 4, 3)
+
+	// От большего размера к меньшему, чтобы уменьшать уже уменьшенное
+	names := make([]string, 0, len(config.Thumbnails.Sizes))
+	for name := range config.Thumbnails.Sizes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return config.Thumbnails.Sizes[names[i]] > config.Thumbnails.Sizes[names[j]]
+	})
+	source := img
+	for _, name := range names {
+		max := config.Thumbnails.Sizes[name]
+		if bounds.Dx() <= max && bounds.Dy() <= max {
+			continue // оригинал и так не больше
+		}
+		thumb := resizeImage(source, fitSize(bounds.Dx(), bounds.Dy(), max))
+		source = thumb
+
+		var buf bytes.Buffer
+		contentType := "image/jpeg"
+		if thumb.Opaque() {
+			err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+		} else {
+			contentType = "image/png"
+			err = png.Encode(&buf, thumb)
+		}
+		if err != nil {
+			return err
+		}
+		info, err := putBlob(ctx, &buf)
+		if err != nil {
+			return err
+		}
+		preview.Thumbnails = append(preview.Thumbnails, Thumbnail{
+			Size:        name,
+			Width:       thumb.Bounds().Dx(),
+			Height:      thumb.Bounds().Dy(),
+			ContentType: contentType,
+			BlobKey:     info.Key,
+		})
+	}
+
+	return updateAttachment(id, func(a *Attachment) {
+		if !needsPreview(a) {
+			// Превью уже создала другая задача: оставляем их
+			unused = thumbnailKeys(preview.Thumbnails)
+			return
+		}
+		unused = thumbnailKeys(a.Thumbnails)
+		a.Width = preview.Width
+		a.Height = preview.Height
+		a.BlurHash = preview.BlurHash
+		a.Thumbnails = preview.Thumbnails
+	})
+}
+
+// updateAttachment applies fn to the stored attachment with the given ID
+func updateAttachment(id string, fn func(*Attachment)) error {
+	return updateMessages(func(messages []Message) ([]Message, error) {
+		for i := range messages {
+			for j := range messages[i].Attachments {
+				if messages[i].Attachments[j].ID == id {
+					fn(&messages[i].Attachments[j])
+					return messages, nil
+				}
+			}
+		}
+		return nil, errors.New("attachment not found")
+	})
+}
+
+// thumbnailKeys returns the blob keys of the thumbnails
+func thumbnailKeys(thumbs []Thumbnail) []string {
+	keys := make([]string, 0, len(thumbs))
+	for _, t := range thumbs {
+		keys = append(keys, t.BlobKey)
+	}
+	return keys
+}
+
+// findThumbnail returns the thumbnail of the given size name
+func (a *Attachment) findThumbnail(size string) *Thumbnail {
+	for i := range a.Thumbnails {
+		if a.Thumbnails[i].Size == size {
+			return &a.Thumbnails[i]
+		}
+	}
+	return nil
+}
+
+// fitSize scales w x h down to fit into max x max, keeping the aspect ratio
+func fitSize(w, h, max int) image.Point {
+	if w <= max && h <= max {
+		return image.Pt(w, h)
+	}
+	if w >= h {
+		return image.Pt(max, int(math.Max(1, math.Round(float64(h)*float64(max)/float64(w)))))
+	}
+	return image.Pt(int(math.Max(1, math.Round(float64(w)*float64(max)/float64(h)))), max)
+}
+
+// resizeImage downscales src with a box filter: every destination pixel
+// is the average of the source pixels it covers
+func resizeImage(src image.Image, size image.Point) *image.RGBA {
+	w, h := size.X, size.Y
+	b := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	}
+	sw, sh := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					bl += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+const blurHashChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHash encodes img as a BlurHash (https://blurha.sh) placeholder
+// with cx x cy components
+func blurHash(img *image.RGBA, cx, cy int) string {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					p := img.RGBAAt(x, y)
+					f[0] += basis * srgbToLinear(p.R)
+					f[1] += basis * srgbToLinear(p.G)
+					f[2] += basis * srgbToLinear(p.B)
+				}
+			}
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			scale := norm / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((cx-1)+(cy-1)*9, 1))
+
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantised+1) / 166
+		hash.WriteString(encodeBase83(quantised, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range factors[1:] {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+	return hash.String()
+}
+
+func encodeBase83(value, length int) string {
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = blurHashChars[value%83]
+		value /= 83
+	}
+	return string(out)
+}
+
+func srgbToLinear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
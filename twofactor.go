@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TwoFactorConfig holds the TOTP (RFC 6238) settings
+type TwoFactorConfig struct {
+	Required bool   `json:"required"` // все пользователи должны включить 2FA
+	Issuer   string `json:"issuer"`   // название в приложении-аутентификаторе
+}
+
+const (
+	totpPeriod        = 30 // seconds
+	totpDigits        = 6
+	totpSkew          = 1 // допустимое расхождение часов, в периодах
+	recoveryCodeCount = 10
+	// pendingLoginTTL is how long the second login step may take
+	pendingLoginTTL = 5 * time.Minute
+)
+
+// Audit action of an admin changing the 2FA requirement
+const LogAdminRequire2FA = "admin_require_2fa"
+
+var (
+	ErrInvalidCode        = errors.New("invalid two-factor code")
+	ErrTwoFactorRequired  = errors.New("two-factor authentication is required")
+	ErrTwoFactorNotActive = errors.New("two-factor authentication is not enabled")
+
+	twoFactorMutex sync.RWMutex
+)
+
+// pendingLogin is a login whose password has been checked and that waits
+// for the second factor. The cookie only holds its token, so the username
+// cannot be forged there; only the hash of the token is kept.
+type pendingLogin struct {
+	username string
+	started  time.Time
+}
+
+var (
+	pendingLogins      = make(map[string]pendingLogin) // хеш токена -> вход
+	pendingLoginsMutex sync.Mutex
+)
+
+// startPendingLogin records a login waiting for the second factor and
+// returns the token to keep in the cookie. Expired ones are dropped.
+func startPendingLogin(username string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+
+	pendingLoginsMutex.Lock()
+	defer pendingLoginsMutex.Unlock()
+	for hash, p := range pendingLogins {
+		if now.Sub(p.started) > pendingLoginTTL {
+			delete(pendingLogins, hash)
+		}
+	}
+	pendingLogins[hashToken(token)] = pendingLogin{username: username, started: now}
+	return token, nil
+}
+
+// findPendingLogin returns the unexpired pending login for a cookie token
+func findPendingLogin(token string) (pendingLogin, bool) {
+	if token == "" {
+		return pendingLogin{}, false
+	}
+	pendingLoginsMutex.Lock()
+	defer pendingLoginsMutex.Unlock()
+	p, ok := pendingLogins[hashToken(token)]
+	if !ok || time.Since(p.started) > pendingLoginTTL {
+		return pendingLogin{}, false
+	}
+	return p, true
+}
+
+// endPendingLogin forgets a pending login once it is finished or abandoned
+func endPendingLogin(token string) {
+	pendingLoginsMutex.Lock()
+	delete(pendingLogins, hashToken(token))
+	pendingLoginsMutex.Unlock()
+}
+
+// twoFactorRequired reports whether the admins require 2FA for everyone
+func twoFactorRequired() bool {
+	twoFactorMutex.RLock()
+	defer twoFactorMutex.RUnlock()
+	return config.TwoFactor.Required
+}
+
+// setTwoFactorRequired changes the requirement and saves it to the config file
+func setTwoFactorRequired(required bool) error {
+	twoFactorMutex.Lock()
+	defer twoFactorMutex.Unlock()
+	config.TwoFactor.Required = required
+	return saveConfig()
+}
+
+// totpCode computes the code for a time step (RFC 4226 dynamic truncation)
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+}
+
+// verifyTOTP checks code against the steps around now. Steps up to
+// lastStep were already used and are refused, so a code cannot be replayed.
+func verifyTOTP(secret, code string, lastStep int64) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for d := int64(-totpSkew); d <= totpSkew; d++ {
+		step := now + d
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// provisioningURI is the otpauth:// URI shown as a QR code to
+// authenticator apps
+func provisioningURI(username, secret string) string {
+	issuer := config.TwoFactor.Issuer
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// beginTwoFactorSetup generates a new secret. It only takes effect after
+// confirmTwoFactor, so a half-finished setup cannot lock the user out.
+func beginTwoFactorSetup(username string) (secret, uri string, err error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", err
+	}
+	secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+	err = updateUser(username, func(u *User) {
+		u.TOTPPending = secret
+	})
+	return secret, provisioningURI(username, secret), err
+}
+
+// confirmTwoFactor enables 2FA once the user proves the app produces valid
+// codes, and returns the recovery codes (shown only this once)
+func confirmTwoFactor(username, code string) ([]string, error) {
+	user := findUser(username)
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	if user.TOTPPending == "" {
+		return nil, errors.New("start the setup first")
+	}
+	step, ok := verifyTOTP(user.TOTPPending, normalizeCode(code), 0)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	return codes, updateUser(username, func(u *User) {
+		u.TOTPSecret = u.TOTPPending
+		u.TOTPPending = ""
+		u.TOTPEnabled = true
+		u.TOTPLastStep = step
+		u.RecoveryCodes = hashes
+	})
+}
+
+// disableTwoFactor turns 2FA off; it needs a valid code and is refused
+// while 2FA is required for everyone
+func disableTwoFactor(username, code string) error {
+	if twoFactorRequired() {
+		return ErrTwoFactorRequired
+	}
+	if err := checkSecondFactor(username, code); err != nil {
+		return err
+	}
+	return updateUser(username, func(u *User) {
+		u.TOTPEnabled = false
+		u.TOTPSecret = ""
+		u.TOTPLastStep = 0
+		u.RecoveryCodes = nil
+	})
+}
+
+// regenerateRecoveryCodes replaces all recovery codes after a valid code
+func regenerateRecoveryCodes(username, code string) ([]string, error) {
+	if err := checkSecondFactor(username, code); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	return codes, updateUser(username, func(u *User) {
+		u.RecoveryCodes = hashes
+	})
+}
+
+// newRecoveryCodes returns the codes and their hashes; only the hashes are stored
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		token, err := randomToken(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = token[:5] + "-" + token[5:]
+		hashes[i] = hashToken(normalizeCode(codes[i]))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeCode drops spaces and dashes users type in codes
+func normalizeCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+// checkSecondFactor accepts a TOTP code or an unused recovery code.
+// A recovery code is used up, and its owner is notified.
+func checkSecondFactor(username, code string) error {
+	user := findUser(username)
+	if user == nil {
+		return ErrUserNotFound
+	}
+	if !user.TOTPEnabled {
+		return ErrTwoFactorNotActive
+	}
+
+	code = normalizeCode(code)
+	var ok, recovery bool
+	var left int
+	err := updateUser(username, func(u *User) {
+		if step, valid := verifyTOTP(u.TOTPSecret, code, u.TOTPLastStep); valid {
+			u.TOTPLastStep = step
+			ok = true
+			return
+		}
+		hash := hashToken(code)
+		for i, h := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+				ok, recovery = true, true
+				left = len(u.RecoveryCodes)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCode
+	}
+	if recovery {
+		notificationService.AddWithPriority(username, "security_recovery_code",
+			fmt.Sprintf("A recovery code was used to sign in to your account, %d left", left), PriorityHigh)
+	}
+	return nil
+}
+
+// requireTwoFactor keeps users without 2FA on the profile page, where
+// they can enable it, while admins require 2FA for everyone
+func requireTwoFactor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !twoFactorRequired() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		session, _ := store.Get(r, "session-name")
+		username, ok := session.Values["username"].(string)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user := findUser(username)
+		if user == nil || user.TOTPEnabled || user.IsBot {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch {
+		case r.URL.Path == "/profile" || r.URL.Path == "/logout" ||
+			strings.HasPrefix(r.URL.Path, "/api/2fa") || strings.HasPrefix(r.URL.Path, "/static/"):
+			next.ServeHTTP(w, r)
+		case r.Method == "GET" && !strings.HasPrefix(r.URL.Path, "/api/"):
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		default:
+			http.Error(w, ErrTwoFactorRequired.Error(), http.StatusForbidden)
+		}
+	})
+}
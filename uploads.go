@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadSession is a resumable upload in progress (tus 1.0 core protocol).
+// The received bytes are kept in <uploads dir>/<id>.part until the upload
+// is complete and moved to the blob store.
+type UploadSession struct {
+	ID         string    `json:"id"`
+	Owner      string    `json:"owner"`
+	FileName   string    `json:"file_name"`
+	Length     int64     `json:"length"`
+	Offset     int64     `json:"offset"`
+	ToUser     string    `json:"to_user"`
+	IsGroup    bool      `json:"is_group"`
+	GroupUsers []string  `json:"group_users,omitempty"`
+	Content    string    `json:"content,omitempty"` // подпись к файлу
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+const tusVersion = "1.0.0"
+
+var (
+	ErrUploadNotFound       = errors.New("upload not found")
+	ErrUploadOffsetMismatch = errors.New("upload offset mismatch")
+	ErrUploadBusy           = errors.New("upload is already being written")
+	ErrChecksumMismatch     = errors.New("checksum mismatch")
+)
+
+var (
+	uploadsFile  = "data/uploads.json"
+	uploadsMutex sync.Mutex
+	// Загрузки, в которые сейчас пишет PATCH-запрос
+	activeUploads   = make(map[string]bool)
+	activeUploadsMu sync.Mutex
+)
+
+func loadUploads() []UploadSession {
+	data, err := os.ReadFile(uploadsFile)
+	if err != nil {
+		return []UploadSession{}
+	}
+
+	var uploads []UploadSession
+	json.Unmarshal(data, &uploads)
+	return uploads
+}
+
+func saveUploads(uploads []UploadSession) error {
+	data, err := json.MarshalIndent(uploads, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(uploadsFile, data, 0644)
+}
+
+func uploadPartPath(id string) string {
+	return filepath.Join(config.Uploads.Dir, id+".part")
+}
+
+func uploadExpiry() time.Duration {
+	return time.Duration(config.Uploads.ExpiryHours) * time.Hour
+}
+
+// findUpload returns the owner's upload session
+func findUpload(id, owner string) (*UploadSession, error) {
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+
+	for _, u := range loadUploads() {
+		if u.ID == id && u.Owner == owner {
+			return &u, nil
+		}
+	}
+	return nil, ErrUploadNotFound
+}
+
+func updateUpload(upload UploadSession) error {
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+
+	uploads := loadUploads()
+	for i := range uploads {
+		if uploads[i].ID == upload.ID {
+			uploads[i] = upload
+			return saveUploads(uploads)
+		}
+	}
+	return ErrUploadNotFound
+}
+
+func removeUpload(id string) error {
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+
+	uploads := loadUploads()
+	for i := range uploads {
+		if uploads[i].ID == id {
+			uploads = append(uploads[:i], uploads[i+1:]...)
+			os.Remove(uploadPartPath(id))
+			return saveUploads(uploads)
+		}
+	}
+	return ErrUploadNotFound
+}
+
+// createUpload starts an upload of length bytes addressed to target
+func createUpload(owner, fileName string, length int64, target Message, content string) (*UploadSession, error) {
+	if err := validateMediaFile(fileName, length); err != nil {
+		return nil, err
+	}
+	if length <= 0 {
+		return nil, errors.New("empty file")
+	}
+
+	// Проверяем получателя сразу, а не после загрузки 50MB.
+	// Без получателя файл станет черновым вложением для следующего сообщения.
+	if target.ToUser != "" || target.IsGroup {
+		target.FromUser = owner
+		target.HasFile = true
+		if target.IsGroup {
+			target.ToUser = "group"
+		}
+		if err := validateMessage(target); err != nil {
+			return nil, err
+		}
+	}
+	// Место резервируется на всю длину загрузки сразу; после записи
+	// загрузки её длина учитывается в использовании сама
+	release, err := reserveQuota(owner, target, length)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	id, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.Uploads.Dir, 0755); err != nil {
+		return nil, err
+	}
+	part, err := os.Create(uploadPartPath(id))
+	if err != nil {
+		return nil, err
+	}
+	part.Close()
+
+	now := time.Now()
+	upload := UploadSession{
+		ID:         id,
+		Owner:      owner,
+		FileName:   filepath.Base(fileName),
+		Length:     length,
+		ToUser:     target.ToUser,
+		IsGroup:    target.IsGroup,
+		GroupUsers: target.GroupUsers,
+		Content:    content,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(uploadExpiry()),
+	}
+
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+	uploads := loadUploads()
+	uploads = append(uploads, upload)
+	if err := saveUploads(uploads); err != nil {
+		os.Remove(uploadPartPath(id))
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// writeUploadChunk appends a chunk starting at offset. When checksum is
+// given ("sha256 <base64>"), a chunk that does not match is discarded.
+// It returns the updated session and, once the last byte is received,
+// the stored attachment and the message it was sent in (nil if staged).
+func writeUploadChunk(ctx context.Context, id, owner string, offset int64, body io.Reader, checksum, ip string) (*UploadSession, *Message, *Attachment, error) {
+	activeUploadsMu.Lock()
+	if activeUploads[id] {
+		activeUploadsMu.Unlock()
+		return nil, nil, nil, ErrUploadBusy
+	}
+	activeUploads[id] = true
+	activeUploadsMu.Unlock()
+	defer func() {
+		activeUploadsMu.Lock()
+		delete(activeUploads, id)
+		activeUploadsMu.Unlock()
+	}()
+
+	upload, err := findUpload(id, owner)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if offset != upload.Offset {
+		return upload, nil, nil, ErrUploadOffsetMismatch
+	}
+
+	var expected []byte
+	var digest hash.Hash
+	if checksum != "" {
+		algo, value, _ := strings.Cut(checksum, " ")
+		if algo != "sha256" {
+			return upload, nil, nil, errors.New("unsupported checksum algorithm")
+		}
+		expected, err = base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return upload, nil, nil, errors.New("invalid checksum")
+		}
+		digest = sha256.New()
+	}
+
+	part, err := os.OpenFile(uploadPartPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return upload, nil, nil, err
+	}
+	defer part.Close()
+	if _, err := part.Seek(upload.Offset, io.SeekStart); err != nil {
+		return upload, nil, nil, err
+	}
+
+	var w io.Writer = part
+	if digest != nil {
+		w = io.MultiWriter(part, digest)
+	}
+	// Больше заявленной длины не принимаем
+	n, copyErr := io.Copy(w, io.LimitReader(body, upload.Length-upload.Offset))
+
+	if digest != nil && (copyErr != nil || string(digest.Sum(nil)) != string(expected)) {
+		// Непроверенный кусок отбрасываем целиком
+		part.Truncate(upload.Offset)
+		if copyErr != nil {
+			return upload, nil, nil, copyErr
+		}
+		return upload, nil, nil, ErrChecksumMismatch
+	}
+
+	// Без контрольной суммы сохраняем всё, что успело прийти: клиент
+	// продолжит с нового смещения после обрыва соединения
+	upload.Offset += n
+	upload.ExpiresAt = time.Now().Add(uploadExpiry())
+	if err := updateUpload(*upload); err != nil {
+		return upload, nil, nil, err
+	}
+	if copyErr != nil {
+		return upload, nil, nil, copyErr
+	}
+
+	if upload.Offset < upload.Length {
+		return upload, nil, nil, nil
+	}
+	msg, att, err := finishUpload(ctx, upload, ip)
+	return upload, msg, att, err
+}
+
+// finishUpload moves a complete upload into the blob store and either
+// posts it or, for uploads without a recipient, stages it for a later message
+func finishUpload(ctx context.Context, upload *UploadSession, ip string) (*Message, *Attachment, error) {
+	part, err := os.Open(uploadPartPath(upload.ID))
+	if err != nil {
+		return nil, nil, err
+	}
+	att, err := storeAttachment(ctx, upload.Owner, upload.FileName, part)
+	part.Close()
+	if isRejectedUpload(err) {
+		// Повторная отправка не поможет: загрузка удаляется
+		removeUpload(upload.ID)
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var msg *Message
+	if upload.isStaged() {
+		att.Caption = upload.Content
+		err = stageAttachments(upload.Owner, []Attachment{*att})
+	} else {
+		var sent Message
+		sent, err = sendMessageWithAttachments(upload.Owner, Message{
+			ToUser:     upload.ToUser,
+			IsGroup:    upload.IsGroup,
+			GroupUsers: upload.GroupUsers,
+			ClientIP:   ip,
+		}, upload.Content, []Attachment{*att})
+		msg = &sent
+	}
+	if err != nil {
+		discardAttachments([]Attachment{*att})
+		return nil, nil, err
+	}
+
+	if err := removeUpload(upload.ID); err != nil {
+		log.Printf("Failed to remove finished upload %s: %v", upload.ID, err)
+	}
+	return msg, att, nil
+}
+
+// isStaged reports whether the upload has no recipient and becomes a
+// staged attachment instead of a message
+func (u *UploadSession) isStaged() bool {
+	return u.ToUser == "" && !u.IsGroup
+}
+
+// expireUploads removes abandoned uploads together with their data
+func expireUploads() {
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+
+	now := time.Now()
+	uploads := loadUploads()
+	kept := uploads[:0]
+	for _, u := range uploads {
+		if now.After(u.ExpiresAt) {
+			os.Remove(uploadPartPath(u.ID))
+			log.Printf("Upload %s by %s expired at offset %d/%d", u.ID, u.Owner, u.Offset, u.Length)
+			continue
+		}
+		kept = append(kept, u)
+	}
+	if len(kept) != len(uploads) {
+		saveUploads(kept)
+	}
+}
+
+// startUploadJanitor periodically expires abandoned uploads
+func startUploadJanitor() {
+	go func() {
+		for {
+			expireUploads()
+			expireStagedAttachments()
+			expireBlobLeases()
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+}
+
+// cancelUpload deletes an unfinished upload of owner
+func cancelUpload(id, owner string) error {
+	if _, err := findUpload(id, owner); err != nil {
+		return err
+	}
+	return removeUpload(id)
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header:
+// comma-separated "key base64(value)" pairs
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.New("invalid Upload-Metadata")
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
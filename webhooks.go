@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IncomingWebhook lets external systems (CI, monitoring) post into a group
+type IncomingWebhook struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	TokenHash  string    `json:"token_hash,omitempty"`
+	GroupUsers []string  `json:"group_users"`
+	Channel    string    `json:"channel,omitempty"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+// SlackPayload is the subset of the Slack incoming webhook format we accept
+type SlackPayload struct {
+	Text        string            `json:"text"`
+	Username    string            `json:"username"`
+	Attachments []SlackAttachment `json:"attachments"`
+	Blocks      []SlackBlock      `json:"blocks"`
+}
+
+type SlackAttachment struct {
+	Fallback   string       `json:"fallback"`
+	Pretext    string       `json:"pretext"`
+	AuthorName string       `json:"author_name"`
+	Title      string       `json:"title"`
+	TitleLink  string       `json:"title_link"`
+	Text       string       `json:"text"`
+	Fields     []SlackField `json:"fields"`
+	Footer     string       `json:"footer"`
+}
+
+type SlackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type SlackBlock struct {
+	Type     string      `json:"type"` // header, section, context, divider
+	Text     *SlackText  `json:"text,omitempty"`
+	Fields   []SlackText `json:"fields,omitempty"`
+	Elements []SlackText `json:"elements,omitempty"`
+}
+
+type SlackText struct {
+	Type string `json:"type"` // plain_text, mrkdwn
+	Text string `json:"text"`
+}
+
+// webhookSenderPrefix puts webhook senders in their own namespace: no
+// account can be named like them, so nobody takes over a webhook's posts
+// by registering its name, even after the webhook is deleted
+const webhookSenderPrefix = "hook:"
+
+var (
+	ErrReservedUsername = errors.New("usernames starting with \"" + webhookSenderPrefix + "\" are reserved")
+	// ErrOwnerInactive stops bots and webhooks of disabled, suspended or deleted accounts
+	ErrOwnerInactive = errors.New("owner account is not active")
+)
+
+var (
+	webhooksFile  = "data/webhooks.json"
+	webhooksMutex sync.RWMutex
+	// <https://example.com|текст> и <https://example.com> в Slack mrkdwn
+	slackLinkPattern = regexp.MustCompile(`<((?:https?|mailto):[^|>]+)(?:\|([^>]+))?>`)
+	slackBoldPattern = regexp.MustCompile(`(^|\s)\*([^*\n]+)\*`)
+)
+
+func loadIncomingWebhooks() []IncomingWebhook {
+	webhooksMutex.RLock()
+	defer webhooksMutex.RUnlock()
+
+	data, err := os.ReadFile(webhooksFile)
+	if err != nil {
+		return []IncomingWebhook{}
+	}
+
+	var hooks []IncomingWebhook
+	json.Unmarshal(data, &hooks)
+	return hooks
+}
+
+func saveIncomingWebhooks(hooks []IncomingWebhook) error {
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+
+	data, err := json.MarshalIndent(hooks, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(webhooksFile, data, 0600)
+}
+
+// hashToken returns the hex SHA-256 of a secret token for storage
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// createIncomingWebhook registers a webhook bound to the group and returns
+// it together with the secret token, which is only shown once
+func createIncomingWebhook(creator, name, channel string, groupUsers []string) (IncomingWebhook, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return IncomingWebhook{}, "", errors.New("webhook name is required")
+	}
+	if findUser(strings.TrimSpace(name)) != nil {
+		return IncomingWebhook{}, "", errors.New("webhook name must not match an existing user")
+	}
+	if len(groupUsers) < 2 {
+		return IncomingWebhook{}, "", errors.New("group must have at least 2 members")
+	}
+	for _, u := range groupUsers {
+		if user := findUser(u); user == nil || user.Deleted {
+			return IncomingWebhook{}, "", fmt.Errorf("user %s does not exist", u)
+		}
+	}
+
+	id, err := randomToken(8)
+	if err != nil {
+		return IncomingWebhook{}, "", err
+	}
+	token, err := randomToken(24)
+	if err != nil {
+		return IncomingWebhook{}, "", err
+	}
+
+	hook := IncomingWebhook{
+		ID:         id,
+		Name:       strings.TrimSpace(name),
+		TokenHash:  hashToken(token),
+		GroupUsers: groupUsers,
+		Channel:    strings.TrimSpace(channel),
+		CreatedBy:  creator,
+		CreatedAt:  time.Now(),
+	}
+	hooks := loadIncomingWebhooks()
+	if err := saveIncomingWebhooks(append(hooks, hook)); err != nil {
+		return IncomingWebhook{}, "", err
+	}
+	return hook, token, nil
+}
+
+func deleteIncomingWebhook(id string) error {
+	hooks := loadIncomingWebhooks()
+	for i := range hooks {
+		if hooks[i].ID == id {
+			return saveIncomingWebhooks(append(hooks[:i], hooks[i+1:]...))
+		}
+	}
+	return errors.New("webhook not found")
+}
+
+func findIncomingWebhook(id string) *IncomingWebhook {
+	for _, h := range loadIncomingWebhooks() {
+		if h.ID == id {
+			return &h
+		}
+	}
+	return nil
+}
+
+// authenticateIncomingWebhook returns the webhook if the token matches
+func authenticateIncomingWebhook(id, token string) (*IncomingWebhook, error) {
+	hook := findIncomingWebhook(id)
+	if hook == nil {
+		return nil, errors.New("webhook not found")
+	}
+	if subtle.ConstantTimeCompare([]byte(hook.TokenHash), []byte(hashToken(token))) != 1 {
+		return nil, errors.New("invalid webhook token")
+	}
+	if !findUser(hook.CreatedBy).isActive() {
+		return nil, ErrOwnerInactive
+	}
+	return hook, nil
+}
+
+func touchIncomingWebhook(id string) {
+	hooks := loadIncomingWebhooks()
+	for i := range hooks {
+		if hooks[i].ID == id {
+			hooks[i].LastUsedAt = time.Now()
+			saveIncomingWebhooks(hooks)
+			return
+		}
+	}
+}
+
+// postIncomingWebhook renders the payload and posts it to the webhook's
+// group like a normal group message, including the live broadcast
+func postIncomingWebhook(hook *IncomingWebhook, payload SlackPayload, ip string) (Message, error) {
+	markdown := slackPayloadToMarkdown(payload)
+	if strings.TrimSpace(markdown) == "" {
+		return Message{}, errors.New("no_text")
+	}
+
+	// Отправителем остаётся вебхук; username из запроса — только подпись,
+	// и она не может совпадать с настоящей учётной записью
+	label := strings.TrimSpace(payload.Username)
+	if label != "" && findUser(label) != nil {
+		return Message{}, errors.New("invalid_username")
+	}
+
+	msg := Message{
+		FromUser:   webhookSenderPrefix + hook.Name,
+		SenderName: label,
+		ToUser:     "group",
+		Content:    markdown,
+		CreatedAt:  time.Now(),
+		IsGroup:    true,
+		GroupUsers: hook.GroupUsers,
+		Webhook:    hook.ID,
+		ClientIP:   ip,
+	}
+	if err := appendMessage(&msg); err != nil {
+		return Message{}, err
+	}
+	touchIncomingWebhook(hook.ID)
+
+	deliverMessage(msg)
+	return msg, nil
+}
+
+// slackPayloadToMarkdown converts text, attachments and blocks to Markdown
+func slackPayloadToMarkdown(p SlackPayload) string {
+	var parts []string
+	if p.Text != "" {
+		parts = append(parts, slackToMarkdown(p.Text))
+	}
+
+	for _, b := range p.Blocks {
+		switch b.Type {
+		case "header":
+			if b.Text != nil {
+				parts = append(parts, "### "+b.Text.Text)
+			}
+		case "section":
+			if b.Text != nil {
+				parts = append(parts, slackToMarkdown(b.Text.Text))
+			}
+			for _, f := range b.Fields {
+				parts = append(parts, "- "+slackToMarkdown(f.Text))
+			}
+		case "context":
+			var texts []string
+			for _, e := range b.Elements {
+				if e.Text != "" {
+					texts = append(texts, slackToMarkdown(e.Text))
+				}
+			}
+			if len(texts) > 0 {
+				parts = append(parts, "_"+strings.Join(texts, " · ")+"_")
+			}
+		case "divider":
+			parts = append(parts, "---")
+		}
+	}
+
+	for _, a := range p.Attachments {
+		var lines []string
+		if a.Pretext != "" {
+			lines = append(lines, slackToMarkdown(a.Pretext))
+		}
+		if a.AuthorName != "" {
+			lines = append(lines, "_"+a.AuthorName+"_")
+		}
+		switch {
+		case a.Title != "" && a.TitleLink != "":
+			lines = append(lines, fmt.Sprintf("**[%s](%s)**", a.Title, a.TitleLink))
+		case a.Title != "":
+			lines = append(lines, "**"+a.Title+"**")
+		}
+		if a.Text != "" {
+			lines = append(lines, slackToMarkdown(a.Text))
+		}
+		for _, f := range a.Fields {
+			lines = append(lines, fmt.Sprintf("- **%s**: %s", f.Title, slackToMarkdown(f.Value)))
+		}
+		if a.Footer != "" {
+			lines = append(lines, "_"+a.Footer+"_")
+		}
+		if len(lines) == 0 && a.Fallback != "" {
+			lines = append(lines, a.Fallback)
+		}
+		parts = append(parts, strings.Join(lines, "\n\n"))
+	}
+
+	return strings.Join(parts, "\n\n")
+}
+
+// slackToMarkdown converts Slack mrkdwn links and bold to Markdown
+func slackToMarkdown(text string) string {
+	text = slackLinkPattern.ReplaceAllStringFunc(text, func(match string) string {
+		m := slackLinkPattern.FindStringSubmatch(match)
+		if m[2] == "" {
+			return m[1]
+		}
+		return fmt.Sprintf("[%s](%s)", m[2], m[1])
+	})
+	// *жирный* в Slack соответствует **жирный** в Markdown
+	return slackBoldPattern.ReplaceAllString(text, "$1**$2**")
+}